@@ -0,0 +1,122 @@
+// Package basemap serves background map tiles from a local MBTiles file, so the map doesn't need a tile service.
+// MBTiles is described at https://github.com/mapbox/mbtiles-spec
+package basemap
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"strconv"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// ErrNoTile is returned for a tile that isn't in the file.
+var ErrNoTile = errors.New("no such tile")
+
+// The content types of the tile formats MBTiles allows. pbf is vector tiles.
+var contentTypes = map[string]string{
+	"png":  "image/png",
+	"jpg":  "image/jpeg",
+	"webp": "image/webp",
+	"pbf":  "application/vnd.mapbox-vector-tile",
+}
+
+// MBTiles is an open MBTiles file and what its metadata says about it.
+type MBTiles struct {
+	db *sql.DB
+	// Format: png, jpg, webp or pbf.
+	Format      string
+	Name        string
+	Attribution string
+	MinZoom     int
+	MaxZoom     int
+}
+
+// Open opens an MBTiles file read only, and reads its metadata. Files without a format in their
+// metadata are taken to be png.
+func Open(path string) (*MBTiles, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+
+	m := &MBTiles{db: db, Format: "png", MaxZoom: 22}
+	rows, err := db.Query(`SELECT name, value FROM metadata;`)
+	if err != nil {
+		db.Close()
+		return nil, errors.New(path + " isn't an MBTiles file: " + err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, value string
+		err = rows.Scan(&name, &value)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		switch name {
+		case "format":
+			m.Format = value
+		case "name":
+			m.Name = value
+		case "attribution":
+			m.Attribution = value
+		case "minzoom":
+			m.MinZoom, _ = strconv.Atoi(value)
+		case "maxzoom":
+			m.MaxZoom, _ = strconv.Atoi(value)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if _, ok := contentTypes[m.Format]; !ok {
+		db.Close()
+		return nil, errors.New(path + " has tiles in " + m.Format + ", which isn't png, jpg, webp or pbf")
+	}
+	var tiles int
+	err = db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name='tiles';`).Scan(&tiles)
+	if err != nil || tiles == 0 {
+		db.Close()
+		return nil, errors.New(path + " has no tiles table")
+	}
+	return m, nil
+}
+
+// Close closes the file.
+func (m *MBTiles) Close() error {
+	return m.db.Close()
+}
+
+// Vector is whether the tiles are vector tiles rather than images.
+func (m *MBTiles) Vector() bool {
+	return m.Format == "pbf"
+}
+
+// ContentType is the content type of the tiles.
+func (m *MBTiles) ContentType() string {
+	return contentTypes[m.Format]
+}
+
+// Tile returns the tile at z, x, y in the XYZ scheme Leaflet uses, and whether it's gzipped, as vector
+// tiles in MBTiles usually are. MBTiles counts rows from the south, so y is flipped.
+func (m *MBTiles) Tile(z int, x int, y int) ([]byte, bool, error) {
+	if z < 0 || z > 30 {
+		return nil, false, ErrNoTile
+	}
+	row := (1<<uint(z) - 1) - y
+
+	var data []byte
+	err := m.db.QueryRow(`SELECT tile_data FROM tiles WHERE zoom_level=$1 AND tile_column=$2 AND tile_row=$3;`, z, x, row).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, false, ErrNoTile
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return data, bytes.HasPrefix(data, []byte{0x1f, 0x8b}), nil
+}
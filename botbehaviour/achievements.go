@@ -0,0 +1,441 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alexalexyang/botschaft/config"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	// How many different restaurants and friends the Gourmet and Social butterfly badges need.
+	gourmetRestaurants = 100
+	socialFriends      = 10
+	// The most countries asked of Overpass in a tick, so a backlog doesn't flood it.
+	maxCountryLookups = 10
+	// The size in degrees of the cells countries are kept for, about a kilometre north to south. Every POI in a cell
+	// gets the country found for the first one looked up, so only places within a cell of a border can be wrong.
+	countryCellSize = 0.01
+	// How many bots each leaderboard shows.
+	leaderboardSize = 10
+)
+
+// An achievement every bot can earn once. earned says whether a bot has earned it.
+type achievement struct {
+	ID          string
+	Name        string
+	Description string
+	earned      func(db *sql.DB, botID int) (bool, error)
+}
+
+// The achievements besides countries, which are worked out per bot in countryBadges.
+var achievements = []achievement{
+	{
+		ID:          "gourmet",
+		Name:        "Gourmet",
+		Description: "Visited " + strconv.Itoa(gourmetRestaurants) + " different restaurants.",
+		earned: func(db *sql.DB, botID int) (bool, error) {
+			return atLeast(db, gourmetRestaurants, `SELECT COUNT(DISTINCT p.osmid) FROM botpois p JOIN poitags t ON t.osmid = p.osmid
+			WHERE p.botid=$1 AND p.visitype="visited" AND t.amenity='restaurant';`, botID)
+		},
+	},
+	{
+		ID:          "well-documented",
+		Name:        "Well documented",
+		Description: "Visited a place with every tag we think OSM should have.",
+		earned: func(db *sql.DB, botID int) (bool, error) {
+			return atLeast(db, 1, `SELECT COUNT(*) FROM botpois p JOIN poitags t ON t.osmid = p.osmid
+			WHERE p.botid=$1 AND p.visitype="visited" AND t.completeness >= 1;`, botID)
+		},
+	},
+	{
+		ID:          "social-butterfly",
+		Name:        "Social butterfly",
+		Description: "Met " + strconv.Itoa(socialFriends) + " other bots.",
+		earned: func(db *sql.DB, botID int) (bool, error) {
+			return atLeast(db, socialFriends, `SELECT COUNT(*) FROM botfriends WHERE botid=$1;`, botID)
+		},
+	},
+}
+
+// Whether query, which counts something for a bot, counts at least n.
+func atLeast(db *sql.DB, n int, query string, botID int) (bool, error) {
+	var count int
+	err := db.QueryRow(query, botID).Scan(&count)
+	return count >= n, err
+}
+
+// A badge a bot was awarded.
+type badge struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Awarded     string `json:"awarded"`
+}
+
+func createAchievementTables(db dbtx) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS botachievements (
+		botid INTEGER,
+		achievement TEXT,
+		name TEXT,
+		description TEXT,
+		awarded TEXT,
+		PRIMARY KEY (botid, achievement)
+	);`)
+	check(err)
+
+	// The country each visited POI is in. code is "" for POIs in no country, like at sea.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS poicountries (
+		osmid INTEGER PRIMARY KEY,
+		code TEXT,
+		name TEXT
+	);`)
+	check(err)
+
+	// The country found for each cell of countryCellSize degrees, by the cell's south west corner in cells.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS countrycells (
+		latcell INTEGER,
+		loncell INTEGER,
+		code TEXT,
+		name TEXT,
+		PRIMARY KEY (latcell, loncell)
+	);`)
+	check(err)
+}
+
+// The countrycells cell lat, lon is in.
+func countryCell(lat float64, lon float64) (int, int) {
+	return int(math.Floor(lat / countryCellSize)), int(math.Floor(lon / countryCellSize))
+}
+
+type overpassAreas struct {
+	Elements []struct {
+		Tags map[string]string `json:"tags"`
+	} `json:"elements"`
+}
+
+// Asks Overpass which country lat, lon is in. Returns its ISO 3166-1 code and English name, or "" for no country.
+func lookupCountry(client *http.Client, overpassURL string, lat float64, lon float64) (string, string, error) {
+	point := strconv.FormatFloat(lat, 'f', 6, 64) + "," + strconv.FormatFloat(lon, 'f', 6, 64)
+	query := "[out:json];is_in(" + point + ")->.a;area.a[admin_level=2][boundary=administrative];out tags;"
+
+	start := time.Now()
+	resp, err := client.Get(overpassURL + "?data=" + url.QueryEscape(query))
+	overpassDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		overpassErrors.Inc()
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		overpassErrors.Inc()
+		return "", "", errors.New("overpass returned " + resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", err
+	}
+	areas := overpassAreas{}
+	err = json.Unmarshal(body, &areas)
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, area := range areas.Elements {
+		code := area.Tags["ISO3166-1"]
+		if code == "" {
+			continue
+		}
+		name := area.Tags["name:en"]
+		if name == "" {
+			name = area.Tags["name"]
+		}
+		return code, name, nil
+	}
+	return "", "", nil
+}
+
+// Finds the countries of the visited POIs that don't have one yet, from countrycells, or from Overpass for POIs
+// in cells no country has been found for. At most maxCountryLookups are asked of Overpass; the rest, and
+// everything after Overpass fails, wait for the next tick.
+func locateVisits(logger *slog.Logger, db *sql.DB, client *http.Client, overpassURL string) {
+	rows, err := db.Query(`SELECT osmid, MIN(latitude), MIN(longitude) FROM botpois
+	WHERE visitype="visited" AND osmid IS NOT NULL AND osmid NOT IN (SELECT osmid FROM poicountries)
+	GROUP BY osmid ORDER BY osmid;`)
+	check(err)
+
+	type visit struct {
+		osmid    int
+		lat, lon float64
+	}
+	visits := []visit{}
+	for rows.Next() {
+		v := visit{}
+		err = rows.Scan(&v.osmid, &v.lat, &v.lon)
+		check(err)
+		visits = append(visits, v)
+	}
+	err = rows.Err()
+	check(err)
+	rows.Close()
+
+	lookups := 0
+	for _, v := range visits {
+		latCell, lonCell := countryCell(v.lat, v.lon)
+		var code, name string
+		err = db.QueryRow(`SELECT code, name FROM countrycells WHERE latcell=$1 AND loncell=$2;`, latCell, lonCell).Scan(&code, &name)
+		if err == sql.ErrNoRows {
+			if lookups == maxCountryLookups {
+				continue
+			}
+			lookups++
+			code, name, err = lookupCountry(client, overpassURL, v.lat, v.lon)
+			if err != nil {
+				logger.Warn("can't look up country", "osmid", v.osmid, "err", err)
+				return
+			}
+			_, err = db.Exec(`INSERT OR REPLACE INTO countrycells (latcell, loncell, code, name) values ($1, $2, $3, $4);`,
+				latCell, lonCell, code, name)
+		}
+		check(err)
+		_, err = db.Exec(`INSERT OR REPLACE INTO poicountries (osmid, code, name) values ($1, $2, $3);`, v.osmid, code, name)
+		check(err)
+	}
+}
+
+// A badge for each country a bot has visited a POI in.
+func countryBadges(db *sql.DB, botID int) ([]badge, error) {
+	rows, err := db.Query(`SELECT DISTINCT c.code, c.name FROM botpois p JOIN poicountries c ON c.osmid = p.osmid
+	WHERE p.botid=$1 AND p.visitype="visited" AND c.code != '' ORDER BY c.code;`, botID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	badges := []badge{}
+	for rows.Next() {
+		var code, name string
+		err = rows.Scan(&code, &name)
+		if err != nil {
+			return nil, err
+		}
+		badges = append(badges, badge{
+			ID:          "country-" + strings.ToLower(code),
+			Name:        "Been to " + name,
+			Description: "Visited " + name + " for the first time.",
+		})
+	}
+	return badges, rows.Err()
+}
+
+// The badges a bot has earned but hasn't been awarded yet.
+func newBadges(db *sql.DB, botID int) ([]badge, error) {
+	held := map[string]bool{}
+	for _, b := range getBadges(db, botID) {
+		held[b.ID] = true
+	}
+
+	earned, err := countryBadges(db, botID)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range achievements {
+		ok, err := a.earned(db, botID)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			earned = append(earned, badge{ID: a.ID, Name: a.Name, Description: a.Description})
+		}
+	}
+
+	badges := []badge{}
+	for _, b := range earned {
+		if !held[b.ID] {
+			badges = append(badges, b)
+		}
+	}
+	return badges, nil
+}
+
+// Checks every bot's achievements after a tick, and awards the badges they've earned, each with an
+// "achievement" event.
+func awardAchievements(logger *slog.Logger, db *sql.DB, cfg config.Config, bots []bot) {
+	// Bots searching local POIs are usually offline, so countries aren't looked up for them.
+	if cfg.POISource != "local" {
+		locateVisits(logger, db, overpassClient(cfg), cfg.OverpassURL)
+	}
+
+	for _, b := range bots {
+		badges, err := newBadges(db, b.ID)
+		check(err)
+		if len(badges) == 0 {
+			continue
+		}
+
+		awardedAt := now().UTC().Format(time.RFC3339)
+		err = inBotTx(db, b.ID, func(tx *sql.Tx) error {
+			for _, awarded := range badges {
+				_, err := tx.Exec(`INSERT OR IGNORE INTO botachievements (botid, achievement, name, description, awarded)
+				values ($1, $2, $3, $4, $5);`, b.ID, awarded.ID, awarded.Name, awarded.Description, awardedAt)
+				if err != nil {
+					return err
+				}
+				err = recordEvent(tx, b.ID, "achievement", map[string]interface{}{"id": awarded.ID, "name": awarded.Name})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		// Bots deleted since the tick started don't get badges.
+		if errors.Is(err, errBotGone) {
+			continue
+		}
+		check(err)
+		for _, awarded := range badges {
+			logger.Info("bot earned an achievement", "bot_id", b.ID, "achievement", awarded.ID)
+		}
+	}
+}
+
+// Gets the badges a bot has been awarded, oldest first.
+func getBadges(db *sql.DB, botID int) []badge {
+	rows, err := db.Query(`SELECT achievement, name, description, awarded FROM botachievements
+	WHERE botid=$1 ORDER BY awarded, achievement;`, botID)
+	check(err)
+	defer rows.Close()
+
+	badges := []badge{}
+	for rows.Next() {
+		b := badge{}
+		err = rows.Scan(&b.ID, &b.Name, &b.Description, &b.Awarded)
+		check(err)
+		badges = append(badges, b)
+	}
+	err = rows.Err()
+	check(err)
+	return badges
+}
+
+// GetAchievements returns the badges a bot has been awarded, oldest first, as JSON. Returns false if there is
+// no such bot.
+func GetAchievements(db *sql.DB, botID int) ([]byte, bool) {
+	if _, ok := getBot(db, botID); !ok {
+		return nil, false
+	}
+
+	badgesJSON, err := json.Marshal(getBadges(db, botID))
+	check(err)
+	return badgesJSON, true
+}
+
+// A bot's place on a leaderboard.
+type leaderboardEntry struct {
+	ID    int     `json:"id"`
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+}
+
+// Leaderboards are the bots that have gone furthest, visited the most different POIs, and found the most
+// POIs with missing tags.
+type Leaderboards struct {
+	// Distance: km travelled, adding up the straight lines between moves.
+	Distance   []leaderboardEntry `json:"distance"`
+	UniquePOIs []leaderboardEntry `json:"uniquepois"`
+	// DataGaps: different visited POIs that are missing some of the tags in expectedTags.
+	DataGaps []leaderboardEntry `json:"datagaps"`
+}
+
+// The top leaderboardSize of values, biggest first. Ties go to the older bot.
+func topBots(names map[int]string, values map[int]float64) []leaderboardEntry {
+	entries := []leaderboardEntry{}
+	for id, value := range values {
+		if name, ok := names[id]; ok && value > 0 {
+			entries = append(entries, leaderboardEntry{id, name, value})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Value != entries[j].Value {
+			return entries[i].Value > entries[j].Value
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	if len(entries) > leaderboardSize {
+		entries = entries[:leaderboardSize]
+	}
+	return entries
+}
+
+// Runs query, which returns a bot ID and a count per bot.
+func countsByBot(db *sql.DB, query string) map[int]float64 {
+	rows, err := db.Query(query)
+	check(err)
+	defer rows.Close()
+
+	counts := map[int]float64{}
+	for rows.Next() {
+		var botID int
+		var count float64
+		err = rows.Scan(&botID, &count)
+		check(err)
+		counts[botID] = count
+	}
+	err = rows.Err()
+	check(err)
+	return counts
+}
+
+// GetLeaderboards gets the leaderboards. Deleted bots aren't on them.
+func GetLeaderboards(db *sql.DB) Leaderboards {
+	names := map[int]string{}
+	rows, err := db.Query(`SELECT BotID, COALESCE(Name, '') FROM bots;`)
+	check(err)
+	for rows.Next() {
+		var id int
+		var name string
+		err = rows.Scan(&id, &name)
+		check(err)
+		names[id] = name
+	}
+	err = rows.Err()
+	check(err)
+	rows.Close()
+
+	distances := map[int]float64{}
+	rows, err = db.Query(`SELECT botid, fromlat, fromlon, tolat, tolon FROM botmoves;`)
+	check(err)
+	for rows.Next() {
+		var botID int
+		var fromLat, fromLon, toLat, toLon float64
+		err = rows.Scan(&botID, &fromLat, &fromLon, &toLat, &toLon)
+		check(err)
+		distances[botID] += haversine(fromLon, fromLat, toLon, toLat)
+	}
+	err = rows.Err()
+	check(err)
+	rows.Close()
+	for botID, km := range distances {
+		distances[botID] = math.Round(km*10) / 10
+	}
+
+	return Leaderboards{
+		Distance: topBots(names, distances),
+		UniquePOIs: topBots(names, countsByBot(db, `SELECT botid, COUNT(DISTINCT osmid) FROM botpois
+		WHERE visitype="visited" AND osmid IS NOT NULL GROUP BY botid;`)),
+		DataGaps: topBots(names, countsByBot(db, `SELECT p.botid, COUNT(DISTINCT p.osmid) FROM botpois p
+		JOIN poitags t ON t.osmid = p.osmid WHERE p.visitype="visited" AND t.completeness < 1 GROUP BY p.botid;`)),
+	}
+}
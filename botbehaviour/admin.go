@@ -0,0 +1,154 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/alexalexyang/botschaft/config"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// What the command line uses to look after bots without the web server.
+
+// Migrate creates every table botbehaviour keeps things in, and the spatial indexes, if they don't exist yet.
+// Nothing else makes them, so it runs before anything uses the database. Bots without a routine are given the default one.
+func Migrate(db *sql.DB) {
+	err := inTx(db, func(tx *sql.Tx) error {
+		createBotTypeTables(tx)
+		createSettingsTable(tx)
+		createSearchTable(tx)
+		createRoutineTable(tx)
+		saveMissingRoutines(tx)
+		createTickTable(tx)
+		createEventsTable(tx)
+		createGeofenceTables(tx)
+		createMovesTable(tx)
+		createPOITagsTable(tx)
+		createVisitedTagsTable(tx)
+		createFriendsTables(tx)
+		createAchievementTables(tx)
+		createLocalPOIsTable(tx)
+		createPersonalityTable(tx)
+		return nil
+	})
+	check(err)
+	ensureSpatialIndex(db)
+}
+
+// BotSummary is a line about a bot for listing them.
+type BotSummary struct {
+	ID     int
+	UserID int
+	Name   string
+	Type   string
+	Lat    float64
+	Lon    float64
+	Radius float64
+	Paused bool
+	Stuck  bool
+}
+
+// ListBots lists every bot, whatever its type, in order of ID.
+func ListBots(db *sql.DB) []BotSummary {
+	rows, err := db.Query(`SELECT b.BotID, COALESCE(b.UserID, 0), COALESCE(b.Name, ''), COALESCE(b.bottype, ''),
+	COALESCE(b.Lat, 0), COALESCE(b.Lon, 0), COALESCE(b.Radius, 0), COALESCE(s.paused, 0), COALESCE(f.stuck, 0)
+	FROM bots b LEFT JOIN botsettings s ON s.botid = b.BotID LEFT JOIN botsearch f ON f.botid = b.BotID
+	ORDER BY b.BotID;`)
+	check(err)
+	defer rows.Close()
+
+	bots := []BotSummary{}
+	for rows.Next() {
+		b := BotSummary{}
+		err = rows.Scan(&b.ID, &b.UserID, &b.Name, &b.Type, &b.Lat, &b.Lon, &b.Radius, &b.Paused, &b.Stuck)
+		check(err)
+		bots = append(bots, b)
+	}
+	err = rows.Err()
+	check(err)
+	return bots
+}
+
+// PlaceBot puts a bot at lat, lon without it travelling there, so it isn't saved as a move. A tick the bot
+// was part way through is dropped, and its next tick searches from where it is now.
+func PlaceBot(db *sql.DB, botID int, lat float64, lon float64) error {
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return errors.New("lat and lon must be a valid latitude and longitude")
+	}
+	b, ok := getBot(db, botID)
+	if !ok {
+		return noBot(botID)
+	}
+
+	unlock := lockBot(botID)
+	defer unlock()
+
+	err := inTx(db, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`UPDATE bots SET Lat=$1, Lon=$2 WHERE BotID=$3;`, lat, lon, botID)
+		if err != nil {
+			return err
+		}
+		return setTickState(tx, botID, tickState{State: stateIdle})
+	})
+	if err == nil {
+		invalidateTiles([2]float64{b.Lat, b.Lon}, [2]float64{lat, lon})
+	}
+	return err
+}
+
+// TickBot is what a bot did in a tick run with RunTick. From and To are lat, lon.
+type TickBot struct {
+	ID     int
+	Name   string
+	Slot   string
+	From   [2]float64
+	To     [2]float64
+	Paused bool
+	Stuck  bool
+	// Failed: the bot failed a step, and carries on from its last step next tick.
+	Failed bool
+	// Visited: the OSM ID of the POI the bot went to, or 0 if it didn't go to one.
+	Visited int
+}
+
+// TickReport is what happened in a tick run with RunTick.
+type TickReport struct {
+	Bots     []TickBot
+	Duration time.Duration
+}
+
+// RunTick runs one travel tick now, like GoTravel does every cfg.TickInterval, and reports what each bot did.
+// Bots that failed are marked Failed, and the others' moves are still saved. If every bot failed, the error says so.
+func RunTick(logger *slog.Logger, db *sql.DB, cfg config.Config) (TickReport, error) {
+	from := map[int][2]float64{}
+	for _, b := range ListBots(db) {
+		from[b.ID] = [2]float64{b.Lat, b.Lon}
+	}
+
+	start := time.Now()
+	bots, failed, err := runTick(logger, db, cfg)
+	report := TickReport{Bots: []TickBot{}, Duration: time.Since(start)}
+	if err != nil {
+		return report, err
+	}
+
+	for _, b := range bots {
+		moved := TickBot{
+			ID:     b.ID,
+			Name:   b.Name,
+			Slot:   b.Slot.Name,
+			From:   from[b.ID],
+			To:     [2]float64{b.Lat, b.Lon},
+			Paused: b.Paused,
+			Stuck:  b.Stuck,
+			Failed: failed[b.ID],
+		}
+		if !b.Paused && b.Tick.State == stateMoved {
+			moved.Visited = b.Tick.DestOSMID
+		}
+		report.Bots = append(report.Bots, moved)
+	}
+	return report, nil
+}
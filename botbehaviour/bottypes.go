@@ -0,0 +1,177 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/alexalexyang/botschaft/models"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// botType is what each kind of bot registers with registerBotType, from an init function in its own file.
+// Every bot goes through the same tick steps (see tick.go); a type decides what happens in them.
+type botType struct {
+	Name        string
+	Description string
+	// Searches: whether the bot asks Overpass for candidate POIs. Bots that don't get no candidates.
+	Searches bool
+	// Planned: if set and true for a bot, it already knows where it's going and skips searching this tick.
+	Planned func(db dbtx, b bot) bool
+	// Amenity: if set, the bot always looks for this kind of POI, except when its routine sends it home.
+	Amenity string
+	// CreateTables: creates the tables the type keeps its state in. Nil if it has none.
+	CreateTables func(db dbtx)
+	// SaveState: validates and saves a new bot's state for the type, given as JSON. Nil if it has none.
+	SaveState func(tx *sql.Tx, b bot, state []byte) error
+	// Choose: picks where the bot goes among its candidates. Returns false to stay where it is.
+	Choose func(tx *sql.Tx, rng *rand.Rand, b bot, candidates []candidatePOI, others []bot) (candidatePOI, bool, error)
+	// Arrive: runs in the same transaction as the move, once the bot is at its destination. Nil to do nothing.
+	Arrive func(tx *sql.Tx, rng *rand.Rand, b bot) error
+}
+
+var botTypes = map[string]botType{}
+
+// Adds a bot type. Panics if the type is incomplete or its name is taken, since that's a programming mistake.
+func registerBotType(t botType) {
+	if t.Name == "" || t.Choose == nil {
+		panic("bot types need a name and a Choose function")
+	}
+	if _, ok := botTypes[t.Name]; ok {
+		panic("bot type " + t.Name + " is registered twice")
+	}
+	botTypes[t.Name] = t
+}
+
+// The names of the registered bot types, sorted.
+func botTypeNames() []string {
+	names := []string{}
+	for name := range botTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func createBotTypeTables(db dbtx) {
+	for _, name := range botTypeNames() {
+		if botTypes[name].CreateTables != nil {
+			botTypes[name].CreateTables(db)
+		}
+	}
+}
+
+// The travelbot goes wherever its personality likes best among what its routine is looking for.
+func init() {
+	registerBotType(botType{
+		Name:        "travelbot",
+		Description: "Goes wherever its personality likes best among what its daily routine is looking for.",
+		Searches:    true,
+		Choose:      choosePreferred,
+	})
+}
+
+func choosePreferred(tx *sql.Tx, rng *rand.Rand, b bot, candidates []candidatePOI, others []bot) (candidatePOI, bool, error) {
+	c, ok := b.Personality.chooseDestination(rng, b, candidates, others, b.SearchRadius/1000)
+	return c, ok, nil
+}
+
+type botTypeInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// GetBotTypes returns the registered bot types and what they do as JSON.
+func GetBotTypes() []byte {
+	types := []botTypeInfo{}
+	for _, name := range botTypeNames() {
+		types = append(types, botTypeInfo{name, botTypes[name].Description})
+	}
+
+	typesJSON, err := json.Marshal(types)
+	check(err)
+	return typesJSON
+}
+
+// NewBot is a bot to create with CreateBot. State is the type's own settings, if it has any.
+// Categories are the POI categories it looks for instead of what its routine says, if any.
+type NewBot struct {
+	UserID     int             `json:"userid"`
+	Name       string          `json:"name"`
+	Lat        float64         `json:"lat"`
+	Lon        float64         `json:"lon"`
+	Radius     float64         `json:"radius"`
+	Type       string          `json:"type"`
+	Categories []string        `json:"categories"`
+	State      json.RawMessage `json:"state"`
+}
+
+// CreateBot validates a new bot of any registered type, saves it with its type's state and a random
+// personality, and returns its ID.
+func CreateBot(db *sql.DB, nb NewBot) (int, error) {
+	err := nb.validate()
+	if err != nil {
+		return 0, err
+	}
+
+	var botID int
+	err = inTx(db, func(tx *sql.Tx) error {
+		var err error
+		botID, err = insertBot(tx, nb)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	CreateRandomPersonality(db, botID)
+	invalidateTiles([2]float64{nb.Lat, nb.Lon})
+	return botID, nil
+}
+
+// Checks everything about a new bot but its type's state, which the type checks when it's saved.
+func (nb NewBot) validate() error {
+	if _, ok := botTypes[nb.Type]; !ok {
+		return errors.New("type must be one of " + strings.Join(botTypeNames(), ", "))
+	}
+	if nb.Name == "" {
+		return errors.New("bots need a name")
+	}
+	if nb.Lat < -90 || nb.Lat > 90 || nb.Lon < -180 || nb.Lon > 180 {
+		return errors.New("lat and lon must be a valid latitude and longitude")
+	}
+	if nb.Radius <= 0 {
+		return errors.New("radius must be more than 0")
+	}
+	return validateCategories(nb.Categories)
+}
+
+// Saves a validated new bot with the default routine, its settings and its type's state, and returns its ID.
+func insertBot(tx *sql.Tx, nb NewBot) (int, error) {
+	botID, err := models.CreateBot(tx, models.BotBaseProfile{
+		UserID:  nb.UserID,
+		Name:    nb.Name,
+		Lat:     nb.Lat,
+		Lon:     nb.Lon,
+		Radius:  nb.Radius,
+		BotType: nb.Type,
+	})
+	if err != nil {
+		return 0, err
+	}
+	saveRoutine(tx, botID, routine{Home: homeLocation{nb.Lat, nb.Lon}, Slots: defaultSlots()})
+	if len(nb.Categories) > 0 {
+		err = saveSettings(tx, botID, botSettings{Categories: nb.Categories})
+		if err != nil {
+			return 0, err
+		}
+	}
+	t := botTypes[nb.Type]
+	if t.SaveState == nil {
+		return botID, nil
+	}
+	return botID, t.SaveState(tx, bot{ID: botID, Name: nb.Name, Lat: nb.Lat, Lon: nb.Lon, Radius: nb.Radius, Type: nb.Type}, nb.State)
+}
@@ -0,0 +1,78 @@
+package botbehaviour
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// A new bot is saved with its type's state, its routine, its settings and a personality, or not at all.
+func TestCreateBot(t *testing.T) {
+	db := migratedDB(t)
+	botID, err := CreateBot(db, NewBot{
+		UserID:     1,
+		Name:       "Commuter",
+		Lat:        52.52,
+		Lon:        13.4,
+		Radius:     1000,
+		Type:       "commuter",
+		Categories: []string{"cafe"},
+		State:      json.RawMessage(`{"work": {"lat": 52.5, "lon": 13.3}, "start": 8, "end": 16}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var botType string
+	err = db.QueryRow(`SELECT bottype FROM bots WHERE BotID=$1;`, botID).Scan(&botType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if botType != "commuter" {
+		t.Errorf("bot %d is a %q, want a commuter", botID, botType)
+	}
+	var start, end int
+	err = db.QueryRow(`SELECT workstart, workend FROM botcommute WHERE botid=$1;`, botID).Scan(&start, &end)
+	if err != nil {
+		t.Fatalf("bot %d's commute wasn't saved: %v", botID, err)
+	}
+	if start != 8 || end != 16 {
+		t.Errorf("bot %d works from %d to %d, want 8 to 16", botID, start, end)
+	}
+	if s := getSettings(db, botID); len(s.Categories) != 1 || s.Categories[0] != "cafe" {
+		t.Errorf("bot %d looks for %v, want [cafe]", botID, s.Categories)
+	}
+	for _, table := range []string{"botroutine", "botpersonality"} {
+		var n int
+		err = db.QueryRow(`SELECT COUNT(*) FROM `+table+` WHERE botid=$1;`, botID).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("bot %d has %d rows in %s, want 1", botID, n, table)
+		}
+	}
+
+	bad := []NewBot{
+		{Name: "Nothing", Lat: 52.52, Lon: 13.4, Radius: 1000, Type: "nothing"},
+		{Name: "", Lat: 52.52, Lon: 13.4, Radius: 1000, Type: "travelbot"},
+		{Name: "Nowhere", Lat: 91, Lon: 13.4, Radius: 1000, Type: "travelbot"},
+		{Name: "Small", Lat: 52.52, Lon: 13.4, Radius: 0, Type: "travelbot"},
+		{Name: "Picky", Lat: 52.52, Lon: 13.4, Radius: 1000, Type: "travelbot", Categories: []string{"cafe; DROP TABLE bots"}},
+		// Commuters need a state, and the type only finds out once the bot is being saved.
+		{Name: "Jobless", Lat: 52.52, Lon: 13.4, Radius: 1000, Type: "commuter"},
+		{Name: "Night shift", Lat: 52.52, Lon: 13.4, Radius: 1000, Type: "commuter", State: json.RawMessage(`{"work": {"lat": 52.5, "lon": 13.3}, "start": 22, "end": 6}`)},
+	}
+	for _, nb := range bad {
+		if _, err := CreateBot(db, nb); err == nil {
+			t.Errorf("%q was made", nb.Name)
+		}
+	}
+	var bots int
+	err = db.QueryRow(`SELECT COUNT(*) FROM bots;`).Scan(&bots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bots != 1 {
+		t.Errorf("%d bots were saved, want 1", bots)
+	}
+}
@@ -0,0 +1,397 @@
+package botbehaviour
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	// The most bots one bulk seed can make.
+	maxSeedBots = 10000
+	// How many random points are tried for each bot before giving up on finding one inside a polygon.
+	maxPlacementTries = 1000
+)
+
+// traitRange is a personality trait in a seed template: a number, or [min, max] to roll it between.
+type traitRange [2]float64
+
+func (t *traitRange) UnmarshalJSON(b []byte) error {
+	var n float64
+	if json.Unmarshal(b, &n) == nil {
+		*t = traitRange{n, n}
+		return nil
+	}
+	var r [2]float64
+	if err := json.Unmarshal(b, &r); err != nil {
+		return errors.New("personality traits must be a number or [min, max]")
+	}
+	*t = r
+	return nil
+}
+
+func (t *traitRange) roll(rng *rand.Rand) float64 {
+	if t == nil {
+		return rng.Float64()
+	}
+	return t[0] + rng.Float64()*(t[1]-t[0])
+}
+
+// The personality bots in a seed get. Traits left out are rolled between 0 and 1.
+type personalityTemplate struct {
+	Curiosity    *traitRange        `json:"curiosity"`
+	Sociability  *traitRange        `json:"sociability"`
+	Stamina      *traitRange        `json:"stamina"`
+	Homesickness *traitRange        `json:"homesickness"`
+	TagPrefs     map[string]float64 `json:"tagprefs"`
+}
+
+func (p personalityTemplate) validate() error {
+	for _, t := range []*traitRange{p.Curiosity, p.Sociability, p.Stamina, p.Homesickness} {
+		if t != nil && (t[0] < 0 || t[1] > 1 || t[0] > t[1]) {
+			return errors.New("personality traits must be between 0 and 1, with min before max")
+		}
+	}
+	return personality{TagPrefs: p.TagPrefs}.validate()
+}
+
+func (p personalityTemplate) roll(rng *rand.Rand) personality {
+	return personality{p.Curiosity.roll(rng), p.Sociability.roll(rng), p.Stamina.roll(rng), p.Homesickness.roll(rng), p.TagPrefs}
+}
+
+// SeedTemplate says what bots BulkSeed makes for each feature. A feature's count, name and type override the
+// template's Count and Types.
+type SeedTemplate struct {
+	UserID int `json:"userid"`
+	// Count: how many bots to make for each feature.
+	Count int `json:"count"`
+	// Name: the bots' names. {feature} is replaced with the feature's name, and {n} with the bot's number in it.
+	Name string `json:"name"`
+	// Types: bot types and their weights. Each bot's type is picked at random in proportion to the weights.
+	Types      map[string]float64 `json:"types"`
+	Radius     float64            `json:"radius"`
+	Categories []string           `json:"categories"`
+	// States: the state for each type that takes one, like {"commuter": {"work": {"lat": 52.52, "lon": 13.40}}}.
+	States map[string]json.RawMessage `json:"states"`
+	// Spread: how far in metres from a point bots are put at random. Bots are put anywhere inside polygons.
+	Spread      float64             `json:"spread"`
+	Personality personalityTemplate `json:"personality"`
+}
+
+// ParseSeedTemplate reads a template from JSON. Left out, Count is 1, Name is "{feature} {n}" and Types is
+// just travelbot. Empty data is the default template.
+func ParseSeedTemplate(data []byte) (SeedTemplate, error) {
+	t := SeedTemplate{Count: 1}
+	if len(bytes.TrimSpace(data)) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&t)
+		if err != nil {
+			return t, errors.New("template: " + err.Error())
+		}
+	}
+	if t.Name == "" {
+		t.Name = "{feature} {n}"
+	}
+	if len(t.Types) == 0 {
+		t.Types = map[string]float64{"travelbot": 1}
+	}
+	return t, nil
+}
+
+func (t SeedTemplate) validate() error {
+	if t.Count < 0 {
+		return errors.New("count can't be less than 0")
+	}
+	if t.Spread < 0 {
+		return errors.New("spread can't be less than 0")
+	}
+	if len(t.Types) == 0 {
+		return errors.New("the template needs at least one type")
+	}
+	for name, weight := range t.Types {
+		if _, ok := botTypes[name]; !ok {
+			return errors.New("type must be one of " + strings.Join(botTypeNames(), ", "))
+		}
+		if weight <= 0 {
+			return errors.New("type weights must be more than 0")
+		}
+	}
+	return t.Personality.validate()
+}
+
+// Picks a type at random in proportion to the template's weights. Types are sorted first so the same seed
+// always picks the same.
+func (t SeedTemplate) pickType(rng *rand.Rand) string {
+	names := []string{}
+	total := 0.0
+	for name, weight := range t.Types {
+		names = append(names, name)
+		total += weight
+	}
+	sort.Strings(names)
+
+	pick := rng.Float64() * total
+	for _, name := range names {
+		pick -= t.Types[name]
+		if pick < 0 {
+			return name
+		}
+	}
+	return names[len(names)-1]
+}
+
+// A place to put bots, from a CSV row or a GeoJSON feature: a point, or polygons.
+type seedFeature struct {
+	Name     string
+	Count    int
+	Type     string
+	Lat, Lon float64
+	Polygons []polygon
+}
+
+// Reads CSV with a header row. lat and lon columns are needed; name, count and type are optional.
+func parseSeedCSV(r io.Reader) ([]seedFeature, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("the CSV needs a header row")
+	}
+
+	columns := map[string]int{}
+	for i, name := range rows[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["lat"]; !ok {
+		return nil, errors.New("the CSV needs lat and lon columns")
+	}
+	if _, ok := columns["lon"]; !ok {
+		return nil, errors.New("the CSV needs lat and lon columns")
+	}
+	value := func(row []string, column string) string {
+		if i, ok := columns[column]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	features := []seedFeature{}
+	for i, row := range rows[1:] {
+		line := strconv.Itoa(i + 2)
+		f := seedFeature{Name: value(row, "name"), Type: value(row, "type"), Count: -1}
+		f.Lat, err = strconv.ParseFloat(value(row, "lat"), 64)
+		if err != nil {
+			return nil, errors.New("line " + line + ": lat must be a number")
+		}
+		f.Lon, err = strconv.ParseFloat(value(row, "lon"), 64)
+		if err != nil {
+			return nil, errors.New("line " + line + ": lon must be a number")
+		}
+		if count := value(row, "count"); count != "" {
+			f.Count, err = strconv.Atoi(count)
+			if err != nil || f.Count < 0 {
+				return nil, errors.New("line " + line + ": count must be a whole number")
+			}
+		}
+		features = append(features, f)
+	}
+	return features, nil
+}
+
+// Reads Points, MultiPoints, Polygons and MultiPolygons, with optional name, count and type properties.
+// A MultiPoint is one place per point.
+func parseSeedGeoJSON(g geoJSONInput, properties map[string]interface{}) ([]seedFeature, error) {
+	switch g.Type {
+	case "FeatureCollection":
+		features := []seedFeature{}
+		for _, feature := range g.Features {
+			more, err := parseSeedGeoJSON(feature, nil)
+			if err != nil {
+				return nil, err
+			}
+			features = append(features, more...)
+		}
+		return features, nil
+	case "Feature":
+		if g.Geometry == nil {
+			return nil, errors.New("features need a geometry")
+		}
+		return parseSeedGeoJSON(*g.Geometry, g.Properties)
+	}
+
+	f := seedFeature{Count: -1}
+	if name, ok := properties["name"].(string); ok {
+		f.Name = name
+	}
+	if t, ok := properties["type"].(string); ok {
+		f.Type = t
+	}
+	if count, ok := properties["count"].(float64); ok {
+		if count < 0 || count != math.Trunc(count) {
+			return nil, errors.New("count must be a whole number")
+		}
+		f.Count = int(count)
+	}
+
+	points := [][2]float64{}
+	var err error
+	switch g.Type {
+	case "Point":
+		point := [2]float64{}
+		err = json.Unmarshal(g.Coordinates, &point)
+		points = append(points, point)
+	case "MultiPoint":
+		err = json.Unmarshal(g.Coordinates, &points)
+	case "Polygon", "MultiPolygon":
+		f.Polygons, err = g.polygons()
+		if err != nil {
+			return nil, err
+		}
+		return []seedFeature{f}, nil
+	default:
+		return nil, errors.New("bots can be seeded in Points, MultiPoints, Polygons and MultiPolygons, not " + g.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	features := []seedFeature{}
+	for _, point := range points {
+		f.Lon, f.Lat = point[0], point[1]
+		features = append(features, f)
+	}
+	return features, nil
+}
+
+// Parses CSV or GeoJSON, whichever data looks like.
+func parseSeedFeatures(data []byte) ([]seedFeature, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return parseSeedCSV(bytes.NewReader(trimmed))
+	}
+	g := geoJSONInput{}
+	err := json.Unmarshal(trimmed, &g)
+	if err != nil {
+		return nil, err
+	}
+	return parseSeedGeoJSON(g, nil)
+}
+
+// A random point inside the feature's polygons, or within spread metres of its point.
+func (f seedFeature) randomPoint(rng *rand.Rand, spread float64) (float64, float64, error) {
+	if len(f.Polygons) == 0 {
+		lat, lon := randomPointNear(rng, f.Lat, f.Lon, spread)
+		return lat, lon, nil
+	}
+
+	south, west, north, east := 90.0, 180.0, -90.0, -180.0
+	for _, p := range f.Polygons {
+		for _, point := range p[0] {
+			south, north = math.Min(south, point[1]), math.Max(north, point[1])
+			west, east = math.Min(west, point[0]), math.Max(east, point[0])
+		}
+	}
+	fence := geofence{Polygons: f.Polygons}
+	for try := 0; try < maxPlacementTries; try++ {
+		lat := south + rng.Float64()*(north-south)
+		lon := west + rng.Float64()*(east-west)
+		if fence.contains(lat, lon) {
+			return lat, lon, nil
+		}
+	}
+	return 0, 0, errors.New("couldn't find a point inside " + f.Name)
+}
+
+// SeededFeature is the bots BulkSeed made for one feature.
+type SeededFeature struct {
+	Feature string `json:"feature"`
+	BotIDs  []int  `json:"botids"`
+}
+
+// A bot planned by BulkSeed.
+type plannedBot struct {
+	feature     int
+	bot         NewBot
+	personality personality
+}
+
+// BulkSeed makes bots for each feature in data, a CSV of points or GeoJSON, as the template says, and returns
+// their IDs by feature. The bots are made in one transaction, so if any of them can't be, none are.
+func BulkSeed(db *sql.DB, t SeedTemplate, data []byte, seed int64) ([]SeededFeature, error) {
+	err := t.validate()
+	if err != nil {
+		return nil, err
+	}
+	features, err := parseSeedFeatures(data)
+	if err != nil {
+		return nil, err
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	planned := []plannedBot{}
+	seeded := []SeededFeature{}
+	for i, f := range features {
+		if f.Name == "" {
+			f.Name = "feature " + strconv.Itoa(i+1)
+		}
+		count := t.Count
+		if f.Count >= 0 {
+			count = f.Count
+		}
+		if len(planned)+count > maxSeedBots {
+			return nil, errors.New("that's more than " + strconv.Itoa(maxSeedBots) + " bots")
+		}
+		seeded = append(seeded, SeededFeature{Feature: f.Name, BotIDs: []int{}})
+
+		for n := 1; n <= count; n++ {
+			lat, lon, err := f.randomPoint(rng, t.Spread)
+			if err != nil {
+				return nil, err
+			}
+			botType := f.Type
+			if botType == "" {
+				botType = t.pickType(rng)
+			}
+			name := strings.NewReplacer("{feature}", f.Name, "{n}", strconv.Itoa(n)).Replace(t.Name)
+
+			nb := NewBot{UserID: t.UserID, Name: name, Lat: lat, Lon: lon, Radius: t.Radius, Type: botType,
+				Categories: t.Categories, State: t.States[botType]}
+			err = nb.validate()
+			if err != nil {
+				return nil, errors.New(f.Name + ": " + err.Error())
+			}
+			planned = append(planned, plannedBot{len(seeded) - 1, nb, t.Personality.roll(rng)})
+		}
+	}
+
+	points := [][2]float64{}
+	err = inTx(db, func(tx *sql.Tx) error {
+		for _, p := range planned {
+			botID, err := insertBot(tx, p.bot)
+			if err != nil {
+				return errors.New(p.bot.Name + ": " + err.Error())
+			}
+			savePersonality(tx, botID, p.personality)
+			seeded[p.feature].BotIDs = append(seeded[p.feature].BotIDs, botID)
+			points = append(points, [2]float64{p.bot.Lat, p.bot.Lon})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	invalidateTiles(points...)
+	return seeded, nil
+}
@@ -0,0 +1,121 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+// An L around a hole: points in the corner the L leaves out, or in the hole, aren't inside it.
+const seedPolygons = `{"type": "FeatureCollection", "features": [
+	{"type": "Feature", "properties": {"name": "L", "count": 40},
+	 "geometry": {"type": "Polygon", "coordinates": [
+		[[13.0, 52.0], [13.2, 52.0], [13.2, 52.1], [13.1, 52.1], [13.1, 52.2], [13.0, 52.2], [13.0, 52.0]],
+		[[13.02, 52.02], [13.08, 52.02], [13.08, 52.08], [13.02, 52.08], [13.02, 52.02]]
+	 ]}},
+	{"type": "Feature", "properties": {"name": "Kreuzberg"},
+	 "geometry": {"type": "Point", "coordinates": [13.4, 52.5]}}
+]}`
+
+// Where every bot in a seed was put, in order of ID.
+func seededPoints(t *testing.T, db *sql.DB, seeded []SeededFeature) map[string][][2]float64 {
+	t.Helper()
+	points := map[string][][2]float64{}
+	for _, f := range seeded {
+		for _, botID := range f.BotIDs {
+			b, ok := getBot(db, botID)
+			if !ok {
+				t.Fatalf("bot %d in %s wasn't saved", botID, f.Feature)
+			}
+			points[f.Feature] = append(points[f.Feature], [2]float64{b.Lat, b.Lon})
+		}
+	}
+	return points
+}
+
+// Bots seeded in a polygon are put inside it, and ones seeded at a point within the spread, the same way
+// for the same seed.
+func TestBulkSeedPlacement(t *testing.T) {
+	template, err := ParseSeedTemplate([]byte(`{"count": 5, "radius": 1000, "spread": 500,
+		"personality": {"curiosity": [0.2, 0.4], "stamina": 0.9}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := migratedDB(t)
+	seeded, err := BulkSeed(db, template, []byte(seedPolygons), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := seededPoints(t, db, seeded)
+	if len(points["L"]) != 40 || len(points["Kreuzberg"]) != 5 {
+		t.Fatalf("%d bots in L and %d in Kreuzberg, want 40 and 5", len(points["L"]), len(points["Kreuzberg"]))
+	}
+
+	features, err := parseSeedFeatures([]byte(seedPolygons))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := geofence{Polygons: features[0].Polygons}
+	for _, p := range points["L"] {
+		if !l.contains(p[0], p[1]) {
+			t.Errorf("%v isn't inside the L", p)
+		}
+	}
+	for _, p := range points["Kreuzberg"] {
+		if d := haversine(13.4, 52.5, p[1], p[0]) * 1000; d > 500.01 {
+			t.Errorf("%v is %.0fm from Kreuzberg, more than the spread", p, d)
+		}
+	}
+	for _, f := range seeded {
+		for _, botID := range f.BotIDs {
+			p := getPersonality(db, botID)
+			if p.Curiosity < 0.2 || p.Curiosity > 0.4 || p.Stamina != 0.9 {
+				t.Errorf("bot %d has curiosity %f and stamina %f, want 0.2 to 0.4 and 0.9", botID, p.Curiosity, p.Stamina)
+			}
+		}
+	}
+
+	again := migratedDB(t)
+	seededAgain, err := BulkSeed(again, template, []byte(seedPolygons), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pointsAgain := seededPoints(t, again, seededAgain); !reflect.DeepEqual(points, pointsAgain) {
+		t.Errorf("the same seed put bots in different places")
+	}
+}
+
+// A seed that can't make every bot makes none.
+func TestBulkSeedFails(t *testing.T) {
+	db := migratedDB(t)
+	bad := []struct {
+		template string
+		data     string
+	}{
+		// Commuters need a state, which isn't checked until they're saved.
+		{`{"types": {"travelbot": 1, "commuter": 1}, "count": 10, "radius": 1000}`, "lat,lon\n52.5,13.4\n"},
+		// A polygon too thin to find a point in.
+		{`{"radius": 1000}`, `{"type": "Polygon", "coordinates": [[[13.0, 52.0], [13.2, 52.0], [13.0, 52.0], [13.0, 52.0]]]}`},
+		{`{"radius": 1000}`, "lat,lon\n52.5,east\n"},
+		{`{"radius": 1000}`, "name,lon\nnowhere,13.4\n"},
+		{`{"radius": 1000, "count": 10001}`, "lat,lon\n52.5,13.4\n"},
+	}
+	for _, b := range bad {
+		template, err := ParseSeedTemplate([]byte(b.template))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := BulkSeed(db, template, []byte(b.data), 1); err == nil {
+			t.Errorf("%s with %q was seeded", b.template, b.data)
+		}
+	}
+	var bots int
+	err := db.QueryRow(`SELECT COUNT(*) FROM bots;`).Scan(&bots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bots != 0 {
+		t.Errorf("%d bots were saved, want none", bots)
+	}
+}
@@ -0,0 +1,15 @@
+package botbehaviour
+
+import (
+	"math/rand"
+	"time"
+)
+
+// What time it is as far as bots are concerned: which part of their routine they're in, and when their moves,
+// visits and events happened. A simulation swaps it for its own clock; see Simulate.
+var now = time.Now
+
+// Gives each bot its own random source, so bots in the same place don't pick the same POI.
+var botRand = func(botID int) *rand.Rand {
+	return rand.New(rand.NewSource(now().UnixNano() + int64(botID)))
+}
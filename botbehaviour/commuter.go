@@ -0,0 +1,87 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math/rand"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Commuters shuttle between home and work. They don't look for POIs at all.
+func init() {
+	registerBotType(botType{
+		Name:         "commuter",
+		Description:  `Goes to work during working hours and home the rest of the time. Needs a state like {"work": {"lat": 52.52, "lon": 13.40}, "start": 9, "end": 17}.`,
+		CreateTables: createCommuteTable,
+		SaveState:    saveCommute,
+		Choose:       chooseCommute,
+	})
+}
+
+// Where a commuter works, and its working hours in local time.
+type commute struct {
+	Work  homeLocation `json:"work"`
+	Start int          `json:"start"`
+	End   int          `json:"end"`
+}
+
+func (c commute) validate() error {
+	if c.Work.Lat < -90 || c.Work.Lat > 90 || c.Work.Lon < -180 || c.Work.Lon > 180 {
+		return errors.New("work must be a valid latitude and longitude")
+	}
+	if c.Start < 0 || c.Start > 23 || c.End < 1 || c.End > 24 || c.Start >= c.End {
+		return errors.New("working hours must start before they end, from 0 to 24")
+	}
+	return nil
+}
+
+func createCommuteTable(db dbtx) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS botcommute (
+		botid INTEGER PRIMARY KEY,
+		worklat REAL,
+		worklon REAL,
+		workstart INTEGER,
+		workend INTEGER
+	);`)
+	check(err)
+}
+
+func saveCommute(tx *sql.Tx, b bot, state []byte) error {
+	c := commute{Start: 9, End: 17}
+	if len(state) == 0 {
+		return errors.New(`commuters need a state with where they work, like {"work": {"lat": 52.52, "lon": 13.40}}`)
+	}
+	err := json.Unmarshal(state, &c)
+	if err != nil {
+		return err
+	}
+	err = c.validate()
+	if err != nil {
+		return err
+	}
+
+	statement := `INSERT OR REPLACE INTO botcommute (botid, worklat, worklon, workstart, workend) values ($1, $2, $3, $4, $5);`
+	_, err = tx.Exec(statement, b.ID, c.Work.Lat, c.Work.Lon, c.Start, c.End)
+	return err
+}
+
+// Work during working hours in the bot's local time, home otherwise. A commuter without a commute stays put.
+func chooseCommute(tx *sql.Tx, rng *rand.Rand, b bot, candidates []candidatePOI, others []bot) (candidatePOI, bool, error) {
+	c := commute{}
+	err := tx.QueryRow(`SELECT worklat, worklon, workstart, workend FROM botcommute WHERE botid=$1;`, b.ID).
+		Scan(&c.Work.Lat, &c.Work.Lon, &c.Start, &c.End)
+	if err == sql.ErrNoRows {
+		return candidatePOI{}, false, nil
+	}
+	if err != nil {
+		return candidatePOI{}, false, err
+	}
+
+	hour := b.localTime(now()).Hour()
+	if hour >= c.Start && hour < c.End {
+		return candidatePOI{Lat: c.Work.Lat, Lon: c.Work.Lon}, true, nil
+	}
+	return candidatePOI{Lat: b.Routine.Home.Lat, Lon: b.Routine.Home.Lon}, true, nil
+}
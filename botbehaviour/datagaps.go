@@ -0,0 +1,212 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// expectedTags are the tags we think every POI on OSM should have. "address" covers addr:housenumber and addr:street.
+var expectedTags = []string{"name", "opening_hours", "wheelchair", "phone", "cuisine", "address"}
+
+// areaGridSize is the size in degrees of the grid cells POIs are grouped into for the per area report. About 1 km at the equator.
+const areaGridSize = 0.01
+
+// Returns the expected tags a POI is missing, and its completeness score from 0 (nothing) to 1 (everything).
+func (tags tagsStruct) completeness() (float64, []string) {
+	present := map[string]bool{
+		"name":          tags.Name != "" || tags.Name_en != "",
+		"opening_hours": tags.Opening_hours != "",
+		"wheelchair":    tags.Wheelchair != "",
+		"phone":         tags.Phone != "",
+		"cuisine":       tags.Cuisine != "",
+		"address":       tags.Addr_housenumber != "" && tags.Addr_street != "",
+	}
+
+	missing := []string{}
+	for _, tag := range expectedTags {
+		if !present[tag] {
+			missing = append(missing, tag)
+		}
+	}
+	score := float64(len(expectedTags)-len(missing)) / float64(len(expectedTags))
+	return score, missing
+}
+
+type poiCompleteness struct {
+	BotID        int      `json:"botid"`
+	OSMID        int      `json:"osmid"`
+	Lat          float64  `json:"lat"`
+	Lon          float64  `json:"lon"`
+	Name         string   `json:"name"`
+	Completeness float64  `json:"completeness"`
+	Missing      []string `json:"missing"`
+}
+
+// Aggregate completeness for a group of POIs, whether by bot or by area.
+type completenessSummary struct {
+	Key          string  `json:"key"`
+	POIs         int     `json:"pois"`
+	Completeness float64 `json:"completeness"`
+}
+
+// How often a single expected tag is missing.
+type tagSummary struct {
+	Tag     string  `json:"tag"`
+	Missing int     `json:"missing"`
+	Share   float64 `json:"share"`
+}
+
+type dataGapReport struct {
+	POIs         []poiCompleteness     `json:"pois"`
+	Completeness float64               `json:"completeness"`
+	ByBot        []completenessSummary `json:"bybot"`
+	ByArea       []completenessSummary `json:"byarea"`
+	ByTag        []tagSummary          `json:"bytag"`
+}
+
+// A POI a bot has visited, with the tags we keep for it in visitedtags.
+type foundPOI struct {
+	BotID int
+	OSMID int
+	Lat   float64
+	Lon   float64
+	Tags  tagsStruct
+}
+
+// Collects every POI bots have visited so far, with its tags as they were at the latest visit.
+func getFoundPOIs(db *sql.DB) []foundPOI {
+	rows, err := db.Query(`SELECT
+	botid,
+	osmid,
+	latitude,
+	longitude,
+	COALESCE(amenity, ''),
+	COALESCE(name, ''),
+	COALESCE(name_en, ''),
+	COALESCE(addr_housenumber, ''),
+	COALESCE(addr_street, ''),
+	COALESCE(opening_hours, ''),
+	COALESCE(phone, ''),
+	COALESCE(cuisine, ''),
+	COALESCE(description, ''),
+	COALESCE(internet_access, ''),
+	COALESCE(smoking, ''),
+	COALESCE(wheelchair, '')
+	FROM visitedtags ORDER BY botid, osmid;`)
+	check(err)
+	defer rows.Close()
+
+	pois := []foundPOI{}
+	for rows.Next() {
+		p := foundPOI{}
+		err = rows.Scan(
+			&p.BotID,
+			&p.OSMID,
+			&p.Lat,
+			&p.Lon,
+			&p.Tags.Amenity,
+			&p.Tags.Name,
+			&p.Tags.Name_en,
+			&p.Tags.Addr_housenumber,
+			&p.Tags.Addr_street,
+			&p.Tags.Opening_hours,
+			&p.Tags.Phone,
+			&p.Tags.Cuisine,
+			&p.Tags.Description,
+			&p.Tags.Internet_access,
+			&p.Tags.Smoking,
+			&p.Tags.Wheelchair)
+		check(err)
+		pois = append(pois, p)
+	}
+	err = rows.Err()
+	check(err)
+	return pois
+}
+
+// Scores every POI bots have visited so far.
+func getPOICompleteness(db *sql.DB) []poiCompleteness {
+	pois := []poiCompleteness{}
+	for _, found := range getFoundPOIs(db) {
+		p := poiCompleteness{BotID: found.BotID, OSMID: found.OSMID, Lat: found.Lat, Lon: found.Lon, Name: found.Tags.Name}
+		p.Completeness, p.Missing = found.Tags.completeness()
+		pois = append(pois, p)
+	}
+	return pois
+}
+
+// Groups POIs with keyFunc and averages their completeness. Sorted from least to most complete.
+func summariseCompleteness(pois []poiCompleteness, keyFunc func(poiCompleteness) string) []completenessSummary {
+	totals := make(map[string]float64)
+	counts := make(map[string]int)
+	for _, p := range pois {
+		key := keyFunc(p)
+		totals[key] += p.Completeness
+		counts[key]++
+	}
+
+	summaries := []completenessSummary{}
+	for key, total := range totals {
+		summaries = append(summaries, completenessSummary{key, counts[key], total / float64(counts[key])})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Completeness == summaries[j].Completeness {
+			return summaries[i].Key < summaries[j].Key
+		}
+		return summaries[i].Completeness < summaries[j].Completeness
+	})
+	return summaries
+}
+
+// Returns the south west corner of the grid cell a POI is in, as "lat,lon".
+func areaKey(p poiCompleteness) string {
+	lat := math.Floor(p.Lat/areaGridSize) * areaGridSize
+	lon := math.Floor(p.Lon/areaGridSize) * areaGridSize
+	return strconv.FormatFloat(lat, 'f', 2, 64) + "," + strconv.FormatFloat(lon, 'f', 2, 64)
+}
+
+func botKey(p poiCompleteness) string {
+	return strconv.Itoa(p.BotID)
+}
+
+// Builds the data-gap report from the POIs in pois.
+func buildDataGapReport(pois []poiCompleteness) dataGapReport {
+	report := dataGapReport{POIs: pois}
+
+	missingCount := make(map[string]int)
+	var total float64
+	for _, p := range pois {
+		total += p.Completeness
+		for _, tag := range p.Missing {
+			missingCount[tag]++
+		}
+	}
+	if len(pois) > 0 {
+		report.Completeness = total / float64(len(pois))
+	}
+
+	report.ByBot = summariseCompleteness(pois, botKey)
+	report.ByArea = summariseCompleteness(pois, areaKey)
+
+	report.ByTag = []tagSummary{}
+	for _, tag := range expectedTags {
+		summary := tagSummary{Tag: tag, Missing: missingCount[tag]}
+		if len(pois) > 0 {
+			summary.Share = float64(summary.Missing) / float64(len(pois))
+		}
+		report.ByTag = append(report.ByTag, summary)
+	}
+	return report
+}
+
+// GetDataGapReport scores the POIs bots have visited by how many expected OSM tags they are missing, and aggregates the scores per bot, per area and per tag.
+func GetDataGapReport(db *sql.DB) []byte {
+	reportJSON, err := json.Marshal(buildDataGapReport(getPOICompleteness(db)))
+	check(err)
+	return reportJSON
+}
@@ -0,0 +1,68 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Something that happened to a bot, like being stopped by a geofence.
+type botEvent struct {
+	ID     int                    `json:"id"`
+	BotID  int                    `json:"botid"`
+	Kind   string                 `json:"kind"`
+	Detail map[string]interface{} `json:"detail"`
+	At     string                 `json:"at"`
+}
+
+func createEventsTable(db dbtx) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS botevents (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		botid INTEGER,
+		kind TEXT,
+		detail TEXT,
+		at TEXT
+	);`)
+	check(err)
+}
+
+// Saves an event for a bot. Use the tick's transaction so the event is only kept if the tick step is.
+func recordEvent(db dbtx, botID int, kind string, detail map[string]interface{}) error {
+	detailJSON, err := json.Marshal(detail)
+	if err != nil {
+		return err
+	}
+	statement := `INSERT INTO botevents (botid, kind, detail, at) values ($1, $2, $3, $4);`
+	_, err = db.Exec(statement, botID, kind, string(detailJSON), now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// GetEvents returns a bot's last 100 events, newest first, as JSON. Returns false if there is no such bot.
+func GetEvents(db *sql.DB, botID int) ([]byte, bool) {
+	if _, ok := getBot(db, botID); !ok {
+		return nil, false
+	}
+
+	rows, err := db.Query(`SELECT id, botid, kind, detail, at FROM botevents WHERE botid=$1 ORDER BY id DESC LIMIT 100;`, botID)
+	check(err)
+	defer rows.Close()
+
+	events := []botEvent{}
+	for rows.Next() {
+		e := botEvent{}
+		var detail string
+		err = rows.Scan(&e.ID, &e.BotID, &e.Kind, &detail, &e.At)
+		check(err)
+		err = json.Unmarshal([]byte(detail), &e.Detail)
+		check(err)
+		events = append(events, e)
+	}
+	err = rows.Err()
+	check(err)
+
+	eventsJSON, err := json.Marshal(events)
+	check(err)
+	return eventsJSON, true
+}
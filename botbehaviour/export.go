@@ -0,0 +1,154 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"strconv"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// A point on a bot's trail. at is when the bot got there, or "" for where a trail starts.
+type trailPoint struct {
+	lat, lon float64
+	at       string
+}
+
+// Every bot's trail from its saved moves, in parts, since a bot placed somewhere by hand starts a new part.
+// Bots that have never moved have no trail.
+func getTrails(db *sql.DB) map[int][][]trailPoint {
+	rows, err := db.Query(`SELECT botid, fromlat, fromlon, tolat, tolon, at FROM botmoves ORDER BY botid, id;`)
+	check(err)
+	defer rows.Close()
+
+	trails := map[int][][]trailPoint{}
+	for rows.Next() {
+		var botID int
+		var from, to trailPoint
+		err = rows.Scan(&botID, &from.lat, &from.lon, &to.lat, &to.lon, &to.at)
+		check(err)
+
+		parts := trails[botID]
+		last := len(parts) - 1
+		if last >= 0 {
+			end := parts[last][len(parts[last])-1]
+			if end.lat == from.lat && end.lon == from.lon {
+				parts[last] = append(parts[last], to)
+				continue
+			}
+		}
+		trails[botID] = append(parts, []trailPoint{from, to})
+	}
+	err = rows.Err()
+	check(err)
+	return trails
+}
+
+// ExportGeoJSON returns every bot, the POIs bots have visited and bots' trails as a GeoJSON FeatureCollection.
+// Each feature's kind property is bot, visited or trail.
+func ExportGeoJSON(db *sql.DB) []byte {
+	features := []geoJSONFeature{}
+
+	for _, b := range ListBots(db) {
+		features = append(features, newPointFeature("bot/"+strconv.Itoa(b.ID), b.Lat, b.Lon, map[string]interface{}{
+			"kind": "bot", "id": b.ID, "name": b.Name, "type": b.Type, "userid": b.UserID,
+		}))
+	}
+
+	rows, err := db.Query(`SELECT p.osmid, MIN(p.latitude), MIN(p.longitude), COUNT(*), COALESCE(MIN(t.name), '')
+	FROM botpois p LEFT JOIN poitags t ON t.osmid = p.osmid
+	WHERE p.visitype="visited" AND p.osmid IS NOT NULL GROUP BY p.osmid ORDER BY p.osmid;`)
+	check(err)
+	defer rows.Close()
+	for rows.Next() {
+		var osmid, visits int
+		var lat, lon float64
+		var name string
+		err = rows.Scan(&osmid, &lat, &lon, &visits, &name)
+		check(err)
+		features = append(features, newPointFeature("node/"+strconv.Itoa(osmid), lat, lon, map[string]interface{}{
+			"kind": "visited", "osmid": osmid, "name": name, "visits": visits,
+		}))
+	}
+	err = rows.Err()
+	check(err)
+
+	trails := getTrails(db)
+	for _, b := range ListBots(db) {
+		parts := trails[b.ID]
+		if len(parts) == 0 {
+			continue
+		}
+		lines := [][][2]float64{}
+		for _, part := range parts {
+			line := [][2]float64{}
+			for _, p := range part {
+				line = append(line, [2]float64{p.lon, p.lat})
+			}
+			lines = append(lines, line)
+		}
+		features = append(features, geoJSONFeature{
+			Type:       "Feature",
+			ID:         "trail/" + strconv.Itoa(b.ID),
+			Geometry:   geoJSONGeometry{Type: "MultiLineString", Coordinates: lines},
+			Properties: map[string]interface{}{"kind": "trail", "botid": b.ID, "name": b.Name},
+		})
+	}
+
+	geoJSON, err := json.Marshal(newFeatureCollection(features))
+	check(err)
+	return geoJSON
+}
+
+// Just enough GPX 1.1 for tracks. See https://www.topografix.com/GPX/1/1/
+type gpxPoint struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Time string  `xml:"time,omitempty"`
+}
+
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+type gpxTrack struct {
+	Name     string       `xml:"name"`
+	Segments []gpxSegment `xml:"trkseg"`
+}
+
+type gpx struct {
+	XMLName xml.Name   `xml:"gpx"`
+	Version string     `xml:"version,attr"`
+	Creator string     `xml:"creator,attr"`
+	XMLNS   string     `xml:"xmlns,attr"`
+	Tracks  []gpxTrack `xml:"trk"`
+}
+
+// ExportGPX returns bots' trails as GPX tracks, one per bot, with the time the bot got to each point.
+// botIDs picks the bots; empty means all of them.
+func ExportGPX(db *sql.DB, botIDs []int) []byte {
+	wanted := HistoryQuery{BotIDs: botIDs}
+	trails := getTrails(db)
+
+	doc := gpx{Version: "1.1", Creator: "botschaft", XMLNS: "http://www.topografix.com/GPX/1/1", Tracks: []gpxTrack{}}
+	for _, b := range ListBots(db) {
+		parts := trails[b.ID]
+		if len(parts) == 0 || !wanted.wants(b.ID) {
+			continue
+		}
+		track := gpxTrack{Name: b.Name}
+		for _, part := range parts {
+			segment := gpxSegment{}
+			for _, p := range part {
+				segment.Points = append(segment.Points, gpxPoint{p.lat, p.lon, p.at})
+			}
+			track.Segments = append(track.Segments, segment)
+		}
+		doc.Tracks = append(doc.Tracks, track)
+	}
+
+	gpxXML, err := xml.MarshalIndent(doc, "", "  ")
+	check(err)
+	return append([]byte(xml.Header), gpxXML...)
+}
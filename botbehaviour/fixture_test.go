@@ -0,0 +1,142 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexalexyang/botschaft/config"
+	"github.com/alexalexyang/botschaft/models"
+)
+
+// An Overpass that answers every query with the same recorded response, and keeps the queries.
+type fakeOverpass struct {
+	response []byte
+	mutex    sync.Mutex
+	queries  []string
+}
+
+func (o *fakeOverpass) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mutex.Lock()
+	o.queries = append(o.queries, r.URL.Query().Get("data"))
+	o.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(o.response)
+}
+
+// A new, empty database in the test's temporary directory.
+func testDB(t *testing.T) *sql.DB {
+	db, err := models.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// A new database with every table made, as the server has it.
+func migratedDB(t *testing.T) *sql.DB {
+	db := testDB(t)
+	err := models.CreateTables(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Migrate(db)
+	return db
+}
+
+// A copy of the database.db shipped with the repo, migrated. Its older tables keep ids and coordinates as TEXT.
+func shippedDB(t *testing.T) *sql.DB {
+	shipped, err := ioutil.ReadFile(filepath.Join("..", "database.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "database.db")
+	err = ioutil.WriteFile(path, shipped, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := models.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = models.CreateTables(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Migrate(db)
+	return db
+}
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// Where tick tests happen: a migrated database, a fake Overpass that answers every query with the points of
+// interest recorded around Mitte, and a clock stopped at midday, so every bot's routine has it out looking.
+type tickFixture struct {
+	db       *sql.DB
+	cfg      config.Config
+	overpass *fakeOverpass
+	clock    time.Time
+}
+
+// newTickFixture makes a tickFixture. wrap, if not nil, wraps the fake Overpass in a handler of the test's own.
+// now and botRand are put back when the test ends.
+func newTickFixture(t *testing.T, wrap func(*fakeOverpass) http.Handler) *tickFixture {
+	response, err := ioutil.ReadFile(filepath.Join("testdata", "golden", "mitte", "overpass.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &tickFixture{overpass: &fakeOverpass{response: response}, clock: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	var handler http.Handler = f.overpass
+	if wrap != nil {
+		handler = wrap(f.overpass)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	realNow, realRand := now, botRand
+	t.Cleanup(func() { now, botRand = realNow, realRand })
+	now = func() time.Time { return f.clock }
+	botRand = func(botID int) *rand.Rand {
+		return rand.New(rand.NewSource(f.clock.UnixNano() + int64(botID)))
+	}
+
+	f.db = migratedDB(t)
+	f.cfg = config.Default()
+	f.cfg.OverpassURL = server.URL
+	return f
+}
+
+// addBots creates n bots of user 1 within metres of the middle of Mitte, of each registered type but commuter
+// in turn, each searching within radius. The same n and metres always put them in the same places.
+func (f *tickFixture) addBots(t *testing.T, n int, metres float64, radius float64) {
+	types := []string{"travelbot", "foodcritic", "surveyor"}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < n; i++ {
+		lat, lon := randomPointNear(rng, 52.515, 13.40, metres)
+		_, err := CreateBot(f.db, NewBot{
+			UserID: 1,
+			Name:   "Bot " + strconv.Itoa(i+1),
+			Lat:    lat,
+			Lon:    lon,
+			Radius: radius,
+			Type:   types[i%len(types)],
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
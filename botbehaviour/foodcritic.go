@@ -0,0 +1,125 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Foodcritics only go to restaurants, prefer ones they haven't rated yet, and rate each one they go to.
+func init() {
+	registerBotType(botType{
+		Name:         "foodcritic",
+		Description:  "Goes to restaurants it hasn't been to yet and rates each one from 1 to 5.",
+		Searches:     true,
+		Amenity:      "restaurant",
+		CreateTables: createRatingsTable,
+		Choose:       chooseUnrated,
+		Arrive:       rateRestaurant,
+	})
+}
+
+type rating struct {
+	OSMID  int    `json:"osmid"`
+	Name   string `json:"name"`
+	Rating int    `json:"rating"`
+	Rated  string `json:"rated"`
+}
+
+func createRatingsTable(db dbtx) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS botratings (
+		botid INTEGER,
+		osmid INTEGER,
+		name TEXT,
+		rating INTEGER,
+		rated TEXT,
+		PRIMARY KEY (botid, osmid)
+	);`)
+	check(err)
+}
+
+func getRatings(db dbtx, botID int) ([]rating, error) {
+	rows, err := db.Query(`SELECT osmid, name, rating, rated FROM botratings WHERE botid=$1 ORDER BY rated;`, botID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ratings := []rating{}
+	for rows.Next() {
+		r := rating{}
+		err = rows.Scan(&r.OSMID, &r.Name, &r.Rating, &r.Rated)
+		if err != nil {
+			return nil, err
+		}
+		ratings = append(ratings, r)
+	}
+	return ratings, rows.Err()
+}
+
+// Picks among the restaurants the critic hasn't rated. Once it has rated everything nearby, it goes back to its favourites.
+func chooseUnrated(tx *sql.Tx, rng *rand.Rand, b bot, candidates []candidatePOI, others []bot) (candidatePOI, bool, error) {
+	ratings, err := getRatings(tx, b.ID)
+	if err != nil {
+		return candidatePOI{}, false, err
+	}
+	rated := map[int]bool{}
+	for _, r := range ratings {
+		rated[r.OSMID] = true
+	}
+
+	unrated := []candidatePOI{}
+	for _, c := range candidates {
+		if !rated[c.OSMID] {
+			unrated = append(unrated, c)
+		}
+	}
+	if len(unrated) == 0 {
+		unrated = candidates
+	}
+	return choosePreferred(tx, rng, b, unrated, others)
+}
+
+// Rates the restaurant the critic just went to, from 1 to 5. Restaurants with the tags it likes and complete
+// OSM data do better, and the rest is down to how the meal went.
+func rateRestaurant(tx *sql.Tx, rng *rand.Rand, b bot) error {
+	if b.Tick.DestOSMID == 0 {
+		return nil
+	}
+	candidates, err := getCandidates(tx, b.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range candidates {
+		if c.OSMID != b.Tick.DestOSMID {
+			continue
+		}
+		score := 1 + 2*c.Completeness + math.Min(b.Personality.tagWeight(c.Tags)-1, 1) + rng.Float64()
+		stars := int(math.Max(1, math.Min(5, math.Round(score))))
+
+		statement := `INSERT OR REPLACE INTO botratings (botid, osmid, name, rating, rated) values ($1, $2, $3, $4, $5);`
+		_, err = tx.Exec(statement, b.ID, c.OSMID, c.Tags["name"], stars, now().UTC().Format(time.RFC3339))
+		return err
+	}
+	return nil
+}
+
+// GetRatings returns the restaurants a foodcritic has rated, oldest first, as JSON. Returns false if there is
+// no such bot.
+func GetRatings(db *sql.DB, botID int) ([]byte, bool) {
+	if _, ok := getBot(db, botID); !ok {
+		return nil, false
+	}
+
+	ratings, err := getRatings(db, botID)
+	check(err)
+
+	ratingsJSON, err := json.Marshal(ratings)
+	check(err)
+	return ratingsJSON, true
+}
@@ -0,0 +1,149 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"math"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// How close two bots have to be, in metres, to meet.
+const meetDistance = 50
+
+func createFriendsTables(db dbtx) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS botfriends (
+		botid INTEGER,
+		friendid INTEGER,
+		since TEXT,
+		PRIMARY KEY (botid, friendid)
+	);`)
+	check(err)
+
+	// A message from botid to friendid.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS botmessages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		botid INTEGER,
+		friendid INTEGER,
+		message TEXT,
+		at TEXT
+	);`)
+	check(err)
+}
+
+// Other bots within meetDistance of b.
+func botsNear(db dbtx, b bot) ([]bot, error) {
+	// A box a bit bigger than meetDistance, so only a few bots need the haversine check. Older databases keep
+	// Lat and Lon as TEXT, so they're cast to compare them as numbers.
+	dLat := meetDistance / 111000.0 * 1.5
+	dLon := dLat / math.Max(math.Cos(b.Lat*math.Pi/180), 0.01)
+
+	rows, err := db.Query(`SELECT BotID, COALESCE(Name, ''), Lat, Lon FROM bots
+	WHERE BotID != $1 AND CAST(Lat AS REAL) BETWEEN $2 AND $3 AND CAST(Lon AS REAL) BETWEEN $4 AND $5 ORDER BY BotID;`,
+		b.ID, b.Lat-dLat, b.Lat+dLat, b.Lon-dLon, b.Lon+dLon)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	near := []bot{}
+	for rows.Next() {
+		other := bot{}
+		err = rows.Scan(&other.ID, &other.Name, &other.Lat, &other.Lon)
+		if err != nil {
+			return nil, err
+		}
+		if haversine(b.Lon, b.Lat, other.Lon, other.Lat)*1000 <= meetDistance {
+			near = append(near, other)
+		}
+	}
+	return near, rows.Err()
+}
+
+// Bots b finds where it has just arrived become its friends, if they weren't already, and b says hello.
+// place is the name of where they are, if it has one.
+func meetBots(db dbtx, b bot, place string) error {
+	near, err := botsNear(db, b)
+	if err != nil {
+		return err
+	}
+
+	at := now().UTC().Format(time.RFC3339)
+	for _, other := range near {
+		for _, pair := range [][2]int{{b.ID, other.ID}, {other.ID, b.ID}} {
+			_, err = db.Exec(`INSERT OR IGNORE INTO botfriends (botid, friendid, since) values ($1, $2, $3);`, pair[0], pair[1], at)
+			if err != nil {
+				return err
+			}
+		}
+
+		message := "Hello " + other.Name + ", fancy meeting you here!"
+		if place != "" {
+			message = "Hello " + other.Name + ", fancy meeting you at " + place + "!"
+		}
+		_, err = db.Exec(`INSERT INTO botmessages (botid, friendid, message, at) values ($1, $2, $3, $4);`, b.ID, other.ID, message, at)
+		if err != nil {
+			return err
+		}
+
+		err = recordEvent(db, b.ID, "met", map[string]interface{}{"botid": other.ID, "name": other.Name})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type friend struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Since string `json:"since"`
+}
+
+type botMessage struct {
+	From     int    `json:"from"`
+	FromName string `json:"fromname"`
+	To       int    `json:"to"`
+	ToName   string `json:"toname"`
+	Message  string `json:"message"`
+	At       string `json:"at"`
+}
+
+// Gets a bot's friends that still exist, oldest friends first.
+func getFriends(db *sql.DB, botID int) []friend {
+	rows, err := db.Query(`SELECT f.friendid, COALESCE(b.Name, ''), f.since FROM botfriends f
+	JOIN bots b ON b.BotID = f.friendid WHERE f.botid=$1 ORDER BY f.since, f.friendid;`, botID)
+	check(err)
+	defer rows.Close()
+
+	friends := []friend{}
+	for rows.Next() {
+		f := friend{}
+		err = rows.Scan(&f.ID, &f.Name, &f.Since)
+		check(err)
+		friends = append(friends, f)
+	}
+	err = rows.Err()
+	check(err)
+	return friends
+}
+
+// Gets the last limit messages a bot sent or got, newest first.
+func getMessages(db *sql.DB, botID int, limit int) []botMessage {
+	rows, err := db.Query(`SELECT m.botid, COALESCE(s.Name, ''), m.friendid, COALESCE(r.Name, ''), m.message, m.at
+	FROM botmessages m LEFT JOIN bots s ON s.BotID = m.botid LEFT JOIN bots r ON r.BotID = m.friendid
+	WHERE m.botid=$1 OR m.friendid=$1 ORDER BY m.id DESC LIMIT $2;`, botID, limit)
+	check(err)
+	defer rows.Close()
+
+	messages := []botMessage{}
+	for rows.Next() {
+		m := botMessage{}
+		err = rows.Scan(&m.From, &m.FromName, &m.To, &m.ToName, &m.Message, &m.At)
+		check(err)
+		messages = append(messages, m)
+	}
+	err = rows.Err()
+	check(err)
+	return messages
+}
@@ -0,0 +1,22 @@
+package botbehaviour
+
+import "testing"
+
+// Bots meet the bots next to them in the shipped database, whose coordinates are TEXT, so "-9.159165" has to
+// be between -9.1597 and -9.1586 as a number.
+func TestBotsNearShipped(t *testing.T) {
+	db := shippedDB(t)
+	bots := GetTravelBots(db)
+	if len(bots) == 0 {
+		t.Fatal("no bots in the shipped database")
+	}
+	for _, b := range bots {
+		near, err := botsNear(db, bot{ID: 100, Lat: b.Lat, Lon: b.Lon + 0.0001})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(near) != 1 || near[0].ID != b.ID {
+			t.Errorf("a bot next to bot %d at %f, %f met %d bots, want just bot %d", b.ID, b.Lat, b.Lon, len(near), b.ID)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Kinds of geofence. Bots with allowed fences must stay inside one of them; no bot may go into a forbidden one.
+const (
+	fenceAllowed   = "allowed"
+	fenceForbidden = "forbidden"
+)
+
+// How far apart in km the points are where a route is checked against geofences.
+const fenceCheckStep = 0.05
+
+// A polygon as GeoJSON rings of [lon, lat]: the outline first, then any holes.
+type polygon [][][2]float64
+
+// A geofence for one bot, or for every bot if BotID is 0.
+type geofence struct {
+	ID       int
+	BotID    int
+	Kind     string
+	Name     string
+	Polygons []polygon
+}
+
+// Ray casting: whether the point is inside the ring.
+func inRing(ring [][2]float64, lat float64, lon float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		lonI, latI := ring[i][0], ring[i][1]
+		lonJ, latJ := ring[j][0], ring[j][1]
+		if (latI > lat) != (latJ > lat) && lon < (lonJ-lonI)*(lat-latI)/(latJ-latI)+lonI {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func (p polygon) contains(lat float64, lon float64) bool {
+	if len(p) == 0 || !inRing(p[0], lat, lon) {
+		return false
+	}
+	for _, hole := range p[1:] {
+		if inRing(hole, lat, lon) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f geofence) contains(lat float64, lon float64) bool {
+	for _, p := range f.Polygons {
+		if p.contains(lat, lon) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a bot with these fences may be at a point. If not, returns the fence in the way; for a point
+// outside all allowed fences that's a fence with no ID.
+func permits(fences []geofence, lat float64, lon float64) (geofence, bool) {
+	hasAllowed, inAllowed := false, false
+	for _, f := range fences {
+		switch f.Kind {
+		case fenceForbidden:
+			if f.contains(lat, lon) {
+				return f, false
+			}
+		case fenceAllowed:
+			hasAllowed = true
+			inAllowed = inAllowed || f.contains(lat, lon)
+		}
+	}
+	if hasAllowed && !inAllowed {
+		return geofence{Kind: fenceAllowed, Name: "outside allowed regions"}, false
+	}
+	return geofence{}, true
+}
+
+// Whether going in a straight line between two points would cross a fence, checked every fenceCheckStep km.
+// A bot that is somewhere it isn't allowed to be may always leave; then only where it goes is checked.
+func routeBlocked(fences []geofence, fromLat float64, fromLon float64, toLat float64, toLon float64) (geofence, bool) {
+	if len(fences) == 0 {
+		return geofence{}, false
+	}
+	if _, ok := permits(fences, fromLat, fromLon); !ok {
+		f, ok := permits(fences, toLat, toLon)
+		return f, !ok
+	}
+
+	steps := int(math.Ceil(haversine(fromLon, fromLat, toLon, toLat) / fenceCheckStep))
+	if steps < 1 {
+		steps = 1
+	}
+	for i := 1; i <= steps; i++ {
+		share := float64(i) / float64(steps)
+		f, ok := permits(fences, fromLat+(toLat-fromLat)*share, fromLon+(toLon-fromLon)*share)
+		if !ok {
+			return f, true
+		}
+	}
+	return geofence{}, false
+}
+
+// A place a fence kept a bot from. Stage says when: "candidate" for a POI the bot isn't allowed to be at,
+// "route" for a candidate it can't get to in a straight line, "tour" for a tour stop it can't get to, and
+// "move" for where it chose to go.
+type fenceBlock struct {
+	Stage string
+	Fence geofence
+	OSMID int
+	Lat   float64
+	Lon   float64
+}
+
+// Counts a block, and saves a fence_blocked event for the bot the first time the fence keeps it from that place.
+// A fence that keeps a bot from a POI near its home would otherwise save an event every tick.
+func recordFenceBlock(db dbtx, botID int, block fenceBlock) error {
+	geofenceBlocks.WithLabelValues(block.Stage).Inc()
+	result, err := db.Exec(`INSERT OR IGNORE INTO botfenceblocks (botid, fenceid, osmid, lat, lon) values ($1, $2, $3, $4, $5);`,
+		botID, block.Fence.ID, block.OSMID, block.Lat, block.Lon)
+	if err != nil {
+		return err
+	}
+	if added, err := result.RowsAffected(); err != nil || added == 0 {
+		return err
+	}
+	return recordEvent(db, botID, "fence_blocked", map[string]interface{}{
+		"stage":    block.Stage,
+		"fence_id": block.Fence.ID,
+		"fence":    block.Fence.Name,
+		"kind":     block.Fence.Kind,
+		"osmid":    block.OSMID,
+		"lat":      block.Lat,
+		"lon":      block.Lon,
+	})
+}
+
+// Drops the candidates a bot can't get to without crossing a fence, and returns them as blocks too.
+func reachable(b bot, candidates []candidatePOI) ([]candidatePOI, []fenceBlock) {
+	if len(b.Fences) == 0 {
+		return candidates, nil
+	}
+	kept := []candidatePOI{}
+	blocked := []fenceBlock{}
+	for _, c := range candidates {
+		if fence, ok := routeBlocked(b.Fences, b.Lat, b.Lon, c.Lat, c.Lon); ok {
+			blocked = append(blocked, fenceBlock{Stage: "route", Fence: fence, OSMID: c.OSMID, Lat: c.Lat, Lon: c.Lon})
+			continue
+		}
+		kept = append(kept, c)
+	}
+	return kept, blocked
+}
+
+func createGeofenceTables(db dbtx) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS geofences (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		botid INTEGER,
+		kind TEXT,
+		name TEXT,
+		polygons TEXT
+	);`)
+	check(err)
+
+	// The places a fence has kept a bot from, so each is only saved as an event once. osmid is 0 for places
+	// that aren't POIs, like the bot's home.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS botfenceblocks (
+		botid INTEGER,
+		fenceid INTEGER,
+		osmid INTEGER,
+		lat REAL,
+		lon REAL,
+		PRIMARY KEY (botid, fenceid, osmid, lat, lon)
+	);`)
+	check(err)
+}
+
+// Gets the fences that apply to a bot: its own and everyone's. Pass botID 0 for only everyone's, or -1 for all fences.
+func getFences(db dbtx, botID int) []geofence {
+	rows, err := db.Query(`SELECT id, botid, kind, name, polygons FROM geofences WHERE botid=0 OR botid=$1 OR $1=-1 ORDER BY id;`, botID)
+	check(err)
+	defer rows.Close()
+
+	fences := []geofence{}
+	for rows.Next() {
+		f := geofence{}
+		var polygons string
+		err = rows.Scan(&f.ID, &f.BotID, &f.Kind, &f.Name, &polygons)
+		check(err)
+		err = json.Unmarshal([]byte(polygons), &f.Polygons)
+		check(err)
+		fences = append(fences, f)
+	}
+	err = rows.Err()
+	check(err)
+	return fences
+}
+
+// GeoJSON as it comes in: a FeatureCollection, a Feature, or a bare Polygon or MultiPolygon.
+type geoJSONInput struct {
+	Type        string                 `json:"type"`
+	Features    []geoJSONInput         `json:"features"`
+	Geometry    *geoJSONInput          `json:"geometry"`
+	Properties  map[string]interface{} `json:"properties"`
+	Coordinates json.RawMessage        `json:"coordinates"`
+}
+
+func (g geoJSONInput) polygons() ([]polygon, error) {
+	polygons := []polygon{}
+	var err error
+	switch g.Type {
+	case "Polygon":
+		p := polygon{}
+		err = json.Unmarshal(g.Coordinates, &p)
+		polygons = append(polygons, p)
+	case "MultiPolygon":
+		err = json.Unmarshal(g.Coordinates, &polygons)
+	default:
+		return nil, errors.New("geofences must be Polygons or MultiPolygons, not " + g.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range polygons {
+		if len(p) == 0 {
+			return nil, errors.New("polygons need an outline")
+		}
+		for _, ring := range p {
+			if len(ring) < 4 {
+				return nil, errors.New("polygon rings need at least 4 points")
+			}
+			for _, point := range ring {
+				if point[0] < -180 || point[0] > 180 || point[1] < -90 || point[1] > 90 {
+					return nil, errors.New("polygon points must be [lon, lat]")
+				}
+			}
+		}
+	}
+	return polygons, nil
+}
+
+// Turns GeoJSON into fences. A feature's "kind" and "name" properties override kind and name.
+func parseGeofences(g geoJSONInput, botID int, kind string, name string) ([]geofence, error) {
+	switch g.Type {
+	case "FeatureCollection":
+		fences := []geofence{}
+		for _, feature := range g.Features {
+			more, err := parseGeofences(feature, botID, kind, name)
+			if err != nil {
+				return nil, err
+			}
+			fences = append(fences, more...)
+		}
+		return fences, nil
+	case "Feature":
+		if g.Geometry == nil {
+			return nil, errors.New("features need a geometry")
+		}
+		if k, ok := g.Properties["kind"].(string); ok {
+			kind = k
+		}
+		if n, ok := g.Properties["name"].(string); ok {
+			name = n
+		}
+		return parseGeofences(*g.Geometry, botID, kind, name)
+	}
+
+	if kind != fenceAllowed && kind != fenceForbidden {
+		return nil, errors.New(`geofence kind must be "allowed" or "forbidden"`)
+	}
+	polygons, err := g.polygons()
+	if err != nil {
+		return nil, err
+	}
+	return []geofence{{BotID: botID, Kind: kind, Name: name, Polygons: polygons}}, nil
+}
+
+// ImportGeofences saves the polygons in a GeoJSON document as geofences for a bot, or for every bot if
+// botID is 0. Returns the new fences' IDs. Nothing is saved if any of them is invalid.
+func ImportGeofences(db *sql.DB, botID int, kind string, name string, geoJSON []byte) ([]int, error) {
+	if _, ok := getBot(db, botID); botID != 0 && !ok {
+		return nil, noBot(botID)
+	}
+
+	g := geoJSONInput{}
+	err := json.Unmarshal(geoJSON, &g)
+	if err != nil {
+		return nil, err
+	}
+	fences, err := parseGeofences(g, botID, kind, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(fences) == 0 {
+		return nil, errors.New("no polygons to import")
+	}
+
+	ids := []int{}
+	err = inTx(db, func(tx *sql.Tx) error {
+		for _, f := range fences {
+			polygons, err := json.Marshal(f.Polygons)
+			if err != nil {
+				return err
+			}
+			statement := `INSERT INTO geofences (botid, kind, name, polygons) values ($1, $2, $3, $4);`
+			result, err := tx.Exec(statement, f.BotID, f.Kind, f.Name, string(polygons))
+			if err != nil {
+				return err
+			}
+			id, err := result.LastInsertId()
+			if err != nil {
+				return err
+			}
+			ids = append(ids, int(id))
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// GetGeofences returns every geofence as a GeoJSON FeatureCollection of MultiPolygons.
+func GetGeofences(db *sql.DB) []byte {
+	features := []geoJSONFeature{}
+	for _, f := range getFences(db, -1) {
+		features = append(features, geoJSONFeature{
+			Type:     "Feature",
+			ID:       strconv.Itoa(f.ID),
+			Geometry: geoJSONGeometry{Type: "MultiPolygon", Coordinates: f.Polygons},
+			Properties: map[string]interface{}{
+				"botid": f.BotID,
+				"kind":  f.Kind,
+				"name":  f.Name,
+			},
+		})
+	}
+
+	fencesJSON, err := json.Marshal(newFeatureCollection(features))
+	check(err)
+	return fencesJSON
+}
+
+// GeofenceBot returns the BotID of the bot a geofence is for, 0 if it's for every bot. False if there is no such fence.
+func GeofenceBot(db *sql.DB, id int) (int, bool) {
+	var botID int
+	err := db.QueryRow(`SELECT botid FROM geofences WHERE id=$1;`, id).Scan(&botID)
+	if err == sql.ErrNoRows {
+		return 0, false
+	}
+	check(err)
+	return botID, true
+}
+
+// DeleteGeofence deletes a geofence. Returns false if there was no such fence.
+func DeleteGeofence(db *sql.DB, id int) bool {
+	result, err := db.Exec(`DELETE FROM geofences WHERE id=$1;`, id)
+	check(err)
+	deleted, err := result.RowsAffected()
+	check(err)
+	_, err = db.Exec(`DELETE FROM botfenceblocks WHERE fenceid=$1;`, id)
+	check(err)
+	return deleted > 0
+}
@@ -0,0 +1,43 @@
+package botbehaviour
+
+import "testing"
+
+// A fence that keeps a bot from the same place every tick only saves one event for it.
+func TestRecordFenceBlockOnce(t *testing.T) {
+	db := migratedDB(t)
+	fence := geofence{ID: 1, Kind: "forbidden", Name: "Park"}
+	blocks := []fenceBlock{
+		{Stage: "candidate", Fence: fence, OSMID: 10, Lat: 52.5, Lon: 13.4},
+		{Stage: "candidate", Fence: fence, OSMID: 10, Lat: 52.5, Lon: 13.4},
+		{Stage: "route", Fence: fence, OSMID: 10, Lat: 52.5, Lon: 13.4},
+		{Stage: "candidate", Fence: fence, OSMID: 11, Lat: 52.6, Lon: 13.4},
+		{Stage: "move", Fence: fence, OSMID: 0, Lat: 52.7, Lon: 13.4},
+		{Stage: "move", Fence: fence, OSMID: 0, Lat: 52.7, Lon: 13.4},
+	}
+	for _, block := range blocks {
+		err := recordFenceBlock(db, 1, block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := recordFenceBlock(db, 2, blocks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(botID int) int {
+		t.Helper()
+		var n int
+		err := db.QueryRow(`SELECT COUNT(*) FROM botevents WHERE botid=$1 AND kind='fence_blocked';`, botID).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := count(1); n != 3 {
+		t.Errorf("bot 1 has %d fence_blocked events, want 3", n)
+	}
+	if n := count(2); n != 1 {
+		t.Errorf("bot 2 has %d fence_blocked events, want 1", n)
+	}
+}
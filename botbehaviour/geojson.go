@@ -0,0 +1,37 @@
+package botbehaviour
+
+// Just enough GeoJSON (RFC 7946) to export points and geofences. Coordinates are [lon, lat].
+
+type geoJSONGeometry struct {
+	Type string `json:"type"`
+	// Coordinates: []float64 for a Point, [][][][2]float64 for a MultiPolygon.
+	Coordinates interface{} `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	ID         string                 `json:"id,omitempty"`
+	Geometry   geoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+func newPointFeature(id string, lat float64, lon float64, properties map[string]interface{}) geoJSONFeature {
+	return geoJSONFeature{
+		Type:       "Feature",
+		ID:         id,
+		Geometry:   geoJSONGeometry{Type: "Point", Coordinates: []float64{lon, lat}},
+		Properties: properties,
+	}
+}
+
+func newFeatureCollection(features []geoJSONFeature) geoJSONFeatureCollection {
+	if features == nil {
+		features = []geoJSONFeature{}
+	}
+	return geoJSONFeatureCollection{Type: "FeatureCollection", Features: features}
+}
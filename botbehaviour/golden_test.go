@@ -0,0 +1,229 @@
+package botbehaviour
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexalexyang/botschaft/config"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files with what happened instead of comparing")
+
+// Golden cases catch changes to what the travel engine does. A case is a directory in testdata/golden with a
+// scenario.json, like Simulate runs, whose pois file is a recorded Overpass response, and the golden files
+// below, which are what the scenario did when they were last updated.
+const (
+	// Every query sent to Overpass, decoded, one per line.
+	goldenQueries = "overpass.golden"
+	// Every table's rows after the last tick.
+	goldenDB = "db.golden"
+	// GetTravelPlans after the last tick, indented.
+	goldenTravelPlans = "travelplans.golden.json"
+)
+
+// TestGolden runs each golden case on a new database against a fake Overpass, and compares what happened with
+// its golden files. After changing what bots do on purpose, run it with -update to rewrite the golden files,
+// and check the diff is what you meant.
+func TestGolden(t *testing.T) {
+	dirs, err := filepath.Glob(filepath.Join("testdata", "golden", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) == 0 {
+		t.Fatal("no golden cases in testdata/golden")
+	}
+	for _, dir := range dirs {
+		dir := dir
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			checkGolden(t, dir)
+		})
+	}
+}
+
+func checkGolden(t *testing.T, dir string) {
+	s, err := LoadScenario(filepath.Join(dir, "scenario.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	overpass := &fakeOverpass{}
+	overpass.response, err = ioutil.ReadFile(s.POIs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(overpass)
+	defer server.Close()
+
+	db := testDB(t)
+	db.SetMaxOpenConns(1)
+
+	cfg := config.Default()
+	cfg.POISource = "overpass"
+	cfg.OverpassURL = server.URL
+	report, err := simulate(discardLogger(), db, cfg, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bots' routines depend on the time, so the plans are got at the time of the last tick.
+	realNow := now
+	now = func() time.Time { return report.End }
+	plans := GetTravelPlans(db)
+	now = realNow
+
+	indented := bytes.Buffer{}
+	err = json.Indent(&indented, plans, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	indented.WriteString("\n")
+
+	got := map[string][]byte{
+		goldenQueries:     []byte(strings.Join(overpass.queries, "\n") + "\n"),
+		goldenDB:          dumpDB(db),
+		goldenTravelPlans: indented.Bytes(),
+	}
+
+	for _, name := range []string{goldenQueries, goldenDB, goldenTravelPlans} {
+		path := filepath.Join(dir, name)
+		if *update {
+			err = ioutil.WriteFile(path, got[name], 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		want, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			t.Errorf("%s doesn't exist yet; run with -update to write it", path)
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if difference := firstDifference(want, got[name]); difference != "" {
+			t.Errorf("%s: %s", path, difference)
+		}
+	}
+}
+
+// Says where got first differs from want, or "" if they're the same. Line endings don't count, so golden
+// files checked out with CRLF still match.
+func firstDifference(want []byte, got []byte) string {
+	wantLines := strings.Split(strings.ReplaceAll(string(want), "\r\n", "\n"), "\n")
+	gotLines := strings.Split(strings.ReplaceAll(string(got), "\r\n", "\n"), "\n")
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		wantLine, gotLine := "(nothing)", "(nothing)"
+		if i < len(wantLines) {
+			wantLine = wantLines[i]
+		}
+		if i < len(gotLines) {
+			gotLine = gotLines[i]
+		}
+		if wantLine != gotLine {
+			return "line " + strconv.Itoa(i+1) + "\n  want: " + wantLine + "\n  got:  " + gotLine
+		}
+	}
+	return ""
+}
+
+// Writes every table's rows as tab separated lines, tables by name and rows in order, so databases that hold
+// the same things dump the same. The spatial indexes and SQLite's own tables are left out, since they only
+// say how things are stored. Floats are written to 10 significant figures, so the last bit of a calculation
+// differing between machines doesn't count.
+func dumpDB(db *sql.DB) []byte {
+	rows, err := db.Query(`SELECT name, sql FROM sqlite_master WHERE type='table' ORDER BY name;`)
+	check(err)
+	tables := []string{}
+	virtual := []string{}
+	for rows.Next() {
+		var name, statement string
+		err = rows.Scan(&name, &statement)
+		check(err)
+		if strings.HasPrefix(statement, "CREATE VIRTUAL TABLE") {
+			virtual = append(virtual, name)
+		}
+		tables = append(tables, name)
+	}
+	err = rows.Err()
+	check(err)
+	rows.Close()
+
+	dump := bytes.Buffer{}
+	for _, table := range tables {
+		skip := strings.HasPrefix(table, "sqlite_")
+		for _, v := range virtual {
+			skip = skip || table == v || strings.HasPrefix(table, v+"_")
+		}
+		if !skip {
+			dumpTable(db, table, &dump)
+		}
+	}
+	return dump.Bytes()
+}
+
+func dumpTable(db *sql.DB, table string, dump *bytes.Buffer) {
+	rows, err := db.Query(`SELECT * FROM "` + table + `" LIMIT 0;`)
+	check(err)
+	columns, err := rows.Columns()
+	check(err)
+	rows.Close()
+
+	order := []string{}
+	for i := range columns {
+		order = append(order, strconv.Itoa(i+1))
+	}
+	rows, err = db.Query(`SELECT * FROM "` + table + `" ORDER BY ` + strings.Join(order, ", ") + `;`)
+	check(err)
+	defer rows.Close()
+
+	dump.WriteString("== " + table + "\n" + strings.Join(columns, "\t") + "\n")
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		err = rows.Scan(pointers...)
+		check(err)
+		fields := []string{}
+		for _, value := range values {
+			fields = append(fields, dumpValue(value))
+		}
+		dump.WriteString(strings.Join(fields, "\t") + "\n")
+	}
+	err = rows.Err()
+	check(err)
+}
+
+func dumpValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', 10, 64)
+	case []byte:
+		return strconv.Quote(string(v))
+	case string:
+		return strconv.Quote(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprint(value)
+}
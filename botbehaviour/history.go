@@ -0,0 +1,218 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The most positions a history query can ask for per bot, to keep answers a sensible size.
+const maxHistoryFrames = 1000
+
+// HistoryQuery is a time window to replay, and how often to sample where bots were in it.
+type HistoryQuery struct {
+	From, To time.Time
+	Step     time.Duration
+	// BotIDs: the bots to replay. Empty for all of them.
+	BotIDs []int
+}
+
+// ParseHistoryQuery parses RFC 3339 times, a step like "10m" and a comma separated list of bot IDs.
+// To defaults to now, From to a day before To, and Step to 5 minutes.
+func ParseHistoryQuery(from string, to string, step string, bots string) (HistoryQuery, error) {
+	q := HistoryQuery{To: time.Now().UTC(), Step: 5 * time.Minute}
+
+	var err error
+	if to != "" {
+		q.To, err = time.Parse(time.RFC3339, to)
+		if err != nil {
+			return q, errors.New("to must be a time like 2019-03-01T12:00:00Z")
+		}
+	}
+	q.From = q.To.Add(-24 * time.Hour)
+	if from != "" {
+		q.From, err = time.Parse(time.RFC3339, from)
+		if err != nil {
+			return q, errors.New("from must be a time like 2019-03-01T12:00:00Z")
+		}
+	}
+	if step != "" {
+		q.Step, err = time.ParseDuration(step)
+		if err != nil || q.Step < time.Second {
+			return q, errors.New("step must be a duration of at least 1s, like 10m")
+		}
+	}
+	q.From, q.To = q.From.UTC(), q.To.UTC()
+
+	if !q.From.Before(q.To) {
+		return q, errors.New("from must be before to")
+	}
+	if q.To.Sub(q.From)/q.Step >= maxHistoryFrames {
+		return q, errors.New("that's more than " + strconv.Itoa(maxHistoryFrames) + " steps; use a longer step or a shorter window")
+	}
+
+	for _, id := range strings.Split(bots, ",") {
+		if strings.TrimSpace(id) == "" {
+			continue
+		}
+		botID, err := strconv.Atoi(strings.TrimSpace(id))
+		if err != nil {
+			return q, errors.New("bots must be a list of bot ids like 1,2,3")
+		}
+		q.BotIDs = append(q.BotIDs, botID)
+	}
+	return q, nil
+}
+
+func (q HistoryQuery) wants(botID int) bool {
+	if len(q.BotIDs) == 0 {
+		return true
+	}
+	for _, id := range q.BotIDs {
+		if id == botID {
+			return true
+		}
+	}
+	return false
+}
+
+type historyMove struct {
+	at       time.Time
+	lat, lon float64
+}
+
+type botHistory struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	// Positions: where the bot was at each of the history's times, as lat, lon.
+	Positions [][2]float64 `json:"positions"`
+}
+
+type historyVisit struct {
+	BotID int     `json:"botid"`
+	OSMID int     `json:"osmid"`
+	Lat   float64 `json:"lat"`
+	Lon   float64 `json:"lon"`
+	At    string  `json:"at"`
+}
+
+type history struct {
+	From  string   `json:"from"`
+	To    string   `json:"to"`
+	Step  string   `json:"step"`
+	Times []string `json:"times"`
+	// Bots: every bot's positions, in order of ID.
+	Bots   []botHistory   `json:"bots"`
+	Visits []historyVisit `json:"visits"`
+}
+
+// Where each bot was at from: where its last move before then took it, or where its first move after then
+// started, or, if it has never moved, where it is now.
+func startPositions(db *sql.DB, from time.Time) map[int][2]float64 {
+	positions := map[int][2]float64{}
+	queries := []string{
+		`SELECT BotID, Lat, Lon FROM bots WHERE Lat IS NOT NULL AND Lon IS NOT NULL;`,
+		`SELECT botid, fromlat, fromlon FROM botmoves WHERE id IN (SELECT MIN(id) FROM botmoves WHERE at >= $1 GROUP BY botid);`,
+		`SELECT botid, tolat, tolon FROM botmoves WHERE id IN (SELECT MAX(id) FROM botmoves WHERE at < $1 GROUP BY botid);`,
+	}
+	for i, query := range queries {
+		args := []interface{}{}
+		if i > 0 {
+			args = append(args, from.Format(time.RFC3339))
+		}
+		rows, err := db.Query(query, args...)
+		check(err)
+		for rows.Next() {
+			var botID int
+			var p [2]float64
+			err = rows.Scan(&botID, &p[0], &p[1])
+			check(err)
+			positions[botID] = p
+		}
+		err = rows.Err()
+		check(err)
+		rows.Close()
+	}
+	return positions
+}
+
+// GetHistory returns where bots were at each step from q.From to q.To, and the POIs they visited then, as JSON.
+// It's worked out from the moves saved for bots' trails.
+func GetHistory(db *sql.DB, q HistoryQuery) []byte {
+	h := history{
+		From:   q.From.Format(time.RFC3339),
+		To:     q.To.Format(time.RFC3339),
+		Step:   q.Step.String(),
+		Times:  []string{},
+		Bots:   []botHistory{},
+		Visits: []historyVisit{},
+	}
+	times := []time.Time{}
+	for t := q.From; !t.After(q.To); t = t.Add(q.Step) {
+		times = append(times, t)
+		h.Times = append(h.Times, t.Format(time.RFC3339))
+	}
+
+	starts := startPositions(db, q.From)
+
+	moves := map[int][]historyMove{}
+	rows, err := db.Query(`SELECT botid, tolat, tolon, osmid, at FROM botmoves WHERE at >= $1 AND at <= $2 ORDER BY id;`,
+		q.From.Format(time.RFC3339), q.To.Format(time.RFC3339))
+	check(err)
+	defer rows.Close()
+	for rows.Next() {
+		var botID, osmid int
+		var at string
+		m := historyMove{}
+		err = rows.Scan(&botID, &m.lat, &m.lon, &osmid, &at)
+		check(err)
+		if !q.wants(botID) {
+			continue
+		}
+		m.at, err = time.Parse(time.RFC3339, at)
+		check(err)
+
+		moves[botID] = append(moves[botID], m)
+		if osmid != 0 {
+			h.Visits = append(h.Visits, historyVisit{botID, osmid, m.lat, m.lon, at})
+		}
+	}
+	err = rows.Err()
+	check(err)
+
+	botRows, err := db.Query(`SELECT BotID, COALESCE(Name, '') FROM bots ORDER BY BotID;`)
+	check(err)
+	defer botRows.Close()
+	for botRows.Next() {
+		b := botHistory{Positions: [][2]float64{}}
+		err = botRows.Scan(&b.ID, &b.Name)
+		check(err)
+		start, ok := starts[b.ID]
+		if !ok || !q.wants(b.ID) {
+			continue
+		}
+
+		position := start
+		next := 0
+		botMoves := moves[b.ID]
+		for _, t := range times {
+			for next < len(botMoves) && !botMoves[next].at.After(t) {
+				position = [2]float64{botMoves[next].lat, botMoves[next].lon}
+				next++
+			}
+			b.Positions = append(b.Positions, position)
+		}
+		h.Bots = append(h.Bots, b)
+	}
+	err = botRows.Err()
+	check(err)
+
+	historyJSON, err := json.Marshal(h)
+	check(err)
+	return historyJSON
+}
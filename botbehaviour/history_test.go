@@ -0,0 +1,106 @@
+package botbehaviour
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alexalexyang/botschaft/models"
+)
+
+func TestParseHistoryQuery(t *testing.T) {
+	q, err := ParseHistoryQuery("", "2024-06-01T12:00:00+02:00", "", " 1, 3,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := HistoryQuery{
+		From:   time.Date(2024, 5, 31, 10, 0, 0, 0, time.UTC),
+		To:     time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC),
+		Step:   5 * time.Minute,
+		BotIDs: []int{1, 3},
+	}
+	if !reflect.DeepEqual(q, want) {
+		t.Errorf("got %+v, want %+v", q, want)
+	}
+
+	bad := [][4]string{
+		{"yesterday", "", "", ""},
+		{"", "2024-06-01", "", ""},
+		{"", "", "fortnightly", ""},
+		{"", "", "500ms", ""},
+		{"2024-06-01T12:00:00Z", "2024-06-01T12:00:00Z", "", ""},
+		{"2024-06-01T13:00:00Z", "2024-06-01T12:00:00Z", "", ""},
+		{"2024-06-01T00:00:00Z", "2024-06-02T00:00:00Z", "1m", ""},
+		{"", "", "", "1,two"},
+	}
+	for _, b := range bad {
+		if _, err := ParseHistoryQuery(b[0], b[1], b[2], b[3]); err == nil {
+			t.Errorf("from %q, to %q, step %q, bots %q was allowed", b[0], b[1], b[2], b[3])
+		}
+	}
+}
+
+// Bots are where their moves took them at each step, starting from where they were before the window.
+func TestGetHistory(t *testing.T) {
+	db := migratedDB(t)
+	for _, b := range []models.BotBaseProfile{
+		{BotID: 1, Name: "Mover", Lat: 52.3, Lon: 13.3, Radius: 1000, BotType: "travelbot"},
+		{BotID: 2, Name: "Sitter", Lat: 48.1, Lon: 11.5, Radius: 1000, BotType: "travelbot"},
+	} {
+		err := models.InsertBot(db, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	moves := []struct {
+		from, to [2]float64
+		osmid    int
+		at       string
+	}{
+		{[2]float64{52.0, 13.0}, [2]float64{52.1, 13.1}, 5, "2024-06-01T08:00:00Z"},
+		{[2]float64{52.1, 13.1}, [2]float64{52.2, 13.2}, 6, "2024-06-01T10:00:00Z"},
+		{[2]float64{52.2, 13.2}, [2]float64{52.3, 13.3}, 0, "2024-06-01T11:10:00Z"},
+	}
+	for _, m := range moves {
+		_, err := db.Exec(`INSERT INTO botmoves (botid, fromlat, fromlon, tolat, tolon, osmid, at) values (1, $1, $2, $3, $4, $5, $6);`,
+			m.from[0], m.from[1], m.to[0], m.to[1], m.osmid, m.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	from := time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+	h := history{}
+	err := json.Unmarshal(GetHistory(db, HistoryQuery{From: from, To: from.Add(3 * time.Hour), Step: time.Hour}), &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTimes := []string{"2024-06-01T09:00:00Z", "2024-06-01T10:00:00Z", "2024-06-01T11:00:00Z", "2024-06-01T12:00:00Z"}
+	if !reflect.DeepEqual(h.Times, wantTimes) {
+		t.Errorf("times are %v, want %v", h.Times, wantTimes)
+	}
+	wantBots := []botHistory{
+		{ID: 1, Name: "Mover", Positions: [][2]float64{{52.1, 13.1}, {52.2, 13.2}, {52.2, 13.2}, {52.3, 13.3}}},
+		{ID: 2, Name: "Sitter", Positions: [][2]float64{{48.1, 11.5}, {48.1, 11.5}, {48.1, 11.5}, {48.1, 11.5}}},
+	}
+	if !reflect.DeepEqual(h.Bots, wantBots) {
+		t.Errorf("bots are %+v, want %+v", h.Bots, wantBots)
+	}
+	wantVisits := []historyVisit{{BotID: 1, OSMID: 6, Lat: 52.2, Lon: 13.2, At: "2024-06-01T10:00:00Z"}}
+	if !reflect.DeepEqual(h.Visits, wantVisits) {
+		t.Errorf("visits are %+v, want %+v", h.Visits, wantVisits)
+	}
+
+	// Before any move, a bot is where its first move started.
+	h = history{}
+	from = time.Date(2024, 6, 1, 7, 0, 0, 0, time.UTC)
+	err = json.Unmarshal(GetHistory(db, HistoryQuery{From: from, To: from.Add(time.Hour), Step: time.Hour, BotIDs: []int{1}}), &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBots = []botHistory{{ID: 1, Name: "Mover", Positions: [][2]float64{{52.0, 13.0}, {52.1, 13.1}}}}
+	if !reflect.DeepEqual(h.Bots, wantBots) {
+		t.Errorf("bots are %+v, want %+v", h.Bots, wantBots)
+	}
+}
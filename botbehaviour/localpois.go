@@ -0,0 +1,113 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// POIs loaded from an OSM export with ImportOSM, for bots to search when cfg.POISource is "local", instead
+// of asking Overpass.
+
+func createLocalPOIsTable(db dbtx) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS osmpois (
+		osmid INTEGER PRIMARY KEY,
+		lat REAL,
+		lon REAL,
+		amenity TEXT,
+		tags TEXT
+	);`)
+	check(err)
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS osmpois_location ON osmpois (lat, lon);`)
+	check(err)
+}
+
+type osmElement struct {
+	Type string            `json:"type"`
+	ID   int               `json:"id"`
+	Lat  float64           `json:"lat"`
+	Lon  float64           `json:"lon"`
+	Tags map[string]string `json:"tags"`
+}
+
+type osmExport struct {
+	Elements []osmElement `json:"elements"`
+}
+
+// ImportOSM loads the amenity nodes in an Overpass JSON export, like the output of
+// [out:json];node[amenity](area);out; and returns how many there were. Nodes already loaded are replaced.
+func ImportOSM(db *sql.DB, r io.Reader) (int, error) {
+	export := osmExport{}
+	err := json.NewDecoder(r).Decode(&export)
+	if err != nil {
+		return 0, errors.New("that isn't Overpass JSON: " + err.Error())
+	}
+
+	imported := 0
+	err = inTx(db, func(tx *sql.Tx) error {
+		for _, e := range export.Elements {
+			if e.Type != "node" || e.Tags["amenity"] == "" {
+				continue
+			}
+			tags, err := json.Marshal(e.Tags)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`INSERT OR REPLACE INTO osmpois (osmid, lat, lon, amenity, tags) values ($1, $2, $3, $4, $5);`,
+				e.ID, e.Lat, e.Lon, e.Tags["amenity"], string(tags))
+			if err != nil {
+				return err
+			}
+			imported++
+		}
+		return nil
+	})
+	return imported, err
+}
+
+// The box around lat, lon that holds every point within metres of it, as south, west, north, east.
+func boundingBox(lat float64, lon float64, metres float64) (float64, float64, float64, float64) {
+	dLat := metres / 111000
+	dLon := dLat / math.Max(math.Cos(lat*math.Pi/180), 0.01)
+	return lat - dLat, lon - dLon, lat + dLat, lon + dLon
+}
+
+// Finds loaded POIs of the kind each bot wants within its SearchRadius, like createOSMQuery asks Overpass for.
+func getLocalPOIs(db *sql.DB, bots []bot) []poi {
+	found := map[int]bool{}
+	pois := []poi{}
+	for _, b := range bots {
+		wanted := routineSlot{Amenity: b.Slot.Amenity}
+		if wanted.Amenity == "" {
+			wanted.Amenity = defaultAmenity
+		}
+		south, west, north, east := boundingBox(b.Lat, b.Lon, b.SearchRadius)
+
+		rows, err := db.Query(`SELECT osmid, lat, lon, amenity, tags FROM osmpois
+		WHERE lat BETWEEN $1 AND $2 AND lon BETWEEN $3 AND $4 ORDER BY osmid;`, south, north, west, east)
+		check(err)
+		for rows.Next() {
+			p := poi{}
+			var amenity, tags string
+			err = rows.Scan(&p.ID, &p.Lat, &p.Lon, &amenity, &tags)
+			check(err)
+			if found[p.ID] || !wanted.wants(amenity) || haversine(b.Lon, b.Lat, p.Lon, p.Lat)*1000 > b.SearchRadius {
+				continue
+			}
+			err = json.Unmarshal([]byte(tags), &p.Tags)
+			check(err)
+			found[p.ID] = true
+			pois = append(pois, p)
+		}
+		err = rows.Err()
+		check(err)
+		rows.Close()
+	}
+
+	poisFetched.Add(float64(len(pois)))
+	return pois
+}
@@ -0,0 +1,246 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The most POI categories a bot can look for at once, to keep Overpass queries small.
+const maxCategories = 10
+
+// A bot's settings from the map page.
+type botSettings struct {
+	// Categories: the amenity values the bot looks for instead of what its routine says. Empty to follow the routine.
+	Categories []string `json:"categories"`
+	// Paused: paused bots stay where they are and skip ticks.
+	Paused bool `json:"paused"`
+}
+
+func validateCategories(categories []string) error {
+	if len(categories) > maxCategories {
+		return errors.New("bots can look for at most " + strconv.Itoa(maxCategories) + " categories")
+	}
+	for _, category := range categories {
+		if category == "" || !amenityPattern.MatchString(category) {
+			return errors.New("categories must be OSM amenity values like cafe or fast_food")
+		}
+	}
+	return nil
+}
+
+func createSettingsTable(db dbtx) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS botsettings (
+		botid INTEGER PRIMARY KEY,
+		categories TEXT,
+		paused INTEGER
+	);`)
+	check(err)
+}
+
+// Gets a bot's settings. A bot without any follows its routine and isn't paused.
+func getSettings(db dbtx, botID int) botSettings {
+	s := botSettings{Categories: []string{}}
+	var categories string
+	err := db.QueryRow(`SELECT categories, paused FROM botsettings WHERE botid=$1;`, botID).Scan(&categories, &s.Paused)
+	if err == sql.ErrNoRows {
+		return s
+	}
+	check(err)
+
+	err = json.Unmarshal([]byte(categories), &s.Categories)
+	check(err)
+	return s
+}
+
+func saveSettings(db dbtx, botID int, s botSettings) error {
+	if s.Categories == nil {
+		s.Categories = []string{}
+	}
+	categories, err := json.Marshal(s.Categories)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT OR REPLACE INTO botsettings (botid, categories, paused) values ($1, $2, $3);`, botID, string(categories), s.Paused)
+	return err
+}
+
+// ErrNoBot is returned, with the bot's id, for changes to a bot that doesn't exist.
+var ErrNoBot = errors.New("no bot")
+
+func noBot(botID int) error {
+	return fmt.Errorf("%w with id %d", ErrNoBot, botID)
+}
+
+// BotOwner returns the UserID of the user who owns a bot. False if there is no such bot.
+func BotOwner(db *sql.DB, botID int) (int, bool) {
+	var userID int
+	err := db.QueryRow(`SELECT COALESCE(UserID, 0) FROM bots WHERE BotID=$1;`, botID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, false
+	}
+	check(err)
+	return userID, true
+}
+
+// BotChanges are changes to a bot from the map page. Fields left out of the JSON stay as they are.
+type BotChanges struct {
+	Name       *string       `json:"name"`
+	Radius     *float64      `json:"radius"`
+	Home       *homeLocation `json:"home"`
+	Categories []string      `json:"categories"`
+	Paused     *bool         `json:"paused"`
+}
+
+func (c BotChanges) validate() error {
+	if c.Name != nil && *c.Name == "" {
+		return errors.New("bots need a name")
+	}
+	if c.Radius != nil && *c.Radius <= 0 {
+		return errors.New("radius must be more than 0")
+	}
+	if c.Home != nil && (c.Home.Lat < -90 || c.Home.Lat > 90 || c.Home.Lon < -180 || c.Home.Lon > 180) {
+		return errors.New("home must be a valid latitude and longitude")
+	}
+	return validateCategories(c.Categories)
+}
+
+// ChangeBot validates changes to a bot and saves them together. The bot is locked meanwhile, so the
+// changes land between its ticks.
+func ChangeBot(db *sql.DB, botID int, c BotChanges) error {
+	err := c.validate()
+	if err != nil {
+		return err
+	}
+	b, ok := getBot(db, botID)
+	if !ok {
+		return noBot(botID)
+	}
+
+	unlock := lockBot(botID)
+	defer unlock()
+
+	err = inTx(db, func(tx *sql.Tx) error {
+		if c.Name != nil {
+			_, err := tx.Exec(`UPDATE bots SET Name=$1 WHERE BotID=$2;`, *c.Name, botID)
+			if err != nil {
+				return err
+			}
+		}
+		if c.Radius != nil {
+			_, err := tx.Exec(`UPDATE bots SET Radius=$1 WHERE BotID=$2;`, *c.Radius, botID)
+			if err != nil {
+				return err
+			}
+		}
+		if c.Home != nil {
+			r := getRoutine(tx, b)
+			r.Home = *c.Home
+			saveRoutine(tx, botID, r)
+		}
+		if c.Categories != nil || c.Paused != nil {
+			s := getSettings(tx, botID)
+			if c.Categories != nil {
+				s.Categories = c.Categories
+			}
+			if c.Paused != nil {
+				s.Paused = *c.Paused
+			}
+			return saveSettings(tx, botID, s)
+		}
+		return nil
+	})
+	if err == nil {
+		invalidateTiles([2]float64{b.Lat, b.Lon})
+	}
+	return err
+}
+
+// The tables that keep something for a bot, and their bot ID column. New per-bot tables go here so DeleteBot clears them.
+var botTables = map[string]string{
+	"bots":            "BotID",
+	"botpois":         "botid",
+	"taginfo":         "botid",
+	"botpersonality":  "botid",
+	"botsearch":       "botid",
+	"botroutine":      "botid",
+	"bottimezone":     "botid",
+	"bottick":         "botid",
+	"botsettings":     "botid",
+	"botratings":      "botid",
+	"bottourplan":     "botid",
+	"bottour":         "botid",
+	"botcommute":      "botid",
+	"geofences":       "botid",
+	"botfenceblocks":  "botid",
+	"botevents":       "botid",
+	"botmoves":        "botid",
+	"botfriends":      "botid",
+	"botmessages":     "botid",
+	"botachievements": "botid",
+	"visitedtags":     "botid",
+}
+
+// The tables where other bots keep something about a bot, and the column it's in. DeleteBot clears these too,
+// so no bot is left with a friend or messages from a bot that's gone.
+var botReferenceTables = map[string]string{
+	"botfriends":  "friendid",
+	"botmessages": "friendid",
+}
+
+// DeleteBot deletes a bot and everything kept for it. Returns false if there was no such bot.
+// It takes the bot's lock first, so a worker part way through the bot's tick finishes it before the bot goes,
+// and finds it gone afterwards.
+func DeleteBot(db *sql.DB, botID int) (bool, error) {
+	unlock := lockBot(botID)
+	defer unlock()
+
+	err := inBotTx(db, botID, func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT name FROM sqlite_master WHERE type='table';`)
+		if err != nil {
+			return err
+		}
+		existing := map[string]bool{}
+		for rows.Next() {
+			var name string
+			err = rows.Scan(&name)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			existing[name] = true
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		// Table and column names come from botTables and botReferenceTables, never from the request.
+		for _, tables := range []map[string]string{botTables, botReferenceTables} {
+			for table, column := range tables {
+				if !existing[table] {
+					continue
+				}
+				_, err = tx.Exec(`DELETE FROM "`+table+`" WHERE "`+column+`"=$1;`, botID)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errBotGone) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	botStuckTicks.DeleteLabelValues(strconv.Itoa(botID))
+	clearTiles()
+	return true, nil
+}
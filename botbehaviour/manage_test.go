@@ -0,0 +1,101 @@
+package botbehaviour
+
+import (
+	"strings"
+	"testing"
+)
+
+// Every table with a botid is cleared when a bot is deleted, or a new bot given the same ID would inherit it.
+func TestBotTables(t *testing.T) {
+	db := migratedDB(t)
+	rows, err := db.Query(`SELECT m.name, p.name FROM sqlite_master m JOIN pragma_table_info(m.name) p
+	WHERE m.type='table' AND lower(p.name) IN ('botid', 'friendid');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, column string
+		err = rows.Scan(&table, &column)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cleared := botTables[table]
+		if strings.EqualFold(column, "friendid") {
+			cleared = botReferenceTables[table]
+		}
+		if !strings.EqualFold(cleared, column) {
+			t.Errorf("DeleteBot doesn't clear %s.%s", table, column)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Deleting a bot takes everything kept for it, and about it, with it, and leaves other bots alone.
+func TestDeleteBot(t *testing.T) {
+	db := migratedDB(t)
+	ids := []int{}
+	for _, name := range []string{"Leaving", "Staying"} {
+		botID, err := CreateBot(db, NewBot{UserID: 1, Name: name, Lat: 52.52, Lon: 13.4, Radius: 1000, Type: "travelbot"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, botID)
+	}
+	leaving, staying := ids[0], ids[1]
+	for _, b := range [][2]int{{leaving, staying}, {staying, leaving}} {
+		_, err := db.Exec(`INSERT INTO botfriends (botid, friendid, since) values ($1, $2, '2024-06-01T00:00:00Z');`, b[0], b[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`INSERT INTO botmessages (botid, friendid, message, at) values ($1, $2, 'hi', '2024-06-01T00:00:00Z');`, b[0], b[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = recordEvent(db, b[0], "met", map[string]interface{}{"botid": b[1]})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleted, err := DeleteBot(db, leaving)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deleted {
+		t.Fatalf("bot %d wasn't deleted", leaving)
+	}
+	for _, tables := range []map[string]string{botTables, botReferenceTables} {
+		for table, column := range tables {
+			var n int
+			err = db.QueryRow(`SELECT COUNT(*) FROM "`+table+`" WHERE "`+column+`"=$1;`, leaving).Scan(&n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 0 {
+				t.Errorf("%d rows left in %s for bot %d", n, table, leaving)
+			}
+		}
+	}
+	if _, ok := getBot(db, staying); !ok {
+		t.Errorf("bot %d went too", staying)
+	}
+	var events int
+	err = db.QueryRow(`SELECT COUNT(*) FROM botevents WHERE botid=$1;`, staying).Scan(&events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events != 1 {
+		t.Errorf("bot %d has %d events, want 1", staying, events)
+	}
+
+	deleted, err = DeleteBot(db, leaving)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted {
+		t.Errorf("bot %d was deleted twice", leaving)
+	}
+}
@@ -0,0 +1,292 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Below this zoom, candidate POIs close together are sent as clusters instead of one by one.
+const clusterMaxZoom = 15
+
+// How wide a cluster cell is on screen, in pixels. Leaflet's tiles are 256 pixels wide.
+const clusterCellPixels = 64
+
+// The most a map can be zoomed in.
+const maxZoom = 22
+
+// MapQuery is the part of the map the page is looking at.
+type MapQuery struct {
+	// West, South, East, North: the bounding box in degrees. West is more than East if the box
+	// crosses the antimeridian.
+	West, South, East, North float64
+	Zoom                     int
+}
+
+// ParseMapQuery parses a bounding box written west,south,east,north and a zoom level. An empty bbox
+// is the whole world.
+func ParseMapQuery(bbox string, zoom string) (MapQuery, error) {
+	q := MapQuery{-180, -90, 180, 90, 0}
+
+	var err error
+	q.Zoom, err = strconv.Atoi(zoom)
+	if err != nil || q.Zoom < 0 || q.Zoom > maxZoom {
+		return q, errors.New("zoom must be a whole number from 0 to " + strconv.Itoa(maxZoom))
+	}
+	if bbox == "" {
+		return q, nil
+	}
+
+	parts := strings.Split(bbox, ",")
+	if len(parts) != 4 {
+		return q, errors.New("bbox must be west,south,east,north")
+	}
+	corners := [4]float64{}
+	for i, part := range parts {
+		corners[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return q, errors.New("bbox must be west,south,east,north in degrees")
+		}
+	}
+	q.West, q.South, q.East, q.North = corners[0], corners[1], corners[2], corners[3]
+
+	if q.West < -180 || q.West > 180 || q.East < -180 || q.East > 180 {
+		return q, errors.New("bbox longitudes must be from -180 to 180")
+	}
+	if q.South < -90 || q.North > 90 || q.South > q.North {
+		return q, errors.New("bbox latitudes must be from -90 to 90, south first")
+	}
+	return q, nil
+}
+
+// An SQL condition for a range of longitudes from min to max overlapping the query's, with $3 and $4 for West and East.
+// min and max are column names from the code, never from the request.
+func (q MapQuery) lonOverlaps(min string, max string) string {
+	if q.West <= q.East {
+		return max + ` >= $3 AND ` + min + ` <= $4`
+	}
+	return `(` + max + ` >= $3 OR ` + min + ` <= $4)`
+}
+
+func (q MapQuery) contains(lat float64, lon float64) bool {
+	if lat < q.South || lat > q.North {
+		return false
+	}
+	if q.West <= q.East {
+		return lon >= q.West && lon <= q.East
+	}
+	return lon >= q.West || lon <= q.East
+}
+
+// The size of a cluster cell in degrees at the query's zoom.
+func (q MapQuery) cellSize() float64 {
+	return 360 / math.Exp2(float64(q.Zoom)) * clusterCellPixels / 256
+}
+
+// POIs too close together to tell apart at the map's zoom.
+type poiCluster struct {
+	// Lat, Lon: the average of the POIs' locations.
+	Lat   float64 `json:"lat"`
+	Lon   float64 `json:"lon"`
+	Count int     `json:"count"`
+	// Completeness: the POIs' average, for the data gaps layer.
+	Completeness float64 `json:"completeness"`
+}
+
+type mapData struct {
+	Bots     []bot        `json:"bots"`
+	POIs     []poi        `json:"pois"`
+	Clusters []poiCluster `json:"clusters"`
+}
+
+// Gets the candidate POIs in view, each once however many bots might go there, from the R*Tree over botpois.
+// Its boxes are rounded outwards, so POIs just outside the view are left out afterwards.
+func getCandidatesInView(db *sql.DB, q MapQuery) []poi {
+	rows, err := db.Query(`SELECT p.osmid, p.latitude, p.longitude,
+	COALESCE(t.amenity, ''),
+	COALESCE(t.name, ''),
+	COALESCE(t.name_en, ''),
+	COALESCE(t.addr_housenumber, ''),
+	COALESCE(t.addr_street, ''),
+	COALESCE(t.opening_hours, ''),
+	COALESCE(t.phone, ''),
+	COALESCE(t.cuisine, ''),
+	COALESCE(t.description, ''),
+	COALESCE(t.internet_access, ''),
+	COALESCE(t.smoking, ''),
+	COALESCE(t.wheelchair, '')
+	FROM botpois_index i JOIN botpois p ON p.rowid = i.id
+	LEFT JOIN taginfo t ON t.botid = p.botid AND t.osmid = p.osmid
+	WHERE i.maxlat >= $1 AND i.minlat <= $2 AND `+q.lonOverlaps("i.minlon", "i.maxlon")+`
+	AND p.visitype="maybe" AND p.osmid IS NOT NULL
+	GROUP BY p.osmid ORDER BY p.osmid;`, q.South, q.North, q.West, q.East)
+	check(err)
+	defer rows.Close()
+
+	pois := []poi{}
+	for rows.Next() {
+		p := poi{}
+		tags := tagsStruct{}
+		err = rows.Scan(&p.ID, &p.Lat, &p.Lon,
+			&tags.Amenity,
+			&tags.Name,
+			&tags.Name_en,
+			&tags.Addr_housenumber,
+			&tags.Addr_street,
+			&tags.Opening_hours,
+			&tags.Phone,
+			&tags.Cuisine,
+			&tags.Description,
+			&tags.Internet_access,
+			&tags.Smoking,
+			&tags.Wheelchair)
+		check(err)
+
+		if !q.contains(p.Lat, p.Lon) {
+			continue
+		}
+		p.Tags = tags.tagMap()
+		p.Completeness, p.Missing = tags.completeness()
+		pois = append(pois, p)
+	}
+	err = rows.Err()
+	check(err)
+	return pois
+}
+
+// Groups POIs into grid cells the size of clusterCellPixels at the query's zoom. Cells with one POI keep it
+// as it is. Cells are in degrees rather than Web Mercator, so they get taller towards the poles.
+func cluster(q MapQuery, pois []poi) ([]poi, []poiCluster) {
+	if q.Zoom >= clusterMaxZoom {
+		return pois, []poiCluster{}
+	}
+
+	type cell struct{ x, y int }
+	size := q.cellSize()
+	cells := map[cell][]poi{}
+	order := []cell{}
+	for _, p := range pois {
+		c := cell{int(math.Floor(p.Lon / size)), int(math.Floor(p.Lat / size))}
+		if _, ok := cells[c]; !ok {
+			order = append(order, c)
+		}
+		cells[c] = append(cells[c], p)
+	}
+
+	single := []poi{}
+	clusters := []poiCluster{}
+	for _, c := range order {
+		members := cells[c]
+		if len(members) == 1 {
+			single = append(single, members[0])
+			continue
+		}
+
+		cl := poiCluster{Count: len(members)}
+		for _, p := range members {
+			cl.Lat += p.Lat
+			cl.Lon += p.Lon
+			cl.Completeness += p.Completeness
+		}
+		n := float64(len(members))
+		cl.Lat, cl.Lon, cl.Completeness = cl.Lat/n, cl.Lon/n, cl.Completeness/n
+		clusters = append(clusters, cl)
+	}
+
+	sort.Slice(clusters, func(i, j int) bool {
+		if clusters[i].Lat != clusters[j].Lat {
+			return clusters[i].Lat < clusters[j].Lat
+		}
+		return clusters[i].Lon < clusters[j].Lon
+	})
+	return single, clusters
+}
+
+// Gets the bots of registered types in view, sorted by ID, with everything GetTravelBots gets but their fences,
+// in one query that only reads. The map is polled often, so unlike GetTravelBots this doesn't make any tables;
+// they must already be there, as Migrate makes them. Older databases keep Lat and Lon as TEXT, so they're cast
+// to compare them as numbers.
+func getBotsInView(db *sql.DB, q MapQuery) []bot {
+	defer observeQuery("getBotsInView", time.Now())
+
+	rows, err := db.Query(`SELECT b.BotID, COALESCE(b.UserID, 0), b.Name, b.Radius, b.Lat, b.Lon, COALESCE(b.bottype, ''),
+	p.botid IS NOT NULL, COALESCE(p.curiosity, 0), COALESCE(p.sociability, 0), COALESCE(p.stamina, 0),
+	COALESCE(p.homesickness, 0), COALESCE(p.tagprefs, '{}'),
+	COALESCE(s.searchradius, 0), COALESCE(s.stuck, 0), COALESCE(s.stuckticks, 0), COALESCE(s.stucksince, ''),
+	r.botid IS NOT NULL, COALESCE(r.homelat, 0), COALESCE(r.homelon, 0), COALESCE(r.slots, '[]'), COALESCE(z.timezone, ''),
+	COALESCE(e.categories, '[]'), COALESCE(e.paused, 0),
+	COALESCE(k.state, ''), COALESCE(k.destosmid, 0), COALESCE(k.destlat, 0), COALESCE(k.destlon, 0), COALESCE(k.updated, '')
+	FROM bots b
+	LEFT JOIN botpersonality p ON p.botid = b.BotID
+	LEFT JOIN botsearch s ON s.botid = b.BotID
+	LEFT JOIN botroutine r ON r.botid = b.BotID
+	LEFT JOIN bottimezone z ON z.botid = b.BotID
+	LEFT JOIN botsettings e ON e.botid = b.BotID
+	LEFT JOIN bottick k ON k.botid = b.BotID
+	WHERE CAST(b.Lat AS REAL) BETWEEN $1 AND $2 AND `+q.lonOverlaps("CAST(b.Lon AS REAL)", "CAST(b.Lon AS REAL)")+`
+	ORDER BY b.BotID;`, q.South, q.North, q.West, q.East)
+	check(err)
+	defer rows.Close()
+
+	bots := []bot{}
+	for rows.Next() {
+		b := bot{}
+		var hasPersonality, hasRoutine bool
+		var tagPrefs, slots, categories string
+		err = rows.Scan(&b.ID, &b.UserID, &b.Name, &b.Radius, &b.Lat, &b.Lon, &b.Type,
+			&hasPersonality, &b.Personality.Curiosity, &b.Personality.Sociability, &b.Personality.Stamina,
+			&b.Personality.Homesickness, &tagPrefs,
+			&b.SearchRadius, &b.Stuck, &b.StuckTicks, &b.StuckSince,
+			&hasRoutine, &b.Routine.Home.Lat, &b.Routine.Home.Lon, &slots, &b.Routine.Timezone,
+			&categories, &b.Paused,
+			&b.Tick.State, &b.Tick.DestOSMID, &b.Tick.DestLat, &b.Tick.DestLon, &b.Tick.Updated)
+		check(err)
+		if _, ok := botTypes[b.Type]; !ok {
+			continue
+		}
+
+		if hasPersonality {
+			err = json.Unmarshal([]byte(tagPrefs), &b.Personality.TagPrefs)
+			check(err)
+		} else {
+			b.Personality = defaultPersonality()
+		}
+		if hasRoutine {
+			err = json.Unmarshal([]byte(slots), &b.Routine.Slots)
+			check(err)
+		} else {
+			b.Routine = routine{Home: homeLocation{b.Lat, b.Lon}, Slots: defaultSlots()}
+		}
+		b.Categories = []string{}
+		err = json.Unmarshal([]byte(categories), &b.Categories)
+		check(err)
+		if b.Tick.State == "" {
+			b.Tick = tickState{State: stateIdle}
+		}
+		b.Slot = b.currentSlot()
+		bots = append(bots, b)
+	}
+	err = rows.Err()
+	check(err)
+	return bots
+}
+
+// GetMapData returns the bots and candidate POIs in view as JSON, with POIs clustered below clusterMaxZoom.
+// The same data always gives the same JSON, so it can be used for an ETag. It only reads, so the tables and the
+// spatial index must have been made by Migrate.
+func GetMapData(db *sql.DB, q MapQuery) []byte {
+	data := mapData{Bots: getBotsInView(db, q)}
+
+	data.POIs, data.Clusters = cluster(q, getCandidatesInView(db, q))
+
+	dataJSON, err := json.Marshal(data)
+	check(err)
+	return dataJSON
+}
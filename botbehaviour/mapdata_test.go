@@ -0,0 +1,84 @@
+package botbehaviour
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/alexalexyang/botschaft/models"
+)
+
+// The map's read-only queries find the same bots as GetTravelBots, and the same candidates as checking every one,
+// in boxes on either side of the antimeridian.
+func TestMapData(t *testing.T) {
+	f := newTickFixture(t, nil)
+	f.addBots(t, 12, 1500, 1000)
+	db := f.db
+	// A bot from before routines were saved with new bots.
+	err := models.InsertBot(db, models.BotBaseProfile{BotID: 100, Name: "Old bot", Lat: 52.51, Lon: 13.39, Radius: 1000, BotType: "travelbot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if failed := processBots(discardLogger(), db, f.cfg, GetTravelBots(db)); len(failed) > 0 {
+		t.Fatalf("%d bots failed", len(failed))
+	}
+
+	queries := map[string]MapQuery{
+		"world":        {-180, -90, 180, 90, 0},
+		"west":         {13.3, 52.4, 13.4, 52.6, 15},
+		"antimeridian": {170, -90, 13.4, 90, 3},
+		"elsewhere":    {170, -90, -170, 90, 3},
+	}
+	for name, q := range queries {
+		want := []bot{}
+		for _, b := range GetTravelBots(db) {
+			if q.contains(b.Lat, b.Lon) {
+				b.Fences = nil
+				want = append(want, b)
+			}
+		}
+		got := getBotsInView(db, q)
+		gotJSON, err := json.Marshal(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantJSON, err := json.Marshal(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(gotJSON) != string(wantJSON) {
+			t.Errorf("%s: bots in view are\n%s\nwant\n%s", name, gotJSON, wantJSON)
+		}
+
+		wantPOIs := []poi{}
+		for _, p := range getCandidatesInView(db, MapQuery{-180, -90, 180, 90, 0}) {
+			if q.contains(p.Lat, p.Lon) {
+				wantPOIs = append(wantPOIs, p)
+			}
+		}
+		if gotPOIs := getCandidatesInView(db, q); !reflect.DeepEqual(gotPOIs, wantPOIs) {
+			t.Errorf("%s: %d candidates in view, want %d", name, len(gotPOIs), len(wantPOIs))
+		}
+		if name == "west" && (len(got) == 0 || len(got) == len(getBotsInView(db, queries["world"])) || len(wantPOIs) == 0) {
+			t.Errorf("west: %d bots and %d candidates in view, so the box doesn't test anything", len(got), len(wantPOIs))
+		}
+	}
+}
+
+// The shipped database keeps coordinates as TEXT, where "44.79" comes after "180".
+func TestMapDataShipped(t *testing.T) {
+	db := shippedDB(t)
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM bots;`).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := getBotsInView(db, MapQuery{-180, -90, 180, 90, 0}); len(got) != n {
+		t.Errorf("%d bots in a view of the world, want all %d", len(got), n)
+	}
+	// Bots 1 and 2 are in Tbilisi, at about 41.71, 44.79.
+	if got := getBotsInView(db, MapQuery{44, 41, 45, 42, 10}); len(got) != 2 || got[0].ID != 1 || got[1].ID != 2 {
+		t.Errorf("%d bots in a view of Tbilisi, want bots 1 and 2", len(got))
+	}
+}
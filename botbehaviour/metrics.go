@@ -0,0 +1,138 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alexalexyang/botschaft/config"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// How long a tick may take on top of the wait between ticks, to ask Overpass and save every bot.
+const readyTickSlack = 5 * time.Minute
+
+// How long since the last successful tick before the travel engine isn't ready any more: two ticks' wait,
+// so one missed tick doesn't make it unready, and readyTickSlack.
+func readyTickAge(cfg config.Config) time.Duration {
+	return 2*cfg.TickInterval.Duration + readyTickSlack
+}
+
+// Metrics for the travel engine, served at /metrics.
+var (
+	tickDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "botschaft_tick_duration_seconds",
+		Help:    "How long a travel tick takes, from getting bots to moving them.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	})
+	ticksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "botschaft_ticks_total",
+		Help: "Travel ticks run, by result: ok or error.",
+	}, []string{"result"})
+	botsProcessed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "botschaft_bots_processed_total",
+		Help: "Bots moved or rested by successful travel ticks.",
+	})
+	botsFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "botschaft_bots_failed_total",
+		Help: "Bots that failed a step of a travel tick. They carry on from their last step next tick.",
+	})
+	poisFetched = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "botschaft_pois_fetched_total",
+		Help: "POIs returned by Overpass.",
+	})
+	overpassDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "botschaft_overpass_request_duration_seconds",
+		Help:    "How long Overpass takes to answer a query.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	})
+	overpassErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "botschaft_overpass_errors_total",
+		Help: "Overpass queries that failed or didn't return 200.",
+	})
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "botschaft_db_query_duration_seconds",
+		Help:    "How long the travel engine's database work takes, by function.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"query"})
+	botDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "botschaft_bot_tick_duration_seconds",
+		Help:    "How long one bot's part of a travel tick takes.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+	workersBusy = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "botschaft_workers_busy",
+		Help: "Travel workers working on a bot now.",
+	})
+	overpassWaiting = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "botschaft_overpass_waiting",
+		Help: "Bots waiting for a free Overpass slot.",
+	})
+	geofenceBlocks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "botschaft_geofence_blocks_total",
+		Help: "POIs and moves geofences kept bots from, by stage: candidate, route, tour or move.",
+	}, []string{"stage"})
+	botStuckTicks = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "botschaft_bot_stuck_ticks",
+		Help: "Ticks in a row a bot has found no POIs even at the largest search radius.",
+	}, []string{"bot"})
+)
+
+var lastTick struct {
+	sync.Mutex
+	at time.Time
+}
+
+// Use with defer at the top of a function doing database work: defer observeQuery("name", time.Now())
+func observeQuery(name string, start time.Time) {
+	dbQueryDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+}
+
+func observeStuck(b bot) {
+	botStuckTicks.WithLabelValues(strconv.Itoa(b.ID)).Set(float64(b.StuckTicks))
+}
+
+func markTickDone() {
+	lastTick.Lock()
+	lastTick.at = time.Now()
+	lastTick.Unlock()
+}
+
+// LastTick returns when the last successful travel tick finished. Zero if there hasn't been one yet.
+func LastTick() time.Time {
+	lastTick.Lock()
+	defer lastTick.Unlock()
+	return lastTick.at
+}
+
+// Health is what /healthz and /readyz report.
+type Health struct {
+	Database      string  `json:"database"`
+	LastTick      string  `json:"lasttick,omitempty"`
+	SinceLastTick float64 `json:"sincelasttick,omitempty"`
+	// Ready: the database is reachable and a tick succeeded within readyTickAge of cfg.
+	Ready bool `json:"ready"`
+}
+
+// CheckHealth checks the database can be reached and how long ago the last successful tick was, against cfg's
+// tick interval.
+func CheckHealth(db *sql.DB, cfg config.Config) Health {
+	health := Health{Database: "ok"}
+
+	var tables int
+	err := db.QueryRow(`SELECT count(*) FROM sqlite_master;`).Scan(&tables)
+	if err != nil {
+		health.Database = err.Error()
+	}
+
+	last := LastTick()
+	if !last.IsZero() {
+		health.LastTick = last.UTC().Format(time.RFC3339)
+		health.SinceLastTick = time.Since(last).Seconds()
+	}
+	health.Ready = err == nil && !last.IsZero() && time.Since(last) < readyTickAge(cfg)
+	return health
+}
@@ -0,0 +1,38 @@
+package botbehaviour
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alexalexyang/botschaft/config"
+)
+
+// How long ago a tick may have been for the engine to be ready follows the tick interval.
+func TestReady(t *testing.T) {
+	db := testDB(t)
+	defer func(realLast time.Time) {
+		lastTick.Lock()
+		lastTick.at = realLast
+		lastTick.Unlock()
+	}(LastTick())
+	lastTick.Lock()
+	lastTick.at = time.Now().Add(-10 * time.Minute)
+	lastTick.Unlock()
+
+	cases := []struct {
+		interval time.Duration
+		ready    bool
+	}{
+		{10 * time.Second, false},
+		{time.Minute, false},
+		{5 * time.Minute, true},
+		{time.Hour, true},
+	}
+	for _, c := range cases {
+		cfg := config.Default()
+		cfg.TickInterval.Duration = c.interval
+		if health := CheckHealth(db, cfg); health.Ready != c.ready {
+			t.Errorf("last tick 10 minutes ago, every %s: ready is %v, want %v", c.interval, health.Ready, c.ready)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func createMovesTable(db dbtx) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS botmoves (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		botid INTEGER,
+		fromlat REAL,
+		fromlon REAL,
+		tolat REAL,
+		tolon REAL,
+		osmid INTEGER,
+		at TEXT
+	);`)
+	check(err)
+}
+
+// Saves a bot's move from where it was to its destination, for its trail. osmid is 0 if it didn't go to a POI.
+// Moves that don't go anywhere aren't saved.
+func recordMove(db dbtx, b bot, toLat float64, toLon float64, osmid int) error {
+	if b.Lat == toLat && b.Lon == toLon {
+		return nil
+	}
+
+	_, err := db.Exec(`INSERT INTO botmoves (botid, fromlat, fromlon, tolat, tolon, osmid, at) values ($1, $2, $3, $4, $5, $6, $7);`,
+		b.ID, b.Lat, b.Lon, toLat, toLon, osmid, now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// The tags of POIs bots have visited. taginfo only keeps a bot's next possible locations, so this is where
+// what a bot has been to is remembered.
+func createPOITagsTable(db dbtx) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS poitags (
+		osmid INTEGER PRIMARY KEY,
+		amenity TEXT,
+		name TEXT,
+		cuisine TEXT,
+		completeness REAL,
+		updated TEXT
+	);`)
+	check(err)
+}
+
+// Every POI each bot has visited, with all the tags the data gap report and the mapping tasks look at, as
+// they were at its latest visit. Kept for good, unlike taginfo.
+func createVisitedTagsTable(db dbtx) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS visitedtags (
+		botid INTEGER,
+		osmid INTEGER,
+		latitude REAL,
+		longitude REAL,
+		amenity TEXT,
+		name TEXT,
+		name_en TEXT,
+		addr_housenumber TEXT,
+		addr_street TEXT,
+		opening_hours TEXT,
+		phone TEXT,
+		cuisine TEXT,
+		description TEXT,
+		internet_access TEXT,
+		smoking TEXT,
+		wheelchair TEXT,
+		updated TEXT,
+		PRIMARY KEY (botid, osmid)
+	);`)
+	check(err)
+}
+
+// Finds a POI's tags: in a bot's next possible locations in taginfo, the bot's own first, otherwise in the
+// tags kept from bots' visits, otherwise in the POIs loaded with ImportOSM. A surveyor's tour can go to POIs
+// other bots found. False if nothing has the POI's tags.
+func findTags(db dbtx, botID int, osmid int) (tagsStruct, bool, error) {
+	tags := tagsStruct{}
+	// Table names come from this list, never from the request.
+	for _, table := range []string{"taginfo", "visitedtags"} {
+		err := db.QueryRow(`SELECT
+		COALESCE(amenity, ''),
+		COALESCE(name, ''),
+		COALESCE(name_en, ''),
+		COALESCE(addr_housenumber, ''),
+		COALESCE(addr_street, ''),
+		COALESCE(opening_hours, ''),
+		COALESCE(phone, ''),
+		COALESCE(cuisine, ''),
+		COALESCE(description, ''),
+		COALESCE(internet_access, ''),
+		COALESCE(smoking, ''),
+		COALESCE(wheelchair, '')
+		FROM `+table+` WHERE osmid=$2 ORDER BY botid=$1 DESC LIMIT 1;`, botID, osmid).Scan(
+			&tags.Amenity,
+			&tags.Name,
+			&tags.Name_en,
+			&tags.Addr_housenumber,
+			&tags.Addr_street,
+			&tags.Opening_hours,
+			&tags.Phone,
+			&tags.Cuisine,
+			&tags.Description,
+			&tags.Internet_access,
+			&tags.Smoking,
+			&tags.Wheelchair)
+		if err != sql.ErrNoRows {
+			return tags, err == nil, err
+		}
+	}
+
+	var osmTags string
+	err := db.QueryRow(`SELECT tags FROM osmpois WHERE osmid=$1;`, osmid).Scan(&osmTags)
+	if err == sql.ErrNoRows {
+		return tags, false, nil
+	}
+	if err != nil {
+		return tags, false, err
+	}
+	parsed := map[string]string{}
+	err = json.Unmarshal([]byte(osmTags), &parsed)
+	if err != nil {
+		return tags, false, err
+	}
+	return tagsFromOSM(parsed), true, nil
+}
+
+// Saves the tags of a POI a bot is visiting at lat, lon, from wherever findTags finds them.
+// Returns the POI's name, or "" if it has none.
+func rememberVisit(db dbtx, botID int, osmid int, lat float64, lon float64) (string, error) {
+	tags, ok, err := findTags(db, botID, osmid)
+	if err != nil || !ok {
+		return "", err
+	}
+
+	updated := now().UTC().Format(time.RFC3339)
+	completeness, _ := tags.completeness()
+	_, err = db.Exec(`INSERT OR REPLACE INTO poitags (osmid, amenity, name, cuisine, completeness, updated) values ($1, $2, $3, $4, $5, $6);`,
+		osmid, tags.Amenity, tags.Name, tags.Cuisine, completeness, updated)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec(`INSERT OR REPLACE INTO visitedtags (
+		botid,
+		osmid,
+		latitude,
+		longitude,
+		amenity,
+		name,
+		name_en,
+		addr_housenumber,
+		addr_street,
+		opening_hours,
+		phone,
+		cuisine,
+		description,
+		internet_access,
+		smoking,
+		wheelchair,
+		updated
+		) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17);`,
+		botID,
+		osmid,
+		lat,
+		lon,
+		tags.Amenity,
+		tags.Name,
+		tags.Name_en,
+		tags.Addr_housenumber,
+		tags.Addr_street,
+		tags.Opening_hours,
+		tags.Phone,
+		tags.Cuisine,
+		tags.Description,
+		tags.Internet_access,
+		tags.Smoking,
+		tags.Wheelchair,
+		updated)
+	return tags.Name, err
+}
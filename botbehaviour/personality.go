@@ -0,0 +1,236 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Tags a bot can have preferences for, as "key=value", e.g. "cuisine=italian".
+var preferableTags = []string{"amenity", "cuisine", "smoking", "wheelchair", "internet_access"}
+
+// How close in km another bot has to be to a POI to count as company there.
+const companyDistance = 0.1
+
+// personality drives how a bot behaves. All traits are from 0 to 1.
+type personality struct {
+	// Curiosity: how far a bot searches, and how much it likes far away POIs.
+	Curiosity float64 `json:"curiosity"`
+	// Sociability: how much a bot likes POIs other bots are at. Below 0.5 it avoids them.
+	Sociability float64 `json:"sociability"`
+	// Stamina: how often a bot moves rather than rests.
+	Stamina float64 `json:"stamina"`
+	// Homesickness: how much a bot likes POIs close to its home.
+	Homesickness float64 `json:"homesickness"`
+	// TagPrefs: weights for POIs with a tag, e.g. "cuisine=italian": 3. Tags not listed weigh 1.
+	TagPrefs map[string]float64 `json:"tagprefs"`
+}
+
+// A POI a bot might move to, with the tags its personality cares about.
+type candidatePOI struct {
+	OSMID int
+	Lat   float64
+	Lon   float64
+	Tags  map[string]string
+	// Completeness: share of expectedTags the POI has on OSM, from 0 to 1. Missing: the expected tags it doesn't have.
+	Completeness float64
+	Missing      []string
+}
+
+func defaultPersonality() personality {
+	return personality{0.5, 0.5, 0.5, 0.5, map[string]float64{}}
+}
+
+// Rolls a personality so bots created in the same place don't all behave the same.
+func randomPersonality(rng *rand.Rand) personality {
+	return personality{rng.Float64(), rng.Float64(), rng.Float64(), rng.Float64(), map[string]float64{}}
+}
+
+func (p personality) validate() error {
+	traits := []float64{p.Curiosity, p.Sociability, p.Stamina, p.Homesickness}
+	for _, trait := range traits {
+		if trait < 0 || trait > 1 {
+			return errors.New("personality traits must be between 0 and 1")
+		}
+	}
+	for tag, weight := range p.TagPrefs {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || !isPreferableTag(kv[0]) {
+			return errors.New(`tag preferences must look like "key=value" with key one of ` + strings.Join(preferableTags, ", "))
+		}
+		if weight < 0 {
+			return errors.New("tag preference weights can't be negative")
+		}
+	}
+	return nil
+}
+
+func isPreferableTag(key string) bool {
+	for _, tag := range preferableTags {
+		if key == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Scales the radius a bot searches in, from half for a bot with no curiosity up to one and a half times.
+func (p personality) travelRadius(radius float64) float64 {
+	return radius * (0.5 + p.Curiosity)
+}
+
+// A bot with no stamina rests every other tick, a bot with full stamina never does.
+func (p personality) wantsRest(rng *rand.Rand) bool {
+	return rng.Float64() > 0.5+p.Stamina/2
+}
+
+// Multiplies together the bot's preferences for each tag the POI has. Cuisine can hold several values separated by ";".
+func (p personality) tagWeight(tags map[string]string) float64 {
+	weight := 1.0
+	for key, value := range tags {
+		for _, v := range strings.Split(value, ";") {
+			if pref, ok := p.TagPrefs[key+"="+strings.TrimSpace(v)]; ok {
+				weight *= pref
+			}
+		}
+	}
+	return weight
+}
+
+// Curious bots like POIs far from where they are, homesick bots like POIs near home. Distances and radius in km.
+func (p personality) distanceWeight(distance float64, homeDistance float64, radius float64) float64 {
+	if radius <= 0 {
+		return 1
+	}
+	farness := math.Min(distance/radius, 1)
+	homeCloseness := 1 / (1 + homeDistance/radius)
+	return 1 + p.Curiosity*farness + p.Homesickness*homeCloseness
+}
+
+// From 0.25 for an unsociable bot to 1.75 for a sociable one, if there are other bots at the POI.
+func (p personality) socialWeight(company int) float64 {
+	if company == 0 {
+		return 1
+	}
+	return 0.25 + 1.5*p.Sociability
+}
+
+// Picks a POI at random, weighted by how much the bot's personality likes it. radius in km.
+// Returns false if there's nothing to pick.
+func (p personality) chooseDestination(rng *rand.Rand, b bot, candidates []candidatePOI, others []bot, radius float64) (candidatePOI, bool) {
+	if len(candidates) == 0 {
+		return candidatePOI{}, false
+	}
+
+	weights := make([]float64, len(candidates))
+	var total float64
+	for i, c := range candidates {
+		company := 0
+		for _, other := range others {
+			if other.ID != b.ID && haversine(c.Lon, c.Lat, other.Lon, other.Lat) < companyDistance {
+				company++
+			}
+		}
+
+		distance := haversine(b.Lon, b.Lat, c.Lon, c.Lat)
+		homeDistance := haversine(b.Routine.Home.Lon, b.Routine.Home.Lat, c.Lon, c.Lat)
+		weights[i] = p.tagWeight(c.Tags) * p.distanceWeight(distance, homeDistance, radius) * p.socialWeight(company)
+		total += weights[i]
+	}
+
+	// Every candidate is weighted 0, so fall back to not caring.
+	if total == 0 {
+		return candidates[rng.Intn(len(candidates))], true
+	}
+
+	pick := rng.Float64() * total
+	for i, c := range candidates {
+		pick -= weights[i]
+		if pick < 0 {
+			return c, true
+		}
+	}
+	return candidates[len(candidates)-1], true
+}
+
+func createPersonalityTable(db dbtx) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS botpersonality (
+		botid INTEGER PRIMARY KEY,
+		curiosity REAL,
+		sociability REAL,
+		stamina REAL,
+		homesickness REAL,
+		tagprefs TEXT
+	);`)
+	check(err)
+}
+
+// Gets a bot's personality, or the default one if it doesn't have one yet.
+func getPersonality(db *sql.DB, botID int) personality {
+	p := defaultPersonality()
+	var tagPrefs string
+	err := db.QueryRow(`SELECT curiosity, sociability, stamina, homesickness, tagprefs FROM botpersonality WHERE botid=$1;`, botID).
+		Scan(&p.Curiosity, &p.Sociability, &p.Stamina, &p.Homesickness, &tagPrefs)
+	if err == sql.ErrNoRows {
+		return defaultPersonality()
+	}
+	check(err)
+
+	err = json.Unmarshal([]byte(tagPrefs), &p.TagPrefs)
+	check(err)
+	return p
+}
+
+func savePersonality(db dbtx, botID int, p personality) {
+	if p.TagPrefs == nil {
+		p.TagPrefs = map[string]float64{}
+	}
+	tagPrefs, err := json.Marshal(p.TagPrefs)
+	check(err)
+
+	statement := `INSERT OR REPLACE INTO botpersonality (botid, curiosity, sociability, stamina, homesickness, tagprefs) values ($1, $2, $3, $4, $5, $6);`
+	_, err = db.Exec(statement, botID, p.Curiosity, p.Sociability, p.Stamina, p.Homesickness, string(tagPrefs))
+	check(err)
+}
+
+// GetPersonality returns a bot's personality as JSON. Returns false if there is no such bot.
+func GetPersonality(db *sql.DB, botID int) ([]byte, bool) {
+	if _, ok := getBot(db, botID); !ok {
+		return nil, false
+	}
+
+	personalityJSON, err := json.Marshal(getPersonality(db, botID))
+	check(err)
+	return personalityJSON, true
+}
+
+// SetPersonality validates a personality in JSON and saves it for a bot.
+func SetPersonality(db *sql.DB, botID int, personalityJSON []byte) error {
+	if _, ok := getBot(db, botID); !ok {
+		return noBot(botID)
+	}
+
+	p := defaultPersonality()
+	err := json.Unmarshal(personalityJSON, &p)
+	if err != nil {
+		return err
+	}
+	err = p.validate()
+	if err != nil {
+		return err
+	}
+
+	savePersonality(db, botID, p)
+	return nil
+}
+
+// CreateRandomPersonality gives a new bot a random personality.
+func CreateRandomPersonality(db *sql.DB, botID int) {
+	rng := botRand(botID)
+	savePersonality(db, botID, randomPersonality(rng))
+}
@@ -0,0 +1,130 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+
+	"github.com/alexalexyang/botschaft/models"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// How many favourite cuisines and recent messages a profile shows.
+const (
+	profileCuisines = 5
+	profileMessages = 20
+)
+
+type cuisineCount struct {
+	Cuisine string `json:"cuisine"`
+	Visits  int    `json:"visits"`
+}
+
+// Profile is what a bot's public profile shows: who it is and what it has done. Owners are public, as on the map.
+type Profile struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	OwnerID   int    `json:"ownerid"`
+	OwnerName string `json:"ownername"`
+	Type      string `json:"type"`
+	// Personality: see personality for what each trait does.
+	Personality personality  `json:"personality"`
+	Home        homeLocation `json:"home"`
+	Location    homeLocation `json:"location"`
+	// DistanceKm: how far the bot has travelled, adding up the straight lines between its moves.
+	DistanceKm float64 `json:"distancekm"`
+	// UniquePOIs: how many different POIs the bot has visited.
+	UniquePOIs int `json:"uniquepois"`
+	// Cuisines: the cuisines of the POIs it has visited most often, most first.
+	Cuisines []cuisineCount `json:"cuisines"`
+	Friends  []friend       `json:"friends"`
+	// Achievements: the badges the bot has been awarded, oldest first.
+	Achievements []badge `json:"achievements"`
+	// Messages: the last messages the bot sent or got, newest first.
+	Messages []botMessage `json:"messages"`
+}
+
+func distanceTravelled(db *sql.DB, botID int) float64 {
+	rows, err := db.Query(`SELECT fromlat, fromlon, tolat, tolon FROM botmoves WHERE botid=$1;`, botID)
+	check(err)
+	defer rows.Close()
+
+	km := 0.0
+	for rows.Next() {
+		var fromLat, fromLon, toLat, toLon float64
+		err = rows.Scan(&fromLat, &fromLon, &toLat, &toLon)
+		check(err)
+		km += haversine(fromLon, fromLat, toLon, toLat)
+	}
+	err = rows.Err()
+	check(err)
+	return km
+}
+
+// Counts visits by cuisine. A POI with several cuisines, like "pizza;pasta", counts for each.
+func favouriteCuisines(db *sql.DB, botID int) []cuisineCount {
+	rows, err := db.Query(`SELECT t.cuisine FROM botpois p JOIN poitags t ON t.osmid = p.osmid
+	WHERE p.botid=$1 AND p.visitype="visited" AND t.cuisine != '';`, botID)
+	check(err)
+	defer rows.Close()
+
+	visits := map[string]int{}
+	for rows.Next() {
+		var cuisines string
+		err = rows.Scan(&cuisines)
+		check(err)
+		for _, cuisine := range strings.Split(cuisines, ";") {
+			cuisine = strings.TrimSpace(cuisine)
+			if cuisine != "" {
+				visits[cuisine]++
+			}
+		}
+	}
+	err = rows.Err()
+	check(err)
+
+	counts := []cuisineCount{}
+	for cuisine, n := range visits {
+		counts = append(counts, cuisineCount{cuisine, n})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Visits != counts[j].Visits {
+			return counts[i].Visits > counts[j].Visits
+		}
+		return counts[i].Cuisine < counts[j].Cuisine
+	})
+	if len(counts) > profileCuisines {
+		counts = counts[:profileCuisines]
+	}
+	return counts
+}
+
+// GetProfile gets a bot's public profile. Returns false if there is no such bot.
+func GetProfile(db *sql.DB, botID int) (Profile, bool) {
+	b, ok := getBot(db, botID)
+	if !ok {
+		return Profile{}, false
+	}
+
+	p := Profile{ID: b.ID, Name: b.Name, Location: homeLocation{b.Lat, b.Lon}}
+	err := db.QueryRow(`SELECT COALESCE(UserID, 0), COALESCE(bottype, '') FROM bots WHERE BotID=$1;`, botID).Scan(&p.OwnerID, &p.Type)
+	check(err)
+	owner, err := models.GetUser(db, p.OwnerID)
+	if err != nil && err != sql.ErrNoRows {
+		panic(err)
+	}
+	p.OwnerName = owner.Name
+
+	p.Personality = getPersonality(db, botID)
+	p.Home = getRoutine(db, b).Home
+	p.DistanceKm = distanceTravelled(db, botID)
+
+	err = db.QueryRow(`SELECT COUNT(DISTINCT osmid) FROM botpois WHERE botid=$1 AND visitype="visited";`, botID).Scan(&p.UniquePOIs)
+	check(err)
+
+	p.Cuisines = favouriteCuisines(db, botID)
+	p.Friends = getFriends(db, botID)
+	p.Achievements = getBadges(db, botID)
+	p.Messages = getMessages(db, botID, profileMessages)
+	return p, true
+}
@@ -0,0 +1,57 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/alexalexyang/botschaft/models"
+)
+
+func TestProfileOwner(t *testing.T) {
+	db := migratedDB(t)
+	userID, err := models.CreateUser(db, models.User{Name: "Ada"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	botID, err := CreateBot(db, NewBot{UserID: userID, Name: "Bot", Lat: 52.52, Lon: 13.4, Radius: 1000, Type: "travelbot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, ok := GetProfile(db, botID)
+	if !ok {
+		t.Fatalf("no profile for bot %d", botID)
+	}
+	if p.OwnerID != userID || p.OwnerName != "Ada" {
+		t.Errorf("bot %d is owned by %d, %q, want %d, \"Ada\"", botID, p.OwnerID, p.OwnerName, userID)
+	}
+	if _, ok := GetProfile(db, botID+1); ok {
+		t.Errorf("bot %d, which doesn't exist, has a profile", botID+1)
+	}
+}
+
+// What the API gets for a bot is there only for bots that exist, so a bot that doesn't isn't found.
+func TestMissingBot(t *testing.T) {
+	db := migratedDB(t)
+	botID, err := CreateBot(db, NewBot{Name: "Bot", Lat: 52.52, Lon: 13.4, Radius: 1000, Type: "travelbot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getters := map[string]func(*sql.DB, int) ([]byte, bool){
+		"personality":  GetPersonality,
+		"routine":      GetRoutine,
+		"ratings":      GetRatings,
+		"tour":         GetTour,
+		"events":       GetEvents,
+		"achievements": GetAchievements,
+	}
+	for name, get := range getters {
+		if _, ok := get(db, botID); !ok {
+			t.Errorf("bot %d has no %s", botID, name)
+		}
+		if _, ok := get(db, botID+1); ok {
+			t.Errorf("bot %d, which doesn't exist, has a %s", botID+1, name)
+		}
+	}
+}
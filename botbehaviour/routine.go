@@ -0,0 +1,279 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/ringsaturn/tzf"
+)
+
+// The POI category bots look for when their routine has nothing else planned.
+const defaultAmenity = "restaurant"
+
+// Amenity values are put into Overpass queries, so they can only be simple OSM values.
+var amenityPattern = regexp.MustCompile(`^[a-z_]*$`)
+
+// A part of a bot's day. From Start up to End in local hours, and may run past midnight, e.g. 22 to 7.
+type routineSlot struct {
+	Name  string `json:"name"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	// Amenity: the kind of POI the bot looks for in this slot. Empty means the bot goes home.
+	Amenity string `json:"amenity"`
+}
+
+type homeLocation struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// A bot's home and daily routine. Timezone: the IANA time zone the routine follows, like Europe/Berlin.
+// Empty to follow the time zone where the bot is.
+type routine struct {
+	Home     homeLocation  `json:"home"`
+	Slots    []routineSlot `json:"slots"`
+	Timezone string        `json:"timezone"`
+}
+
+func defaultSlots() []routineSlot {
+	return []routineSlot{
+		{"breakfast", 7, 10, "cafe"},
+		{"lunch", 12, 14, "restaurant"},
+		{"dinner", 18, 21, "restaurant"},
+		{"night", 22, 7, ""},
+	}
+}
+
+func (s routineSlot) goesHome() bool {
+	return s.Amenity == ""
+}
+
+// Whether the slot is looking for POIs with this amenity. A slot can look for several, separated by "|".
+func (s routineSlot) wants(amenity string) bool {
+	for _, a := range strings.Split(s.Amenity, "|") {
+		if a == amenity {
+			return true
+		}
+	}
+	return false
+}
+
+func (s routineSlot) contains(hour int) bool {
+	if s.Start <= s.End {
+		return hour >= s.Start && hour < s.End
+	}
+	return hour >= s.Start || hour < s.End
+}
+
+// Returns the slot the hour falls in. Hours not in any slot are free time spent wandering to defaultAmenity.
+func (r routine) slotAt(hour int) routineSlot {
+	for _, slot := range r.Slots {
+		if slot.contains(hour) {
+			return slot
+		}
+	}
+	return routineSlot{"wander", hour, hour + 1, defaultAmenity}
+}
+
+// Time zones by name, since loading one reads the zoneinfo database. It's built in with time/tzdata, so time
+// zones work on machines without one.
+var timezones sync.Map
+
+// Loads the IANA time zone called name. False if there's no such time zone.
+func loadZone(name string) (*time.Location, bool) {
+	if loc, ok := timezones.Load(name); ok {
+		return loc.(*time.Location), true
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, false
+	}
+	timezones.Store(name, loc)
+	return loc, true
+}
+
+// Finds the IANA time zone at a point from the time zone boundaries in OpenStreetMap. Made when it's first
+// needed, since it takes a moment and some memory to load.
+var timezoneFinder = sync.OnceValues(func() (tzf.F, error) {
+	return tzf.NewDefaultFinder()
+})
+
+// The time zone at a point, with its borders and daylight saving. Points the boundaries don't cover get
+// nauticalZone.
+func zoneAt(lat float64, lon float64) *time.Location {
+	finder, err := timezoneFinder()
+	if err != nil {
+		return nauticalZone(lon)
+	}
+	name := finder.GetTimezoneName(lon, lat)
+	if loc, ok := loadZone(name); ok && name != "" {
+		return loc
+	}
+	return nauticalZone(lon)
+}
+
+// Approximates the time zone at a longitude with nautical time zones, 15 degrees to an hour.
+// Only used where zoneAt has no time zone, as it ignores political borders and daylight saving.
+func nauticalZone(lon float64) *time.Location {
+	offset := int(math.Round(lon / 15))
+	name := "UTC"
+	if offset >= 0 {
+		name += "+"
+	}
+	return time.FixedZone(name+strconv.Itoa(offset), offset*3600)
+}
+
+// The bot's local time at t, in its routine's Timezone, or in the time zone where it is if it has none.
+func (b bot) localTime(t time.Time) time.Time {
+	if b.Routine.Timezone != "" {
+		if loc, ok := loadZone(b.Routine.Timezone); ok {
+			return t.In(loc)
+		}
+	}
+	return t.In(zoneAt(b.Lat, b.Lon))
+}
+
+// The slot of its routine a bot is in at t, in the bot's local time.
+func (b bot) slotAt(t time.Time) routineSlot {
+	return b.Routine.slotAt(b.localTime(t).Hour())
+}
+
+func (r routine) validate() error {
+	if r.Home.Lat < -90 || r.Home.Lat > 90 || r.Home.Lon < -180 || r.Home.Lon > 180 {
+		return errors.New("home must be a valid latitude and longitude")
+	}
+	// time.LoadLocation also takes "Local", which is a different zone on every machine.
+	if r.Timezone != "" {
+		if _, err := time.LoadLocation(r.Timezone); err != nil || r.Timezone == "Local" {
+			return errors.New("timezone must be an IANA time zone like Europe/Berlin")
+		}
+	}
+	for _, slot := range r.Slots {
+		if slot.Name == "" {
+			return errors.New("routine slots need a name")
+		}
+		if slot.Start < 0 || slot.Start > 23 || slot.End < 0 || slot.End > 24 || slot.Start == slot.End {
+			return errors.New("routine slot " + slot.Name + " must start and end on different hours from 0 to 24")
+		}
+		if !amenityPattern.MatchString(slot.Amenity) {
+			return errors.New("routine slot " + slot.Name + " has an amenity that isn't an OSM value")
+		}
+	}
+	return nil
+}
+
+func createRoutineTable(db dbtx) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS botroutine (
+		botid INTEGER PRIMARY KEY,
+		homelat REAL,
+		homelon REAL,
+		slots TEXT
+	);`)
+	check(err)
+
+	// Kept apart from botroutine, which is never altered, so databases from before time zones still work.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS bottimezone (
+		botid INTEGER PRIMARY KEY,
+		timezone TEXT
+	);`)
+	check(err)
+}
+
+// Gets a bot's home and routine. A bot without one gets the default routine, with home where it is now,
+// which isn't saved; routines are saved when a bot is made, when they're changed, and by saveMissingRoutines.
+func getRoutine(db dbtx, b bot) routine {
+	r := routine{}
+	var slots string
+	err := db.QueryRow(`SELECT homelat, homelon, slots FROM botroutine WHERE botid=$1;`, b.ID).
+		Scan(&r.Home.Lat, &r.Home.Lon, &slots)
+	if err == sql.ErrNoRows {
+		return routine{Home: homeLocation{b.Lat, b.Lon}, Slots: defaultSlots()}
+	}
+	check(err)
+
+	err = json.Unmarshal([]byte(slots), &r.Slots)
+	check(err)
+
+	err = db.QueryRow(`SELECT timezone FROM bottimezone WHERE botid=$1;`, b.ID).Scan(&r.Timezone)
+	if err != sql.ErrNoRows {
+		check(err)
+	}
+	return r
+}
+
+func saveRoutine(db dbtx, botID int, r routine) {
+	if r.Slots == nil {
+		r.Slots = []routineSlot{}
+	}
+	slots, err := json.Marshal(r.Slots)
+	check(err)
+
+	statement := `INSERT OR REPLACE INTO botroutine (botid, homelat, homelon, slots) values ($1, $2, $3, $4);`
+	_, err = db.Exec(statement, botID, r.Home.Lat, r.Home.Lon, string(slots))
+	check(err)
+
+	_, err = db.Exec(`INSERT OR REPLACE INTO bottimezone (botid, timezone) values ($1, $2);`, botID, r.Timezone)
+	check(err)
+}
+
+// Saves the default routine, with home where the bot is now, for every bot without a routine, like bots made
+// before routines were saved with new bots. Runs before each tick, so their home stays where they first travelled from.
+func saveMissingRoutines(db dbtx) {
+	slots, err := json.Marshal(defaultSlots())
+	check(err)
+	_, err = db.Exec(`INSERT INTO botroutine (botid, homelat, homelon, slots)
+	SELECT BotID, Lat, Lon, $1 FROM bots WHERE BotID NOT IN (SELECT botid FROM botroutine);`, string(slots))
+	check(err)
+}
+
+func getBot(db *sql.DB, botID int) (bot, bool) {
+	b := bot{ID: botID}
+	err := db.QueryRow(`SELECT Name, Radius, Lat, Lon FROM bots WHERE BotID=$1;`, botID).Scan(&b.Name, &b.Radius, &b.Lat, &b.Lon)
+	if err == sql.ErrNoRows {
+		return b, false
+	}
+	check(err)
+	return b, true
+}
+
+// GetRoutine returns a bot's home and daily routine as JSON. Returns false if there is no such bot.
+func GetRoutine(db *sql.DB, botID int) ([]byte, bool) {
+	b, ok := getBot(db, botID)
+	if !ok {
+		return nil, false
+	}
+
+	routineJSON, err := json.Marshal(getRoutine(db, b))
+	check(err)
+	return routineJSON, true
+}
+
+// SetRoutine validates a home and daily routine in JSON and saves it for a bot. Anything left out stays as it was.
+func SetRoutine(db *sql.DB, botID int, routineJSON []byte) error {
+	b, ok := getBot(db, botID)
+	if !ok {
+		return noBot(botID)
+	}
+
+	r := getRoutine(db, b)
+	err := json.Unmarshal(routineJSON, &r)
+	if err != nil {
+		return err
+	}
+	err = r.validate()
+	if err != nil {
+		return err
+	}
+
+	saveRoutine(db, botID, r)
+	return nil
+}
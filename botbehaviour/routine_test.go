@@ -0,0 +1,92 @@
+package botbehaviour
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alexalexyang/botschaft/models"
+)
+
+func TestLocalTime(t *testing.T) {
+	summer := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+	winter := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	cases := []struct {
+		timezone string
+		lat, lon float64
+		at       time.Time
+		hour     int
+	}{
+		// Berlin is on daylight saving time in summer, which longitude alone doesn't know.
+		{"Europe/Berlin", 52.52, 13.4, summer, 12},
+		{"Europe/Berlin", 52.52, 13.4, winter, 11},
+		{"", 52.52, 13.4, summer, 12},
+		{"", 52.52, 13.4, winter, 11},
+		// Madrid is an hour ahead of its longitude all year.
+		{"Europe/Madrid", 40.42, -3.7, winter, 11},
+		{"", 40.42, -3.7, winter, 11},
+		// A time zone set by hand wins over where the bot is.
+		{"Asia/Tokyo", 52.52, 13.4, winter, 19},
+		// Kashgar keeps China's time, two hours ahead of its longitude.
+		{"", 39.47, 75.99, winter, 18},
+		// A time zone that can't be loaded goes by where the bot is.
+		{"Nowhere/Atlantis", 52.52, 13.4, summer, 12},
+	}
+	for _, c := range cases {
+		b := bot{Lat: c.lat, Lon: c.lon, Routine: routine{Timezone: c.timezone}}
+		if hour := b.localTime(c.at).Hour(); hour != c.hour {
+			t.Errorf("%q at %g, %g, %s: got hour %d, want %d", c.timezone, c.lat, c.lon, c.at.Format(time.RFC3339), hour, c.hour)
+		}
+	}
+}
+
+func TestRoutineTimezone(t *testing.T) {
+	for _, timezone := range []string{"", "UTC", "Europe/Berlin", "America/Argentina/Buenos_Aires"} {
+		if err := (routine{Timezone: timezone}).validate(); err != nil {
+			t.Errorf("%q: %v", timezone, err)
+		}
+	}
+	for _, timezone := range []string{"Local", "Nowhere/Atlantis", "../etc/passwd"} {
+		if err := (routine{Timezone: timezone}).validate(); err == nil {
+			t.Errorf("%q was allowed", timezone)
+		}
+	}
+}
+
+// Reading a routine doesn't save one. New bots get theirs when they're made, and older bots before a tick.
+func TestRoutineSaved(t *testing.T) {
+	db := migratedDB(t)
+	routines := func() int {
+		t.Helper()
+		var n int
+		err := db.QueryRow(`SELECT COUNT(*) FROM botroutine;`).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	err := models.InsertBot(db, models.BotBaseProfile{BotID: 1, Name: "Old bot", Lat: 52.52, Lon: 13.4, Radius: 1000, BotType: "travelbot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := GetRoutine(db, 1); !ok {
+		t.Fatal("bot 1 has no routine")
+	}
+	if n := routines(); n != 0 {
+		t.Errorf("%d routines saved after getting one, want 0", n)
+	}
+
+	_, err = CreateBot(db, NewBot{Name: "New bot", Lat: 52.5, Lon: 13.3, Radius: 1000, Type: "travelbot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := routines(); n != 1 {
+		t.Errorf("%d routines saved after making a bot, want 1", n)
+	}
+
+	saveMissingRoutines(db)
+	b, _ := getBot(db, 1)
+	if r := getRoutine(db, bot{ID: 1}); r.Home.Lat != b.Lat || r.Home.Lon != b.Lon {
+		t.Errorf("bot 1's home is %v, want where it was, %f, %f", r.Home, b.Lat, b.Lon)
+	}
+}
@@ -0,0 +1,147 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/alexalexyang/botschaft/config"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// When a bot finds nothing, its search ring grows by radiusGrowth times each step, up to cfg.MaxSearchRadius metres.
+const radiusGrowth = 2
+
+// The radius in metres a bot starts searching in this tick, from its own radius and its curiosity.
+func (b bot) startRadius(cfg config.Config) float64 {
+	radius := b.Radius
+	if radius <= 0 {
+		radius = cfg.DefaultRadius
+	}
+	return math.Min(b.Personality.travelRadius(radius), cfg.MaxSearchRadius)
+}
+
+// Finds POIs near every bot. Bots that find nothing search again in a wider ring until they find something
+// or reach cfg.MaxSearchRadius, in which case they are stuck. POIs come from Overpass, or from the POIs loaded with
+// ImportOSM if cfg.POISource is "local". Nothing is saved here; see saveCandidates.
+// Returns an error if Overpass can't be asked or its answer can't be read.
+func searchPOIs(logger *slog.Logger, db *sql.DB, cfg config.Config, bots []bot) ([]bot, error) {
+	client := overpassClient(cfg)
+	pending := []int{}
+	for i := range bots {
+		bots[i].SearchRadius = bots[i].startRadius(cfg)
+		bots[i].Stuck = false
+		// Bots going home don't need anywhere new to go.
+		if !bots[i].Slot.goesHome() {
+			pending = append(pending, i)
+		}
+	}
+
+	for len(pending) > 0 {
+		searching := []bot{}
+		for _, i := range pending {
+			searching = append(searching, bots[i])
+		}
+
+		var pois []poi
+		if cfg.POISource == "local" {
+			pois = getLocalPOIs(db, searching)
+		} else {
+			var err error
+			pois, err = getPOIs(client, createOSMQuery(cfg.OverpassURL, searching))
+			if err != nil {
+				return bots, err
+			}
+		}
+		searching = getNearestPOIs(searching, pois)
+
+		next := []int{}
+		for k, i := range pending {
+			bots[i] = searching[k]
+			if len(bots[i].Pois) > 0 {
+				continue
+			}
+			if bots[i].SearchRadius >= cfg.MaxSearchRadius {
+				logger.Warn("bot is stuck", "bot_id", bots[i].ID, "radius", bots[i].SearchRadius)
+				bots[i].Stuck = true
+				continue
+			}
+			bots[i].SearchRadius = math.Min(bots[i].SearchRadius*radiusGrowth, cfg.MaxSearchRadius)
+			logger.Debug("widening search", "bot_id", bots[i].ID, "radius", bots[i].SearchRadius)
+			next = append(next, i)
+		}
+		pending = next
+	}
+
+	return bots, nil
+}
+
+func createSearchTable(db dbtx) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS botsearch (
+		botid INTEGER PRIMARY KEY,
+		searchradius REAL,
+		stuck INTEGER,
+		stuckticks INTEGER,
+		stucksince TEXT
+	);`)
+	check(err)
+}
+
+// Saves how far a bot had to search this tick, and whether it is stuck. Counts how many ticks in a row it has been stuck.
+func recordSearch(db dbtx, b *bot) {
+	previous := getSearch(db, b.ID)
+
+	b.StuckTicks = 0
+	b.StuckSince = ""
+	if b.Stuck {
+		b.StuckTicks = previous.StuckTicks + 1
+		b.StuckSince = previous.StuckSince
+		if b.StuckSince == "" {
+			b.StuckSince = now().UTC().Format(time.RFC3339)
+		}
+	}
+
+	observeStuck(*b)
+
+	statement := `INSERT OR REPLACE INTO botsearch (botid, searchradius, stuck, stuckticks, stucksince) values ($1, $2, $3, $4, $5);`
+	_, err := db.Exec(statement, b.ID, b.SearchRadius, b.Stuck, b.StuckTicks, b.StuckSince)
+	check(err)
+}
+
+// Gets what a bot's last search found, or an empty search if it hasn't searched yet.
+func getSearch(db dbtx, botID int) bot {
+	b := bot{ID: botID}
+	err := db.QueryRow(`SELECT searchradius, stuck, stuckticks, stucksince FROM botsearch WHERE botid=$1;`, botID).
+		Scan(&b.SearchRadius, &b.Stuck, &b.StuckTicks, &b.StuckSince)
+	if err == sql.ErrNoRows {
+		return bot{ID: botID}
+	}
+	check(err)
+	return b
+}
+
+type stuckBot struct {
+	ID           int     `json:"id"`
+	Name         string  `json:"name"`
+	Lat          float64 `json:"lat"`
+	Lon          float64 `json:"lon"`
+	SearchRadius float64 `json:"searchradius"`
+	StuckTicks   int     `json:"stuckticks"`
+	StuckSince   string  `json:"stucksince"`
+}
+
+// GetStuckBots returns the bots that found no POIs even at the largest search radius, as JSON.
+func GetStuckBots(db *sql.DB) []byte {
+	stuck := []stuckBot{}
+	for _, b := range GetTravelBots(db) {
+		if b.Stuck {
+			stuck = append(stuck, stuckBot{b.ID, b.Name, b.Lat, b.Lon, b.SearchRadius, b.StuckTicks, b.StuckSince})
+		}
+	}
+
+	stuckJSON, err := json.Marshal(stuck)
+	check(err)
+	return stuckJSON
+}
@@ -0,0 +1,77 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"math/rand"
+	"strconv"
+
+	"github.com/alexalexyang/botschaft/models"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// DemoSeed is how many demo users and bots SeedDemo makes, and where. Bots are put at random within
+// Spread metres of Lat, Lon.
+type DemoSeed struct {
+	Users       int
+	BotsPerUser int
+	Type        string
+	Lat         float64
+	Lon         float64
+	Spread      float64
+	Radius      float64
+	// Seed: seeds where bots are put, so the same seed makes the same demo.
+	Seed int64
+}
+
+// Seeded is what SeedDemo made.
+type Seeded struct {
+	UserIDs []int
+	BotIDs  []int
+}
+
+// A random point within metres of lat, lon, spread evenly over the circle.
+func randomPointNear(rng *rand.Rand, lat float64, lon float64, metres float64) (float64, float64) {
+	distance := metres * math.Sqrt(rng.Float64())
+	bearing := rng.Float64() * 2 * math.Pi
+	dLat := distance * math.Cos(bearing) / 111000
+	dLon := distance * math.Sin(bearing) / 111000 / math.Max(math.Cos(lat*math.Pi/180), 0.01)
+	return lat + dLat, lon + dLon
+}
+
+// SeedDemo makes demo users, each with some bots, so there's something on the map to try things with.
+func SeedDemo(db *sql.DB, s DemoSeed) (Seeded, error) {
+	seeded := Seeded{UserIDs: []int{}, BotIDs: []int{}}
+	if s.Users < 1 || s.BotsPerUser < 0 {
+		return seeded, errors.New("make at least 1 user, and 0 or more bots each")
+	}
+	if s.Spread < 0 {
+		return seeded, errors.New("spread can't be less than 0")
+	}
+
+	rng := rand.New(rand.NewSource(s.Seed))
+	for u := 1; u <= s.Users; u++ {
+		var userID int
+		err := inTx(db, func(tx *sql.Tx) error {
+			var err error
+			userID, err = models.CreateUser(tx, models.User{Name: "Demo user " + strconv.Itoa(u)})
+			return err
+		})
+		if err != nil {
+			return seeded, err
+		}
+		seeded.UserIDs = append(seeded.UserIDs, userID)
+
+		for i := 0; i < s.BotsPerUser; i++ {
+			lat, lon := randomPointNear(rng, s.Lat, s.Lon, s.Spread)
+			name := "Demo bot " + strconv.Itoa(len(seeded.BotIDs)+1)
+			botID, err := CreateBot(db, NewBot{UserID: userID, Name: name, Lat: lat, Lon: lon, Radius: s.Radius, Type: s.Type})
+			if err != nil {
+				return seeded, err
+			}
+			seeded.BotIDs = append(seeded.BotIDs, botID)
+		}
+	}
+	return seeded, nil
+}
@@ -0,0 +1,321 @@
+package botbehaviour
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/alexalexyang/botschaft/config"
+	"github.com/alexalexyang/botschaft/models"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Scenario is a simulation for Simulate to run: bots, the POIs they can go to, and how long to run for.
+type Scenario struct {
+	Name string `json:"name"`
+	// POIs: an Overpass JSON file of the POIs bots can go to, like import-osm loads. Bots only ever look here.
+	POIs string `json:"pois"`
+	// Bots: groups of bots to make, each like a bots import.
+	Bots     []ScenarioBots   `json:"bots"`
+	Policies ScenarioPolicies `json:"policies"`
+	// Seed: seeds where bots are put, their types and personalities, and every choice they make.
+	Seed  int64 `json:"seed"`
+	Ticks int   `json:"ticks"`
+	// Start: the simulated time of the first tick. Step: how much simulated time passes between ticks.
+	Start time.Time       `json:"start"`
+	Step  config.Duration `json:"step"`
+}
+
+// ScenarioBots is a group of bots in a scenario: a template like BulkSeed takes, and the points or polygons
+// to put them at, either inline as GeoJSON or a CSV string, or in File.
+type ScenarioBots struct {
+	Template json.RawMessage `json:"template"`
+	Features json.RawMessage `json:"features"`
+	File     string          `json:"file"`
+}
+
+// ScenarioPolicies are the settings a scenario runs with, instead of the config's.
+type ScenarioPolicies struct {
+	DefaultRadius   float64 `json:"defaultradius"`
+	MaxSearchRadius float64 `json:"maxsearchradius"`
+	// Geofences: GeoJSON polygons for every bot, with "allowed" or "forbidden" kind properties.
+	Geofences json.RawMessage `json:"geofences"`
+}
+
+// LoadScenario reads a scenario file. Files it names are relative to it.
+func LoadScenario(path string) (Scenario, error) {
+	s := Scenario{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&s)
+	if err != nil {
+		return s, errors.New(path + ": " + err.Error())
+	}
+
+	dir := filepath.Dir(path)
+	if s.POIs != "" && !filepath.IsAbs(s.POIs) {
+		s.POIs = filepath.Join(dir, s.POIs)
+	}
+	for i := range s.Bots {
+		if s.Bots[i].File != "" && !filepath.IsAbs(s.Bots[i].File) {
+			s.Bots[i].File = filepath.Join(dir, s.Bots[i].File)
+		}
+	}
+	return s, s.validate()
+}
+
+func (s Scenario) validate() error {
+	if s.POIs == "" {
+		return errors.New("scenarios need a pois file, since simulations don't ask Overpass")
+	}
+	if len(s.Bots) == 0 {
+		return errors.New("scenarios need at least one group of bots")
+	}
+	for i, group := range s.Bots {
+		if (len(group.Features) == 0) == (group.File == "") {
+			return errors.New("bots group " + strconv.Itoa(i+1) + " needs either features or a file")
+		}
+	}
+	if s.Ticks < 1 {
+		return errors.New("ticks must be at least 1")
+	}
+	if s.Start.IsZero() {
+		return errors.New(`scenarios need a start time, like "2024-06-01T08:00:00Z"`)
+	}
+	if s.Step.Duration <= 0 {
+		return errors.New(`step must be more than 0, like "15m"`)
+	}
+	if s.Policies.DefaultRadius < 0 || s.Policies.MaxSearchRadius < 0 {
+		return errors.New("radii can't be less than 0")
+	}
+	return nil
+}
+
+// The points or polygons a group of bots is put at.
+func (group ScenarioBots) data() ([]byte, error) {
+	if group.File != "" {
+		return ioutil.ReadFile(group.File)
+	}
+	csvData := ""
+	if json.Unmarshal(group.Features, &csvData) == nil {
+		return []byte(csvData), nil
+	}
+	return group.Features, nil
+}
+
+// SimBot is what one bot did in a simulation.
+type SimBot struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Visits: how many times it went to a POI. UniquePOIs: how many different POIs it went to.
+	Visits     int `json:"visits"`
+	UniquePOIs int `json:"uniquepois"`
+	// Encounters: how many times it arrived somewhere another bot was.
+	Encounters int     `json:"encounters"`
+	DistanceKm float64 `json:"distancekm"`
+	// StuckTicks: how many ticks it found nothing even at the largest search radius. Stuck: it was stuck at the end.
+	StuckTicks int     `json:"stuckticks"`
+	Stuck      bool    `json:"stuck"`
+	Lat        float64 `json:"lat"`
+	Lon        float64 `json:"lon"`
+}
+
+// SimReport is what happened in a simulation, for comparing runs.
+type SimReport struct {
+	Scenario string    `json:"scenario"`
+	Seed     int64     `json:"seed"`
+	Ticks    int       `json:"ticks"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	// POIs: how many POIs bots could go to. Coverage: the share of them at least one bot went to.
+	POIs        int     `json:"pois"`
+	VisitedPOIs int     `json:"visitedpois"`
+	Coverage    float64 `json:"coverage"`
+	Visits      int     `json:"visits"`
+	Encounters  int     `json:"encounters"`
+	DistanceKm  float64 `json:"distancekm"`
+	// StuckBots: the IDs of the bots that were stuck at the end.
+	StuckBots []int    `json:"stuckbots"`
+	Bots      []SimBot `json:"bots"`
+}
+
+// Simulate runs a scenario in db, which must be empty: it loads the POIs, makes the bots, and runs its ticks
+// one after another on a simulated clock, with POIs only from the scenario, so nothing is asked of Overpass.
+// Bots are worked on one at a time, so the same scenario and seed always end the same way. The clock is
+// the package's, so nothing else should tick while a simulation runs.
+func Simulate(logger *slog.Logger, db *sql.DB, cfg config.Config, s Scenario) (SimReport, error) {
+	cfg.POISource = "local"
+	return simulate(logger, db, cfg, s)
+}
+
+// Simulate with bots finding POIs wherever cfg says. The scenario's POIs are loaded either way, for coverage.
+func simulate(logger *slog.Logger, db *sql.DB, cfg config.Config, s Scenario) (SimReport, error) {
+	report := SimReport{Scenario: s.Name, Seed: s.Seed, Start: s.Start, StuckBots: []int{}, Bots: []SimBot{}}
+	err := s.validate()
+	if err != nil {
+		return report, err
+	}
+	err = models.CreateTables(db)
+	if err != nil {
+		return report, err
+	}
+	Migrate(db)
+	if len(ListBots(db)) > 0 {
+		return report, errors.New("simulations need an empty database")
+	}
+
+	cfg.Workers = 1
+	cfg.OverpassConcurrency = 1
+	if s.Policies.DefaultRadius > 0 {
+		cfg.DefaultRadius = s.Policies.DefaultRadius
+	}
+	if s.Policies.MaxSearchRadius > 0 {
+		cfg.MaxSearchRadius = s.Policies.MaxSearchRadius
+	}
+
+	clock := s.Start
+	defer func(realNow func() time.Time, realRand func(int) *rand.Rand) {
+		now, botRand = realNow, realRand
+	}(now, botRand)
+	now = func() time.Time { return clock }
+	botRand = func(botID int) *rand.Rand {
+		return rand.New(rand.NewSource(s.Seed<<32 + clock.UnixNano() + int64(botID)))
+	}
+
+	f, err := os.Open(s.POIs)
+	if err != nil {
+		return report, err
+	}
+	report.POIs, err = ImportOSM(db, f)
+	f.Close()
+	if err != nil {
+		return report, errors.New(s.POIs + ": " + err.Error())
+	}
+
+	if len(s.Policies.Geofences) > 0 {
+		_, err = ImportGeofences(db, 0, fenceAllowed, "", s.Policies.Geofences)
+		if err != nil {
+			return report, errors.New("geofences: " + err.Error())
+		}
+	}
+
+	for i, group := range s.Bots {
+		t, err := ParseSeedTemplate(group.Template)
+		if err != nil {
+			return report, err
+		}
+		if t.Radius == 0 {
+			t.Radius = cfg.DefaultRadius
+		}
+		data, err := group.data()
+		if err != nil {
+			return report, err
+		}
+		_, err = BulkSeed(db, t, data, s.Seed+int64(i))
+		if err != nil {
+			return report, errors.New("bots group " + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+	}
+
+	stuckTicks := map[int]int{}
+	stuck := map[int]bool{}
+	for tick := 1; tick <= s.Ticks; tick++ {
+		bots, _, err := runTick(logger.With("tick_id", tick), db, cfg)
+		if err != nil {
+			return report, errors.New("tick " + strconv.Itoa(tick) + ": " + err.Error())
+		}
+		for _, b := range bots {
+			stuck[b.ID] = b.Stuck
+			if b.Stuck {
+				stuckTicks[b.ID]++
+			}
+		}
+		report.Ticks = tick
+		report.End = clock
+		clock = clock.Add(s.Step.Duration)
+	}
+
+	for _, summary := range ListBots(db) {
+		report.Bots = append(report.Bots, simBot(db, summary, stuckTicks[summary.ID], stuck[summary.ID]))
+	}
+	report.total(db)
+	return report, nil
+}
+
+// Works out what a bot did from what was saved about it.
+func simBot(db *sql.DB, summary BotSummary, stuckTicks int, stuck bool) SimBot {
+	b := SimBot{
+		ID:         summary.ID,
+		Name:       summary.Name,
+		Type:       summary.Type,
+		StuckTicks: stuckTicks,
+		Stuck:      stuck,
+		Lat:        summary.Lat,
+		Lon:        summary.Lon,
+		DistanceKm: distanceTravelled(db, summary.ID),
+	}
+	err := db.QueryRow(`SELECT COUNT(*), COUNT(DISTINCT osmid) FROM botpois WHERE botid=$1 AND visitype="visited";`, b.ID).
+		Scan(&b.Visits, &b.UniquePOIs)
+	check(err)
+	err = db.QueryRow(`SELECT COUNT(*) FROM botmessages WHERE botid=$1;`, b.ID).Scan(&b.Encounters)
+	check(err)
+	return b
+}
+
+// Adds up the bots' figures, and works out how many of the scenario's POIs were visited.
+func (r *SimReport) total(db *sql.DB) {
+	for _, b := range r.Bots {
+		r.Visits += b.Visits
+		r.Encounters += b.Encounters
+		r.DistanceKm += b.DistanceKm
+		if b.Stuck {
+			r.StuckBots = append(r.StuckBots, b.ID)
+		}
+	}
+
+	err := db.QueryRow(`SELECT COUNT(DISTINCT p.osmid) FROM botpois p JOIN osmpois o ON o.osmid = p.osmid
+	WHERE p.visitype="visited";`).Scan(&r.VisitedPOIs)
+	check(err)
+	if r.POIs > 0 {
+		r.Coverage = math.Round(float64(r.VisitedPOIs)/float64(r.POIs)*1000) / 1000
+	}
+}
+
+// WriteCSV writes a row for each bot, with a header row.
+func (r SimReport) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"id", "name", "type", "visits", "uniquepois", "encounters", "distancekm", "stuckticks", "stuck", "lat", "lon"})
+	for _, b := range r.Bots {
+		writer.Write([]string{
+			strconv.Itoa(b.ID),
+			b.Name,
+			b.Type,
+			strconv.Itoa(b.Visits),
+			strconv.Itoa(b.UniquePOIs),
+			strconv.Itoa(b.Encounters),
+			strconv.FormatFloat(b.DistanceKm, 'f', 3, 64),
+			strconv.Itoa(b.StuckTicks),
+			strconv.FormatBool(b.Stuck),
+			strconv.FormatFloat(b.Lat, 'f', 6, 64),
+			strconv.FormatFloat(b.Lon, 'f', 6, 64),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,217 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math/rand"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Surveyors plan tours over the POIs with the most missing OSM tags and go round them one stop a tick,
+// so the data gap report fills up systematically. They only search when they need a new tour.
+func init() {
+	registerBotType(botType{
+		Name:         "surveyor",
+		Description:  `Plans tours over the POIs with the most missing OSM tags, within a budget in metres, and visits them one by one. Takes an optional state like {"budget": 5000}.`,
+		Searches:     true,
+		Planned:      hasTourLeft,
+		CreateTables: createTourTables,
+		SaveState:    saveSurveyBudget,
+		Choose:       chooseTourStop,
+		Arrive:       markStopVisited,
+	})
+}
+
+// The POIs a bot has been to, by OSM ID.
+func getVisited(db dbtx, botID int) (map[int]bool, error) {
+	rows, err := db.Query(`SELECT osmid FROM botpois WHERE visitype="visited" AND botid=$1 AND osmid IS NOT NULL;`, botID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	visited := map[int]bool{}
+	for rows.Next() {
+		var osmid int
+		err = rows.Scan(&osmid)
+		if err != nil {
+			return nil, err
+		}
+		visited[osmid] = true
+	}
+	return visited, rows.Err()
+}
+
+func saveSurveyBudget(tx *sql.Tx, b bot, state []byte) error {
+	t := tour{Budget: defaultSurveyBudget}
+	if len(state) > 0 {
+		err := json.Unmarshal(state, &t)
+		if err != nil {
+			return err
+		}
+	}
+	if t.Budget <= 0 {
+		return errors.New("budget must be more than 0")
+	}
+	return saveTour(tx, b.ID, tour{Budget: t.Budget})
+}
+
+// The POIs a surveyor can plan a tour over: the candidates it found this tick, the POIs loaded with ImportOSM,
+// and the POIs any bot has found, that are within the bot's radius, of the kind it's looking for, and not
+// behind a fence.
+func surveyPool(db dbtx, b bot, candidates []candidatePOI) ([]candidatePOI, error) {
+	wanted := routineSlot{Amenity: b.Slot.Amenity}
+	if wanted.Amenity == "" {
+		wanted.Amenity = defaultAmenity
+	}
+	seen := map[int]bool{0: true}
+	pool := []candidatePOI{}
+	add := func(osmid int, lat float64, lon float64, tags tagsStruct) {
+		if seen[osmid] || !wanted.wants(tags.Amenity) || haversine(b.Lon, b.Lat, lon, lat)*1000 > b.Radius {
+			return
+		}
+		seen[osmid] = true
+		if _, ok := permits(b.Fences, lat, lon); !ok {
+			return
+		}
+		c := candidatePOI{OSMID: osmid, Lat: lat, Lon: lon}
+		c.Completeness, c.Missing = tags.completeness()
+		pool = append(pool, c)
+	}
+
+	for _, c := range candidates {
+		seen[c.OSMID] = true
+		pool = append(pool, c)
+	}
+
+	south, west, north, east := boundingBox(b.Lat, b.Lon, b.Radius)
+	rows, err := db.Query(`SELECT osmid, lat, lon, tags FROM osmpois
+	WHERE lat BETWEEN $1 AND $2 AND lon BETWEEN $3 AND $4 ORDER BY osmid;`, south, north, west, east)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var osmid int
+		var lat, lon float64
+		var osmTags string
+		err = rows.Scan(&osmid, &lat, &lon, &osmTags)
+		if err == nil {
+			parsed := map[string]string{}
+			err = json.Unmarshal([]byte(osmTags), &parsed)
+			add(osmid, lat, lon, tagsFromOSM(parsed))
+		}
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The rows are read before findTags looks anything up, since a transaction has one connection.
+	type found struct {
+		osmid    int
+		lat, lon float64
+	}
+	pois := []found{}
+	rows, err = db.Query(`SELECT p.osmid, MIN(p.latitude), MIN(p.longitude)
+	FROM botpois_index i JOIN botpois p ON p.rowid = i.id
+	WHERE i.maxlat >= $1 AND i.minlat <= $2 AND i.maxlon >= $3 AND i.minlon <= $4 AND p.osmid IS NOT NULL
+	GROUP BY p.osmid ORDER BY p.osmid;`, south, north, west, east)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		f := found{}
+		err = rows.Scan(&f.osmid, &f.lat, &f.lon)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if !seen[f.osmid] {
+			pois = append(pois, f)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, f := range pois {
+		tags, ok, err := findTags(db, b.ID, f.osmid)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			add(f.osmid, f.lat, f.lon, tags)
+		}
+	}
+	return pool, nil
+}
+
+func hasTourLeft(db dbtx, b bot) bool {
+	t, err := getTour(db, b.ID)
+	check(err)
+	_, ok := t.next()
+	return ok
+}
+
+// Goes to the next stop on the tour. Stops a geofence has come to block since the tour was planned are skipped,
+// with a fence_blocked event each.
+// Once the tour is done, plans a new one from the candidates found this tick and the other POIs surveyPool
+// knows of within the bot's radius.
+// Stays where it is if there is nothing left to survey nearby.
+func chooseTourStop(tx *sql.Tx, rng *rand.Rand, b bot, candidates []candidatePOI, others []bot) (candidatePOI, bool, error) {
+	t, err := getTour(tx, b.ID)
+	if err != nil {
+		return candidatePOI{}, false, err
+	}
+
+	stop, ok := t.next()
+	for ok {
+		fence, blocked := routeBlocked(b.Fences, b.Lat, b.Lon, stop.Lat, stop.Lon)
+		if !blocked {
+			break
+		}
+		err = recordFenceBlock(tx, b.ID, fenceBlock{Stage: "tour", Fence: fence, OSMID: stop.OSMID, Lat: stop.Lat, Lon: stop.Lon})
+		if err != nil {
+			return candidatePOI{}, false, err
+		}
+		_, err = tx.Exec(`UPDATE bottour SET visited=1 WHERE botid=$1 AND seq=$2;`, b.ID, stop.Seq)
+		if err != nil {
+			return candidatePOI{}, false, err
+		}
+		t.Stops[stop.Seq].Visited = true
+		stop, ok = t.next()
+	}
+	if !ok {
+		visited, err := getVisited(tx, b.ID)
+		if err != nil {
+			return candidatePOI{}, false, err
+		}
+		pool, err := surveyPool(tx, b, candidates)
+		if err != nil {
+			return candidatePOI{}, false, err
+		}
+		t, err = planAndSaveTour(tx, b, t, pool, visited)
+		if err != nil {
+			return candidatePOI{}, false, err
+		}
+		stop, ok = t.next()
+		if !ok {
+			return candidatePOI{}, false, nil
+		}
+	}
+	return candidatePOI{OSMID: stop.OSMID, Lat: stop.Lat, Lon: stop.Lon, Missing: stop.Missing}, true, nil
+}
+
+func markStopVisited(tx *sql.Tx, rng *rand.Rand, b bot) error {
+	if b.Tick.DestOSMID == 0 {
+		return nil
+	}
+	_, err := tx.Exec(`UPDATE bottour SET visited=1 WHERE botid=$1 AND osmid=$2;`, b.ID, b.Tick.DestOSMID)
+	return err
+}
@@ -0,0 +1,183 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Values OSM documents for tags with a fixed set of values. Anything else is suspicious.
+var knownTagValues = map[string][]string{
+	"wheelchair":      {"yes", "no", "limited", "designated"},
+	"smoking":         {"yes", "no", "separated", "isolated", "outside", "dedicated", "designated"},
+	"internet_access": {"yes", "no", "wlan", "wifi", "wired", "terminal", "service"},
+}
+
+// A POI with missing or suspicious tags that someone could fix on OSM.
+type mappingTask struct {
+	OSMID      int
+	Lat        float64
+	Lon        float64
+	Name       string
+	Amenity    string
+	Missing    []string
+	Suspicious map[string]string
+}
+
+// Draft of an OSM note. Notes are left by hand, botschaft does not write to OSM.
+type osmNoteDraft struct {
+	Lat  float64 `json:"lat"`
+	Lon  float64 `json:"lon"`
+	Text string  `json:"text"`
+	URL  string  `json:"url"`
+}
+
+func osmElementURL(osmid int) string {
+	return "https://www.openstreetmap.org/node/" + strconv.Itoa(osmid)
+}
+
+func isKnownValue(tag string, value string) bool {
+	for _, known := range knownTagValues[tag] {
+		if value == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the tags whose values look wrong, with the reason why.
+func (tags tagsStruct) suspicious() map[string]string {
+	reasons := make(map[string]string)
+
+	if tags.Phone != "" {
+		digits := 0
+		for _, r := range tags.Phone {
+			switch {
+			case unicode.IsDigit(r):
+				digits++
+			case !strings.ContainsRune(" +-()./;", r):
+				reasons["phone"] = "contains characters that are not part of a phone number"
+			}
+		}
+		if digits < 6 {
+			reasons["phone"] = "has too few digits to be a phone number"
+		}
+	}
+
+	if tags.Opening_hours != "" && !strings.ContainsAny(tags.Opening_hours, "0123456789") && tags.Opening_hours != "off" && tags.Opening_hours != "closed" {
+		reasons["opening_hours"] = "has no times in it"
+	}
+
+	values := map[string]string{"wheelchair": tags.Wheelchair, "smoking": tags.Smoking, "internet_access": tags.Internet_access}
+	for tag, value := range values {
+		if value != "" && !isKnownValue(tag, value) {
+			reasons[tag] = `"` + value + `" is not a documented value`
+		}
+	}
+	return reasons
+}
+
+// Turns the POIs bots have found into one task per OSM element with missing or suspicious tags.
+func buildMappingTasks(pois []foundPOI) []mappingTask {
+	seen := make(map[int]bool)
+	tasks := []mappingTask{}
+
+	for _, p := range pois {
+		// Several bots can find the same POI.
+		if seen[p.OSMID] {
+			continue
+		}
+		seen[p.OSMID] = true
+
+		_, missing := p.Tags.completeness()
+		suspicious := p.Tags.suspicious()
+		if len(missing) == 0 && len(suspicious) == 0 {
+			continue
+		}
+		tasks = append(tasks, mappingTask{p.OSMID, p.Lat, p.Lon, p.Tags.Name, p.Tags.Amenity, missing, suspicious})
+	}
+
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].OSMID < tasks[j].OSMID })
+	return tasks
+}
+
+// Describes what is wrong with a task's POI in a sentence or two, for people fixing it.
+func (task mappingTask) describe() string {
+	name := task.Name
+	if name == "" {
+		name = "This " + task.Amenity
+	}
+
+	var parts []string
+	if len(task.Missing) > 0 {
+		parts = append(parts, name+" is missing "+strings.Join(task.Missing, ", ")+".")
+	}
+
+	var tags []string
+	for tag := range task.Suspicious {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		parts = append(parts, "The "+tag+" tag "+task.Suspicious[tag]+".")
+	}
+	return strings.Join(parts, " ")
+}
+
+// Formats tasks as a MapRoulette challenge: a GeoJSON FeatureCollection with one point per OSM element.
+func tasksToMapRoulette(tasks []mappingTask) geoJSONFeatureCollection {
+	features := []geoJSONFeature{}
+	for _, task := range tasks {
+		suspicious := []string{}
+		for tag := range task.Suspicious {
+			suspicious = append(suspicious, tag)
+		}
+		sort.Strings(suspicious)
+
+		element := "node/" + strconv.Itoa(task.OSMID)
+		features = append(features, newPointFeature(element, task.Lat, task.Lon, map[string]interface{}{
+			"@id":         element,
+			"name":        task.Name,
+			"amenity":     task.Amenity,
+			"missing":     strings.Join(task.Missing, ";"),
+			"suspicious":  strings.Join(suspicious, ";"),
+			"instruction": task.describe(),
+			"osm_url":     osmElementURL(task.OSMID),
+		}))
+	}
+	return newFeatureCollection(features)
+}
+
+// Formats tasks as OSM notes that can be left at each POI.
+func tasksToNoteDrafts(tasks []mappingTask) []osmNoteDraft {
+	notes := []osmNoteDraft{}
+	for _, task := range tasks {
+		url := osmElementURL(task.OSMID)
+		text := task.describe() + " " + url + " (found by a botschaft bot)"
+		notes = append(notes, osmNoteDraft{task.Lat, task.Lon, text, url})
+	}
+	return notes
+}
+
+func getMappingTasks(db *sql.DB) []mappingTask {
+	return buildMappingTasks(getFoundPOIs(db))
+}
+
+// GetMapRouletteChallenge returns POIs with missing or suspicious tags as a MapRoulette-compatible GeoJSON challenge.
+func GetMapRouletteChallenge(db *sql.DB) []byte {
+	challengeJSON, err := json.Marshal(tasksToMapRoulette(getMappingTasks(db)))
+	check(err)
+	return challengeJSON
+}
+
+// GetOSMNoteDrafts returns POIs with missing or suspicious tags as a list of OSM note drafts.
+func GetOSMNoteDrafts(db *sql.DB) []byte {
+	notesJSON, err := json.Marshal(tasksToNoteDrafts(getMappingTasks(db)))
+	check(err)
+	return notesJSON
+}
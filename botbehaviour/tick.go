@@ -0,0 +1,408 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"strconv"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The steps of a bot's tick. Each step's writes and the move to the next state are committed in one
+// transaction, so a failed step changes nothing, and a bot interrupted by a restart carries on from the
+// last step that was committed instead of searching again.
+const (
+	// stateIdle: the bot hasn't started a tick yet.
+	stateIdle = "idle"
+	// stateCandidates: the POIs the bot might go to are saved as "maybe" in botpois.
+	stateCandidates = "candidates"
+	// stateChosen: the bot has picked where to go, or to stay where it is.
+	stateChosen = "chosen"
+	// stateMoved: the bot is at its destination. The next tick starts again from the search.
+	stateMoved = "moved"
+)
+
+// Where a bot is in its tick, saved in bottick.
+type tickState struct {
+	State string
+	// DestOSMID, DestLat, DestLon: where the bot chose to go. DestOSMID is 0 if it isn't going to a POI.
+	DestOSMID int
+	DestLat   float64
+	DestLon   float64
+	Updated   string
+}
+
+// Either a *sql.DB or a *sql.Tx, so the same functions can be used in and out of a transaction.
+type dbtx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Runs f in a transaction. Commits if f succeeds, rolls back if it returns an error or panics.
+func inTx(db *sql.DB, f func(tx *sql.Tx) error) (err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	err = f(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// errBotGone is returned by inBotTx for a bot that has been deleted.
+var errBotGone = errors.New("bot has been deleted")
+
+// Runs f in a transaction with inTx if the bot still exists, and returns errBotGone if it doesn't. Ticks work
+// on bots read when the tick started, so a bot deleted since isn't saved again.
+func inBotTx(db *sql.DB, botID int, f func(tx *sql.Tx) error) error {
+	return inTx(db, func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM bots WHERE BotID=$1);`, botID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errBotGone
+		}
+		return f(tx)
+	})
+}
+
+func createTickTable(db dbtx) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS bottick (
+		botid INTEGER PRIMARY KEY,
+		state TEXT,
+		destosmid INTEGER,
+		destlat REAL,
+		destlon REAL,
+		updated TEXT
+	);`)
+	check(err)
+}
+
+// Gets where a bot is in its tick. A bot that has never ticked is idle.
+func getTickState(db dbtx, botID int) tickState {
+	s := tickState{}
+	err := db.QueryRow(`SELECT state, destosmid, destlat, destlon, updated FROM bottick WHERE botid=$1;`, botID).
+		Scan(&s.State, &s.DestOSMID, &s.DestLat, &s.DestLon, &s.Updated)
+	if err == sql.ErrNoRows {
+		return tickState{State: stateIdle}
+	}
+	check(err)
+	return s
+}
+
+func setTickState(db dbtx, botID int, s tickState) error {
+	s.Updated = now().UTC().Format(time.RFC3339)
+	statement := `INSERT OR REPLACE INTO bottick (botid, state, destosmid, destlat, destlon, updated) values ($1, $2, $3, $4, $5, $6);`
+	_, err := db.Exec(statement, botID, s.State, s.DestOSMID, s.DestLat, s.DestLon, s.Updated)
+	return err
+}
+
+// Whether the bot is part way through a tick and should carry on rather than search again.
+func (s tickState) resuming() bool {
+	return s.State == stateCandidates || s.State == stateChosen
+}
+
+// Step 1: replaces the bot's "maybe" POIs and their tags with what it found this tick, and saves its search
+// and a fence_blocked event for each POI it found behind a fence.
+func saveCandidates(db *sql.DB, b *bot) error {
+	defer observeQuery("saveCandidates", time.Now())
+
+	// Where the old and new candidates are, so their tiles can be dropped.
+	changed := [][2]float64{}
+	for _, poi := range b.Pois {
+		changed = append(changed, [2]float64{poi.Lat, poi.Lon})
+	}
+
+	err := inBotTx(db, b.ID, func(tx *sql.Tx) error {
+		var south, west, north, east sql.NullFloat64
+		err := tx.QueryRow(`SELECT MIN(latitude), MIN(longitude), MAX(latitude), MAX(longitude) FROM botpois
+		WHERE visitype="maybe" AND botid=$1;`, b.ID).Scan(&south, &west, &north, &east)
+		if err != nil {
+			return err
+		}
+		if south.Valid && west.Valid {
+			changed = append(changed, [2]float64{south.Float64, west.Float64}, [2]float64{north.Float64, east.Float64})
+		}
+
+		_, err = tx.Exec(`DELETE FROM botpois WHERE visitype="maybe" AND botid=$1;`, b.ID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM taginfo WHERE botid=$1;`, b.ID)
+		if err != nil {
+			return err
+		}
+
+		for _, poi := range b.Pois {
+			id := strconv.Itoa(poi.ID)
+			lat := strconv.FormatFloat(poi.Lat, 'f', 6, 64)
+			lon := strconv.FormatFloat(poi.Lon, 'f', 6, 64)
+
+			statement := `INSERT INTO botpois (botid, osmid, latitude, longitude, visitype) values ($1, $2, $3, $4, $5);`
+			_, err = tx.Exec(statement, b.ID, id, lat, lon, `maybe`)
+			if err != nil {
+				return err
+			}
+
+			tags := poi.Tags
+			statement = `INSERT INTO taginfo (
+					botid,
+					osmid,
+					amenity,
+					name,
+					name_en,
+					addr_housenumber,
+					addr_street,
+					opening_hours,
+					phone,
+					cuisine,
+					description,
+					internet_access,
+					smoking,
+					wheelchair
+					) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14);`
+			_, err = tx.Exec(statement,
+				b.ID,
+				id,
+				tags["amenity"],
+				tags["name"],
+				tags["name:en"],
+				tags["addr:housenumber"],
+				tags["addr:street"],
+				tags["opening_hours"],
+				tags["phone"],
+				tags["cuisine"],
+				tags["description"],
+				tags["internet_access"],
+				tags["smoking"],
+				tags["wheelchair"])
+			if err != nil {
+				return err
+			}
+		}
+
+		recordSearch(tx, b)
+		for _, block := range b.Blocked {
+			err = recordFenceBlock(tx, b.ID, block)
+			if err != nil {
+				return err
+			}
+		}
+
+		b.Tick = tickState{State: stateCandidates}
+		return setTickState(tx, b.ID, b.Tick)
+	})
+	if err == nil {
+		invalidateTiles(changed...)
+	}
+	return err
+}
+
+// Step 1 for a bot that didn't search this tick: its candidates and their tags from its last search are kept
+// as they are, since a planned stop it goes to may be one of them and rememberVisit needs its tags.
+func keepCandidates(db *sql.DB, b *bot) error {
+	return inBotTx(db, b.ID, func(tx *sql.Tx) error {
+		b.Tick = tickState{State: stateCandidates}
+		return setTickState(tx, b.ID, b.Tick)
+	})
+}
+
+// Gets a bot's "maybe" POIs, with the tags its personality cares about and how complete their tags are.
+func getCandidates(db dbtx, botID int) ([]candidatePOI, error) {
+	rows, err := db.Query(`SELECT
+	p.osmid,
+	p.latitude,
+	p.longitude,
+	COALESCE(t.amenity, ''),
+	COALESCE(t.name, ''),
+	COALESCE(t.name_en, ''),
+	COALESCE(t.addr_housenumber, ''),
+	COALESCE(t.addr_street, ''),
+	COALESCE(t.opening_hours, ''),
+	COALESCE(t.phone, ''),
+	COALESCE(t.cuisine, ''),
+	COALESCE(t.smoking, ''),
+	COALESCE(t.wheelchair, ''),
+	COALESCE(t.internet_access, '')
+	FROM botpois p LEFT JOIN taginfo t ON t.osmid = p.osmid AND t.botid = p.botid
+	WHERE p.visitype="maybe" AND p.botid=$1;`, botID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candidates := []candidatePOI{}
+	for rows.Next() {
+		var osmid sql.NullInt64
+		tags := tagsStruct{}
+		c := candidatePOI{}
+		err = rows.Scan(&osmid, &c.Lat, &c.Lon,
+			&tags.Amenity,
+			&tags.Name,
+			&tags.Name_en,
+			&tags.Addr_housenumber,
+			&tags.Addr_street,
+			&tags.Opening_hours,
+			&tags.Phone,
+			&tags.Cuisine,
+			&tags.Smoking,
+			&tags.Wheelchair,
+			&tags.Internet_access)
+		if err != nil {
+			return nil, err
+		}
+		c.OSMID = int(osmid.Int64)
+		c.Tags = map[string]string{
+			"amenity":         tags.Amenity,
+			"name":            tags.Name,
+			"cuisine":         tags.Cuisine,
+			"smoking":         tags.Smoking,
+			"wheelchair":      tags.Wheelchair,
+			"internet_access": tags.Internet_access,
+		}
+		c.Completeness, c.Missing = tags.completeness()
+		candidates = append(candidates, c)
+	}
+	return candidates, rows.Err()
+}
+
+// Step 2: picks where the bot goes from its saved candidates. Home if the routine says so, otherwise a
+// place picked by its type, unless it's resting or there's nowhere to go, in which case it stays.
+// Candidates it can't reach without crossing a geofence are left out, with a fence_blocked event each, and if
+// the destination still can't be reached, the bot stays and a fence_blocked event is saved.
+func chooseNext(logger *slog.Logger, db *sql.DB, t botType, rng *rand.Rand, b *bot, others []bot) error {
+	defer observeQuery("chooseNext", time.Now())
+
+	return inBotTx(db, b.ID, func(tx *sql.Tx) error {
+		candidates, err := getCandidates(tx, b.ID)
+		if err != nil {
+			return err
+		}
+		candidates, blocked := reachable(*b, candidates)
+		for _, block := range blocked {
+			err = recordFenceBlock(tx, b.ID, block)
+			if err != nil {
+				return err
+			}
+		}
+
+		next := tickState{State: stateChosen, DestLat: b.Lat, DestLon: b.Lon}
+		if b.Slot.goesHome() {
+			logger.Debug("going home", "slot", b.Slot.Name)
+			next.DestLat = b.Routine.Home.Lat
+			next.DestLon = b.Routine.Home.Lon
+		} else if !b.Personality.wantsRest(rng) {
+			destination, ok, err := t.Choose(tx, rng, *b, candidates, others)
+			if err != nil {
+				return err
+			}
+			if ok {
+				logger.Debug("moving", "slot", b.Slot.Name, "osmid", destination.OSMID, "candidates", len(candidates))
+				next.DestOSMID = destination.OSMID
+				next.DestLat = destination.Lat
+				next.DestLon = destination.Lon
+			}
+		} else {
+			logger.Debug("resting", "slot", b.Slot.Name)
+		}
+
+		if fence, blocked := routeBlocked(b.Fences, b.Lat, b.Lon, next.DestLat, next.DestLon); blocked {
+			logger.Info("geofence blocked move", "fence_id", fence.ID, "fence", fence.Name, "kind", fence.Kind)
+			err = recordFenceBlock(tx, b.ID, fenceBlock{Stage: "move", Fence: fence, OSMID: next.DestOSMID, Lat: next.DestLat, Lon: next.DestLon})
+			if err != nil {
+				return err
+			}
+			next = tickState{State: stateChosen, DestLat: b.Lat, DestLon: b.Lon}
+		}
+
+		err = setTickState(tx, b.ID, next)
+		if err != nil {
+			return err
+		}
+		b.Tick = next
+		return nil
+	})
+}
+
+// Step 3: moves the bot to its chosen destination, and saves the POI as "visited" in botpois if it went to one,
+// and the move for its trail. Then the bot meets any bots already there, and its type does what it does on arriving.
+func moveBot(db *sql.DB, t botType, rng *rand.Rand, b *bot) error {
+	defer observeQuery("moveBot", time.Now())
+
+	from := [2]float64{b.Lat, b.Lon}
+	err := inBotTx(db, b.ID, func(tx *sql.Tx) error {
+		err := recordMove(tx, *b, b.Tick.DestLat, b.Tick.DestLon, b.Tick.DestOSMID)
+		if err != nil {
+			return err
+		}
+
+		place := ""
+		if b.Tick.DestOSMID != 0 {
+			place, err = rememberVisit(tx, b.ID, b.Tick.DestOSMID, b.Tick.DestLat, b.Tick.DestLon)
+			if err != nil {
+				return err
+			}
+
+			lat := strconv.FormatFloat(b.Tick.DestLat, 'f', 6, 64)
+			lon := strconv.FormatFloat(b.Tick.DestLon, 'f', 6, 64)
+			statement := `INSERT INTO botpois (botid, osmid, latitude, longitude, visitype) values ($1, $2, $3, $4, $5);`
+			_, err = tx.Exec(statement, b.ID, strconv.Itoa(b.Tick.DestOSMID), lat, lon, `visited`)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(`UPDATE bots SET Lat=?,Lon=? WHERE BotID=?;`, b.Tick.DestLat, b.Tick.DestLon, b.ID)
+		if err != nil {
+			return err
+		}
+
+		// Bots that stayed where they were have already met whoever is there.
+		if b.Tick.DestLat != b.Lat || b.Tick.DestLon != b.Lon {
+			arrived := *b
+			arrived.Lat, arrived.Lon = b.Tick.DestLat, b.Tick.DestLon
+			err = meetBots(tx, arrived, place)
+			if err != nil {
+				return err
+			}
+		}
+
+		if t.Arrive != nil {
+			err = t.Arrive(tx, rng, *b)
+			if err != nil {
+				return err
+			}
+		}
+
+		moved := b.Tick
+		moved.State = stateMoved
+		err = setTickState(tx, b.ID, moved)
+		if err != nil {
+			return err
+		}
+		b.Lat = b.Tick.DestLat
+		b.Lon = b.Tick.DestLon
+		b.Tick = moved
+		return nil
+	})
+	if err == nil {
+		invalidateTiles(from, [2]float64{b.Lat, b.Lon})
+	}
+	return err
+}
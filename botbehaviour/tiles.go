@@ -0,0 +1,251 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"math"
+	"sync"
+
+	"github.com/alexalexyang/botschaft/mvt"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The most tiles kept in the cache. It's emptied when it gets this big.
+const maxCachedTiles = 4096
+
+// Encoded vector tiles. Tiles are dropped where bots change, see invalidateTiles.
+var tileCache = struct {
+	sync.Mutex
+	tiles map[mvt.Tile][]byte
+	// generation goes up whenever tiles are dropped, so a tile made from data that changed
+	// while it was being made isn't cached.
+	generation int
+}{tiles: map[mvt.Tile][]byte{}}
+
+// Makes R*Tree indexes over botpois and botmoves, kept up to date by triggers, and an index on bot locations.
+// Rows saved before the indexes existed are added to them once.
+func ensureSpatialIndex(db *sql.DB) {
+	var triggers int
+	err := db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type='trigger' AND name='botmoves_index_delete';`).Scan(&triggers)
+	check(err)
+	if triggers > 0 {
+		return
+	}
+
+	err = inTx(db, func(tx *sql.Tx) error {
+		var indexes int
+		err := tx.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name IN ('botpois_index', 'botmoves_index');`).Scan(&indexes)
+		if err != nil {
+			return err
+		}
+
+		statements := []string{
+			`CREATE VIRTUAL TABLE IF NOT EXISTS botpois_index USING rtree(id, minlat, maxlat, minlon, maxlon);`,
+			`CREATE TRIGGER IF NOT EXISTS botpois_index_insert AFTER INSERT ON botpois
+			WHEN NEW.latitude IS NOT NULL AND NEW.longitude IS NOT NULL BEGIN
+				INSERT INTO botpois_index VALUES (NEW.rowid, NEW.latitude, NEW.latitude, NEW.longitude, NEW.longitude);
+			END;`,
+			`CREATE TRIGGER IF NOT EXISTS botpois_index_update AFTER UPDATE OF latitude, longitude ON botpois BEGIN
+				DELETE FROM botpois_index WHERE id = OLD.rowid;
+				INSERT INTO botpois_index SELECT NEW.rowid, NEW.latitude, NEW.latitude, NEW.longitude, NEW.longitude
+				WHERE NEW.latitude IS NOT NULL AND NEW.longitude IS NOT NULL;
+			END;`,
+			`CREATE TRIGGER IF NOT EXISTS botpois_index_delete AFTER DELETE ON botpois BEGIN
+				DELETE FROM botpois_index WHERE id = OLD.rowid;
+			END;`,
+			`CREATE VIRTUAL TABLE IF NOT EXISTS botmoves_index USING rtree(id, minlat, maxlat, minlon, maxlon);`,
+			`CREATE TRIGGER IF NOT EXISTS botmoves_index_insert AFTER INSERT ON botmoves BEGIN
+				INSERT INTO botmoves_index VALUES (NEW.id, MIN(NEW.fromlat, NEW.tolat), MAX(NEW.fromlat, NEW.tolat),
+				MIN(NEW.fromlon, NEW.tolon), MAX(NEW.fromlon, NEW.tolon));
+			END;`,
+			`CREATE TRIGGER IF NOT EXISTS botmoves_index_delete AFTER DELETE ON botmoves BEGIN
+				DELETE FROM botmoves_index WHERE id = OLD.id;
+			END;`,
+			`CREATE INDEX IF NOT EXISTS bots_location ON bots (Lat, Lon);`,
+		}
+		if indexes == 0 {
+			statements = append(statements,
+				`INSERT INTO botpois_index SELECT rowid, latitude, latitude, longitude, longitude FROM botpois
+				WHERE latitude IS NOT NULL AND longitude IS NOT NULL;`,
+				`INSERT INTO botmoves_index SELECT id, MIN(fromlat, tolat), MAX(fromlat, tolat), MIN(fromlon, tolon), MAX(fromlon, tolon)
+				FROM botmoves;`)
+		}
+
+		for _, statement := range statements {
+			_, err = tx.Exec(statement)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	check(err)
+}
+
+// Drops cached tiles that overlap the box around points, given as lat, lon, after something there changed.
+func invalidateTiles(points ...[2]float64) {
+	if len(points) == 0 {
+		return
+	}
+	south, west, north, east := points[0][0], points[0][1], points[0][0], points[0][1]
+	for _, p := range points[1:] {
+		south, north = math.Min(south, p[0]), math.Max(north, p[0])
+		west, east = math.Min(west, p[1]), math.Max(east, p[1])
+	}
+
+	tileCache.Lock()
+	defer tileCache.Unlock()
+	tileCache.generation++
+	for t := range tileCache.tiles {
+		s, w, n, e := t.Bounds()
+		if s <= north && n >= south && w <= east && e >= west {
+			delete(tileCache.tiles, t)
+		}
+	}
+}
+
+// Drops every cached tile.
+func clearTiles() {
+	tileCache.Lock()
+	tileCache.generation++
+	tileCache.tiles = map[mvt.Tile][]byte{}
+	tileCache.Unlock()
+}
+
+// The bots in the tile. Older databases keep Lat and Lon as TEXT, so they're cast to compare them as numbers.
+func tileBots(db *sql.DB, t mvt.Tile) mvt.Layer {
+	south, west, north, east := t.Bounds()
+
+	rows, err := db.Query(`SELECT b.BotID, COALESCE(b.Name, ''), COALESCE(b.bottype, ''), b.Lat, b.Lon, COALESCE(s.paused, 0)
+	FROM bots b LEFT JOIN botsettings s ON s.botid = b.BotID
+	WHERE CAST(b.Lat AS REAL) BETWEEN $1 AND $2 AND CAST(b.Lon AS REAL) BETWEEN $3 AND $4 ORDER BY b.BotID;`, south, north, west, east)
+	check(err)
+	defer rows.Close()
+
+	layer := mvt.Layer{Name: "bots"}
+	for rows.Next() {
+		var id int
+		var name, botType string
+		var lat, lon float64
+		var paused bool
+		err = rows.Scan(&id, &name, &botType, &lat, &lon, &paused)
+		check(err)
+
+		layer.Features = append(layer.Features, mvt.Feature{
+			ID:         uint64(id),
+			Type:       mvt.Point,
+			Geometry:   [][][2]float64{{t.Point(lat, lon)}},
+			Properties: map[string]interface{}{"id": id, "name": name, "type": botType, "paused": paused},
+		})
+	}
+	err = rows.Err()
+	check(err)
+	return layer
+}
+
+// The POIs of a visit type in the tile, found with the spatial index. count is how many bots might go
+// to a candidate, or how often a visited POI was visited.
+func tilePOIs(db *sql.DB, t mvt.Tile, layerName string, visitType string) mvt.Layer {
+	south, west, north, east := t.Bounds()
+
+	rows, err := db.Query(`SELECT p.osmid, MIN(p.latitude), MIN(p.longitude), COUNT(*)
+	FROM botpois_index i JOIN botpois p ON p.rowid = i.id
+	WHERE i.maxlat >= $1 AND i.minlat <= $2 AND i.maxlon >= $3 AND i.minlon <= $4
+	AND p.visitype = $5 AND p.osmid IS NOT NULL
+	GROUP BY p.osmid ORDER BY p.osmid;`, south, north, west, east, visitType)
+	check(err)
+	defer rows.Close()
+
+	layer := mvt.Layer{Name: layerName}
+	for rows.Next() {
+		var osmid, count int
+		var lat, lon float64
+		err = rows.Scan(&osmid, &lat, &lon, &count)
+		check(err)
+
+		layer.Features = append(layer.Features, mvt.Feature{
+			ID:         uint64(osmid),
+			Type:       mvt.Point,
+			Geometry:   [][][2]float64{{t.Point(lat, lon)}},
+			Properties: map[string]interface{}{"osmid": osmid, "count": count},
+		})
+	}
+	err = rows.Err()
+	check(err)
+	return layer
+}
+
+// Each bot's moves through the tile as one feature, cut to the tile. Moves that follow on from each other
+// are joined into one line.
+func tileTrails(db *sql.DB, t mvt.Tile) mvt.Layer {
+	south, west, north, east := t.Bounds()
+
+	rows, err := db.Query(`SELECT m.botid, m.fromlat, m.fromlon, m.tolat, m.tolon
+	FROM botmoves_index i JOIN botmoves m ON m.id = i.id
+	WHERE i.maxlat >= $1 AND i.minlat <= $2 AND i.maxlon >= $3 AND i.minlon <= $4
+	ORDER BY m.botid, m.id;`, south, north, west, east)
+	check(err)
+	defer rows.Close()
+
+	layer := mvt.Layer{Name: "trails"}
+	for rows.Next() {
+		var botID int
+		var fromLat, fromLon, toLat, toLon float64
+		err = rows.Scan(&botID, &fromLat, &fromLon, &toLat, &toLon)
+		check(err)
+
+		a, b, ok := mvt.ClipLine(t.Point(fromLat, fromLon), t.Point(toLat, toLon))
+		if !ok {
+			continue
+		}
+
+		last := len(layer.Features) - 1
+		if last < 0 || layer.Features[last].ID != uint64(botID) {
+			layer.Features = append(layer.Features, mvt.Feature{
+				ID:         uint64(botID),
+				Type:       mvt.LineString,
+				Properties: map[string]interface{}{"botid": botID},
+			})
+			last++
+		}
+
+		f := &layer.Features[last]
+		part := len(f.Geometry) - 1
+		if part >= 0 && f.Geometry[part][len(f.Geometry[part])-1] == a {
+			f.Geometry[part] = append(f.Geometry[part], b)
+		} else {
+			f.Geometry = append(f.Geometry, [][2]float64{a, b})
+		}
+	}
+	err = rows.Err()
+	check(err)
+	return layer
+}
+
+// GetTile returns a Mapbox Vector Tile with layers bots, candidates, visited and trails. Tiles are cached
+// until bots in them move or change.
+func GetTile(db *sql.DB, t mvt.Tile) []byte {
+	tileCache.Lock()
+	cached, ok := tileCache.tiles[t]
+	generation := tileCache.generation
+	tileCache.Unlock()
+	if ok {
+		return cached
+	}
+
+	tile := mvt.Encode([]mvt.Layer{
+		tileTrails(db, t),
+		tilePOIs(db, t, "visited", "visited"),
+		tilePOIs(db, t, "candidates", "maybe"),
+		tileBots(db, t),
+	})
+
+	tileCache.Lock()
+	if tileCache.generation == generation {
+		if len(tileCache.tiles) >= maxCachedTiles {
+			tileCache.tiles = map[mvt.Tile][]byte{}
+		}
+		tileCache.tiles[t] = tile
+	}
+	tileCache.Unlock()
+	return tile
+}
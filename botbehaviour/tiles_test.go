@@ -0,0 +1,35 @@
+package botbehaviour
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/alexalexyang/botschaft/mvt"
+)
+
+// Every bot in the shipped database, whose coordinates are TEXT, is in the tile of the whole world, and only
+// the ones in Tbilisi are in a tile of Georgia.
+func TestTileBotsShipped(t *testing.T) {
+	db := shippedDB(t)
+	cases := []struct {
+		z, x, y int
+		ids     []uint64
+	}{
+		{0, 0, 0, []uint64{1, 2, 3, 4, 5, 6, 7, 8}},
+		{6, 39, 23, []uint64{1, 2}},
+	}
+	for _, c := range cases {
+		tile, err := mvt.NewTile(c.z, c.x, c.y)
+		if err != nil {
+			t.Fatal(err)
+		}
+		layer := tileBots(db, tile)
+		ids := []uint64{}
+		for _, f := range layer.Features {
+			ids = append(ids, f.ID)
+		}
+		if !reflect.DeepEqual(ids, c.ids) {
+			t.Errorf("tile %d/%d/%d has bots %v, want %v", c.z, c.x, c.y, ids, c.ids)
+		}
+	}
+}
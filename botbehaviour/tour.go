@@ -0,0 +1,247 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"sort"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// How far in metres a surveyor's tour can be, unless its state says otherwise.
+const defaultSurveyBudget = 5000
+
+// A stop on a surveyor's tour: a POI and the expected tags it's missing.
+type tourStop struct {
+	Seq     int      `json:"seq"`
+	OSMID   int      `json:"osmid"`
+	Lat     float64  `json:"lat"`
+	Lon     float64  `json:"lon"`
+	Missing []string `json:"missing"`
+	Visited bool     `json:"visited"`
+}
+
+// A surveyor's planned tour. Budget and Length are in metres, Length from where the bot was when it planned.
+type tour struct {
+	Planned string     `json:"planned"`
+	Budget  float64    `json:"budget"`
+	Length  float64    `json:"length"`
+	Stops   []tourStop `json:"stops"`
+}
+
+// The first stop not visited yet. False if the tour is done, or there isn't one.
+func (t tour) next() (tourStop, bool) {
+	for _, stop := range t.Stops {
+		if !stop.Visited {
+			return stop, true
+		}
+	}
+	return tourStop{}, false
+}
+
+// Length in km of the path from start through stops in order.
+func pathLength(startLat float64, startLon float64, stops []tourStop) float64 {
+	length := 0.0
+	lat, lon := startLat, startLon
+	for _, stop := range stops {
+		length += haversine(lon, lat, stop.Lon, stop.Lat)
+		lat, lon = stop.Lat, stop.Lon
+	}
+	return length
+}
+
+// How much longer in km the path gets by putting stop in at position at.
+func insertionCost(startLat float64, startLon float64, stops []tourStop, at int, stop tourStop) float64 {
+	prevLat, prevLon := startLat, startLon
+	if at > 0 {
+		prevLat, prevLon = stops[at-1].Lat, stops[at-1].Lon
+	}
+	added := haversine(prevLon, prevLat, stop.Lon, stop.Lat)
+	if at < len(stops) {
+		next := stops[at]
+		added += haversine(stop.Lon, stop.Lat, next.Lon, next.Lat) - haversine(prevLon, prevLat, next.Lon, next.Lat)
+	}
+	return added
+}
+
+// Shortens the path by reversing stretches of it wherever that's shorter (2-opt), until nothing helps.
+// The start stays where it is and the path doesn't have to come back to it.
+func twoOpt(startLat float64, startLon float64, stops []tourStop) []tourStop {
+	point := func(i int) (float64, float64) {
+		if i == 0 {
+			return startLat, startLon
+		}
+		return stops[i-1].Lat, stops[i-1].Lon
+	}
+	distance := func(i int, j int) float64 {
+		latA, lonA := point(i)
+		latB, lonB := point(j)
+		return haversine(lonA, latA, lonB, latB)
+	}
+
+	// Points are numbered from 0 for the start, so stop k is point k+1.
+	n := len(stops)
+	for improved := true; improved; {
+		improved = false
+		for i := 1; i < n; i++ {
+			for j := i + 1; j <= n; j++ {
+				delta := distance(i-1, j) - distance(i-1, i)
+				if j < n {
+					delta += distance(i, j+1) - distance(j, j+1)
+				}
+				if delta < -1e-9 {
+					for a, b := i-1, j-1; a < b; a, b = a+1, b-1 {
+						stops[a], stops[b] = stops[b], stops[a]
+					}
+					improved = true
+				}
+			}
+		}
+	}
+	return stops
+}
+
+// Plans a tour from the start over the candidates the bot hasn't visited that are missing tags, at most
+// budget km long. POIs missing the most tags go in first, each where it adds the least distance (cheapest
+// insertion), and those that would go over budget are left out. Then the order is shortened with twoOpt.
+func planTour(startLat float64, startLon float64, budget float64, candidates []candidatePOI, visited map[int]bool) []tourStop {
+	pool := []tourStop{}
+	seen := map[int]bool{}
+	for _, c := range candidates {
+		if c.OSMID == 0 || visited[c.OSMID] || seen[c.OSMID] || len(c.Missing) == 0 {
+			continue
+		}
+		seen[c.OSMID] = true
+		pool = append(pool, tourStop{OSMID: c.OSMID, Lat: c.Lat, Lon: c.Lon, Missing: c.Missing})
+	}
+	sort.SliceStable(pool, func(i, j int) bool {
+		if len(pool[i].Missing) != len(pool[j].Missing) {
+			return len(pool[i].Missing) > len(pool[j].Missing)
+		}
+		return haversine(startLon, startLat, pool[i].Lon, pool[i].Lat) < haversine(startLon, startLat, pool[j].Lon, pool[j].Lat)
+	})
+
+	stops := []tourStop{}
+	length := 0.0
+	for _, stop := range pool {
+		bestAt, bestAdded := 0, math.Inf(1)
+		for at := 0; at <= len(stops); at++ {
+			added := insertionCost(startLat, startLon, stops, at, stop)
+			if added < bestAdded {
+				bestAt, bestAdded = at, added
+			}
+		}
+		if length+bestAdded > budget {
+			continue
+		}
+		stops = append(stops, tourStop{})
+		copy(stops[bestAt+1:], stops[bestAt:])
+		stops[bestAt] = stop
+		length += bestAdded
+	}
+
+	stops = twoOpt(startLat, startLon, stops)
+	for i := range stops {
+		stops[i].Seq = i
+	}
+	return stops
+}
+
+func createTourTables(db dbtx) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS bottourplan (
+		botid INTEGER PRIMARY KEY,
+		planned TEXT,
+		budget REAL,
+		length REAL
+	);
+	CREATE TABLE IF NOT EXISTS bottour (
+		botid INTEGER,
+		seq INTEGER,
+		osmid INTEGER,
+		lat REAL,
+		lon REAL,
+		missing TEXT,
+		visited INTEGER,
+		PRIMARY KEY (botid, seq)
+	);`)
+	check(err)
+}
+
+// Gets a surveyor's tour. A surveyor without one gets an empty tour with the default budget.
+func getTour(db dbtx, botID int) (tour, error) {
+	t := tour{Budget: defaultSurveyBudget, Stops: []tourStop{}}
+	err := db.QueryRow(`SELECT planned, budget, length FROM bottourplan WHERE botid=$1;`, botID).Scan(&t.Planned, &t.Budget, &t.Length)
+	if err == sql.ErrNoRows {
+		return t, nil
+	}
+	if err != nil {
+		return t, err
+	}
+
+	rows, err := db.Query(`SELECT seq, osmid, lat, lon, missing, visited FROM bottour WHERE botid=$1 ORDER BY seq;`, botID)
+	if err != nil {
+		return t, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		stop := tourStop{}
+		var missing string
+		err = rows.Scan(&stop.Seq, &stop.OSMID, &stop.Lat, &stop.Lon, &missing, &stop.Visited)
+		if err != nil {
+			return t, err
+		}
+		err = json.Unmarshal([]byte(missing), &stop.Missing)
+		if err != nil {
+			return t, err
+		}
+		t.Stops = append(t.Stops, stop)
+	}
+	return t, rows.Err()
+}
+
+// Replaces a surveyor's tour.
+func saveTour(db dbtx, botID int, t tour) error {
+	_, err := db.Exec(`DELETE FROM bottour WHERE botid=$1;`, botID)
+	if err != nil {
+		return err
+	}
+	for _, stop := range t.Stops {
+		missing, err := json.Marshal(stop.Missing)
+		if err != nil {
+			return err
+		}
+		statement := `INSERT INTO bottour (botid, seq, osmid, lat, lon, missing, visited) values ($1, $2, $3, $4, $5, $6, $7);`
+		_, err = db.Exec(statement, botID, stop.Seq, stop.OSMID, stop.Lat, stop.Lon, string(missing), stop.Visited)
+		if err != nil {
+			return err
+		}
+	}
+
+	statement := `INSERT OR REPLACE INTO bottourplan (botid, planned, budget, length) values ($1, $2, $3, $4);`
+	_, err = db.Exec(statement, botID, t.Planned, t.Budget, t.Length)
+	return err
+}
+
+// GetTour returns a surveyor's planned tour as JSON. Returns false if there is no such bot.
+func GetTour(db *sql.DB, botID int) ([]byte, bool) {
+	if _, ok := getBot(db, botID); !ok {
+		return nil, false
+	}
+
+	t, err := getTour(db, botID)
+	check(err)
+
+	tourJSON, err := json.Marshal(t)
+	check(err)
+	return tourJSON, true
+}
+
+// Plans a new tour from where the bot is now and saves it. The tour is empty if there is nothing worth surveying.
+func planAndSaveTour(db dbtx, b bot, t tour, candidates []candidatePOI, visited map[int]bool) (tour, error) {
+	t.Stops = planTour(b.Lat, b.Lon, t.Budget/1000, candidates, visited)
+	t.Length = pathLength(b.Lat, b.Lon, t.Stops) * 1000
+	t.Planned = now().UTC().Format(time.RFC3339)
+	return t, saveTour(db, b.ID, t)
+}
@@ -4,15 +4,18 @@ import (
 	"bytes"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"math"
-	"math/rand"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/alexalexyang/botschaft/config"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -24,11 +27,34 @@ func check(err error) {
 
 type bot struct {
 	ID     int
+	UserID int
 	Name   string
 	Lat    float64
 	Lon    float64
 	Radius float64
 	Pois   []poi
+	// Type: the bot's bottype, one of the registered botTypes.
+	Type string
+	// Personality: drives how far the bot goes, where it goes, and when it rests.
+	Personality personality
+	// SearchRadius: how far in metres the bot had to search to find POIs in its last tick.
+	SearchRadius float64
+	// Stuck: the bot found nothing even at maxSearchRadius.
+	Stuck      bool
+	StuckTicks int
+	StuckSince string
+	// Routine: the bot's home and daily routine. Slot: the part of the routine the bot is in now.
+	Routine routine
+	Slot    routineSlot
+	// Tick: where the bot is in its current tick.
+	Tick tickState
+	// Categories: the POI categories the bot looks for instead of what its routine says. Paused: the bot skips ticks.
+	Categories []string
+	Paused     bool
+	// Fences: the geofences the bot keeps to, its own and everyone's. Left out of JSON since they can be big.
+	Fences []geofence `json:"-"`
+	// Blocked: the POIs its last search found that its geofences don't let it be at, saved as events with its candidates.
+	Blocked []fenceBlock `json:"-"`
 }
 
 type poi struct {
@@ -38,20 +64,20 @@ type poi struct {
 	Tags map[string]string `json:"tags"`
 	// VisitType: potential or visited.
 	VisitType string
+	// Completeness: share of expectedTags the POI has on OSM, from 0 to 1.
+	Completeness float64  `json:"completeness"`
+	Missing      []string `json:"missing"`
 }
 
 type jsonStruct struct {
 	Pois []poi `json:"elements"`
 }
 
-// Collects all bots with travel in their drive in a []bot.
-func GetTravelBots() []bot {
+// Collects all bots of a registered type in a []bot. Bots of types this build doesn't know are left alone.
+func GetTravelBots(db *sql.DB) []bot {
+	defer observeQuery("GetTravelBots", time.Now())
 
-	// Select all travelbots.
-	db, err := sql.Open("sqlite3", "database.db")
-	check(err)
-
-	query := `SELECT BotID, Name, Radius, Lat, Lon FROM bots WHERE bottype="travelbot";`
+	query := `SELECT BotID, COALESCE(UserID, 0), Name, Radius, Lat, Lon, COALESCE(bottype, '') FROM bots;`
 	rows, err := db.Query(query)
 	check(err)
 	defer rows.Close()
@@ -61,53 +87,119 @@ func GetTravelBots() []bot {
 	for rows.Next() {
 		b := bot{}
 
-		err = rows.Scan(&b.ID, &b.Name, &b.Radius, &b.Lat, &b.Lon)
+		err = rows.Scan(&b.ID, &b.UserID, &b.Name, &b.Radius, &b.Lat, &b.Lon, &b.Type)
 		check(err)
-		bots = append(bots, b)
+		if _, ok := botTypes[b.Type]; ok {
+			bots = append(bots, b)
+		}
 	}
 	err = rows.Err()
 	check(err)
-	db.Close()
+	rows.Close()
+
+	for i := range bots {
+		bots[i].Personality = getPersonality(db, bots[i].ID)
+
+		search := getSearch(db, bots[i].ID)
+		bots[i].SearchRadius = search.SearchRadius
+		bots[i].Stuck = search.Stuck
+		bots[i].StuckTicks = search.StuckTicks
+		bots[i].StuckSince = search.StuckSince
+
+		bots[i].Routine = getRoutine(db, bots[i])
+		settings := getSettings(db, bots[i].ID)
+		bots[i].Categories = settings.Categories
+		bots[i].Paused = settings.Paused
+
+		bots[i].Slot = bots[i].currentSlot()
+		bots[i].Tick = getTickState(db, bots[i].ID)
+		bots[i].Fences = getFences(db, bots[i].ID)
+	}
 	return bots
 }
 
+// The part of its routine the bot is in now, and what it looks for: its type's amenity if it has one, else the
+// categories it was given, else its routine's.
+func (b bot) currentSlot() routineSlot {
+	slot := b.slotAt(now())
+	if len(b.Categories) > 0 && !slot.goesHome() {
+		slot.Amenity = strings.Join(b.Categories, "|")
+	}
+	if amenity := botTypes[b.Type].Amenity; amenity != "" && !slot.goesHome() {
+		slot.Amenity = amenity
+	}
+	return slot
+}
+
 // Concatenates separate queries for POIs from each bot in []bot into a single long query,
-func createOSMQuery(bots []bot) string {
+// each for the kind of POI the bot's routine wants now.
+func createOSMQuery(overpassURL string, bots []bot) string {
 	poiType := "amenity"
-	poiSubType := "restaurant"
 
 	var pointsBuffer bytes.Buffer
 	for _, bot := range bots {
+		poiSubType := bot.Slot.Amenity
+		if poiSubType == "" {
+			poiSubType = defaultAmenity
+		}
 		lat := strconv.FormatFloat(bot.Lat, 'f', 6, 64)
 		lon := strconv.FormatFloat(bot.Lon, 'f', 6, 64)
-		radius := strconv.FormatFloat(bot.Radius, 'f', 6, 64)
+		radius := strconv.FormatFloat(bot.SearchRadius, 'f', 6, 64)
 		pointTemplate := "node(around:{radius},{lat},{lon})[{poiType}={poiSubType}];"
+		// Several categories are matched with a regular expression. They are checked against amenityPattern, so they're safe in it.
+		if strings.Contains(poiSubType, "|") {
+			pointTemplate = `node(around:{radius},{lat},{lon})[{poiType}~"^({poiSubType})$"];`
+		}
 		replacements := strings.NewReplacer("{radius}", radius, "{lat}", lat, "{lon}", lon, "{poiType}", poiType, "{poiSubType}", poiSubType)
 		point := replacements.Replace(pointTemplate)
 		pointsBuffer.WriteString(point)
 	}
 
-	queryTemplate := "https://overpass-api.de/api/interpreter?data=[out:json];({points});out;"
+	queryTemplate := "[out:json];({points});out;"
 	replacements := strings.NewReplacer("{points}", pointsBuffer.String())
 
-	return replacements.Replace(queryTemplate)
+	return overpassURL + "?data=" + url.QueryEscape(replacements.Replace(queryTemplate))
+}
+
+// The client Overpass is asked with. It gives up on a query, including reading the answer, after cfg.OverpassTimeout.
+func overpassClient(cfg config.Config) *http.Client {
+	return &http.Client{Timeout: cfg.OverpassTimeout.Duration}
 }
 
 // Query OSM with single long query from createOSMQuery() to get all POIs near all travel bots. Collect into a []poi.
-func getPOIs(query string) []poi {
+func getPOIs(client *http.Client, query string) ([]poi, error) {
 	// Send a GET request to Overpass to get all POIs for all bot locations.
-	resp, err := http.Get(query)
-	check(err)
+	start := time.Now()
+	resp, err := client.Get(query)
+	overpassDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		overpassErrors.Inc()
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		overpassErrors.Inc()
+		return nil, errors.New("overpass returned " + resp.Status)
+	}
 
 	// Read data into []byte.
 	body, err := ioutil.ReadAll(resp.Body)
-	check(err)
+	if err != nil {
+		overpassErrors.Inc()
+		return nil, err
+	}
 
 	// Transform to a Golang struct we can use.
 	result := &jsonStruct{}
-	json.Unmarshal(body, &result)
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		overpassErrors.Inc()
+		return nil, errors.New("overpass answered with something that isn't JSON: " + err.Error())
+	}
 
-	return result.Pois
+	poisFetched.Add(float64(len(result.Pois)))
+	return result.Pois, nil
 }
 
 // Used to find distance between two points on Earth in km.
@@ -134,13 +226,24 @@ func withinBotRadius(haversineDistance float64, radius float64) bool {
 	}
 }
 
-// Finds the nearest POIs to a bot using haversine() and withinBotRadius().
-func getNearestPOIs(bots []bot, pois []poi, radius float64) []bot {
+// Finds the nearest POIs to a bot, within its SearchRadius, using haversine() and withinBotRadius().
+// Only POIs of the kind the bot's routine wants now count, since one query has POIs for every bot,
+// and only POIs the bot's geofences allow it to be at.
+func getNearestPOIs(bots []bot, pois []poi) []bot {
 	newBotsSlice := []bot{}
 	for _, bot := range bots {
+		bot.Pois = nil
+		bot.Blocked = nil
 		for _, poi := range pois {
-			distance := haversine(bot.Lat, bot.Lon, poi.Lat, poi.Lon)
-			if withinBotRadius(distance, radius) == true {
+			if bot.Slot.Amenity != "" && !bot.Slot.wants(poi.Tags["amenity"]) {
+				continue
+			}
+			distance := haversine(bot.Lon, bot.Lat, poi.Lon, poi.Lat)
+			if withinBotRadius(distance, bot.SearchRadius) == true {
+				if fence, ok := permits(bot.Fences, poi.Lat, poi.Lon); !ok {
+					bot.Blocked = append(bot.Blocked, fenceBlock{Stage: "candidate", Fence: fence, OSMID: poi.ID, Lat: poi.Lat, Lon: poi.Lon})
+					continue
+				}
 				bot.Pois = append(bot.Pois, poi)
 			}
 		}
@@ -149,58 +252,6 @@ func getNearestPOIs(bots []bot, pois []poi, radius float64) []bot {
 	return newBotsSlice
 }
 
-// Insert POIs within bot radius to botpois table set to "maybe".
-func insertBotPOIsDB(bots []bot) {
-	db, err := sql.Open("sqlite3", "database.db")
-	check(err)
-	for _, bot := range bots {
-		for _, poi := range bot.Pois {
-			id := strconv.Itoa(poi.ID)
-			lat := strconv.FormatFloat(poi.Lat, 'f', 6, 64)
-			lon := strconv.FormatFloat(poi.Lon, 'f', 6, 64)
-
-			statement := `INSERT INTO botpois (botid, osmid, latitude, longitude, visitype) values ($1, $2, $3, $4, $5);`
-			check(err)
-			_, err = db.Exec(statement, bot.ID, id, lat, lon, `maybe`)
-
-			tags := poi.Tags
-			statement = `INSERT INTO taginfo (
-					botid,
-					osmid,
-					amenity,
-					name,
-					name_en,
-					addr_housenumber,
-					addr_street,
-					opening_hours,
-					phone,
-					cuisine,
-					description,
-					internet_access,
-					smoking,
-					wheelchair
-					) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14);`
-			check(err)
-			_, err = db.Exec(statement,
-				bot.ID,
-				id,
-				tags["amenity"],
-				tags["name"],
-				tags["name:en"],
-				tags["addr:housenumber"],
-				tags["addr:street"],
-				tags["opening_hours"],
-				tags["phone"],
-				tags["cuisine"],
-				tags["description"],
-				tags["internet_access"],
-				tags["smoking"],
-				tags["wheelchair"])
-		}
-	}
-	db.Close()
-}
-
 // CREATE TABLE taginfo (
 // 	botid,
 // 	osmid TEXT,
@@ -218,72 +269,6 @@ func insertBotPOIsDB(bots []bot) {
 // 	wheelchair TEXT
 //   );
 
-// Insert current location as "visited" in botpois. Replace current location with randomly picked location. Delete all "maybe" pois.
-func pickNewPOI(bots []bot) []bot {
-	newBotsSlice := []bot{}
-
-	db, err := sql.Open("sqlite3", "database.db")
-	check(err)
-
-	for _, bot := range bots {
-		// Insert current location as "visited" in botpois.
-		id := strconv.Itoa(bot.ID)
-		lat := strconv.FormatFloat(bot.Lat, 'f', 6, 64)
-		lon := strconv.FormatFloat(bot.Lon, 'f', 6, 64)
-
-		statement := `INSERT INTO botpois (botid, latitude, longitude, visitype) values ($1, $3, $4, $5);`
-
-		check(err)
-		_, err = db.Exec(statement, id, lat, lon, `visited`)
-
-		// Select all "maybe" pois.
-
-		type poi struct {
-			ID   sql.NullInt64     `json:"id"`
-			Lat  float64           `json:"lat"`
-			Lon  float64           `json:"lon"`
-			Tags map[string]string `json:"tags"`
-			// VisitType: potential or visited.
-			VisitType string
-		}
-
-		pois := []poi{}
-		rows, err := db.Query(`SELECT osmid, latitude, longitude FROM botpois WHERE visitype="maybe" AND botid=$1;`, bot.ID)
-		check(err)
-		defer rows.Close()
-		for rows.Next() {
-			poi := poi{}
-			err = rows.Scan(&poi.ID, &poi.Lat, &poi.Lon)
-			check(err)
-			pois = append(pois, poi)
-		}
-		err = rows.Err()
-		check(err)
-
-		// Replace current location with randomly picked location.
-		if len(pois) > 0 {
-			rand.Seed(time.Now().Unix())
-			randomPOI := pois[rand.Intn(len(pois))]
-			bot.Lat = randomPOI.Lat
-			bot.Lon = randomPOI.Lon
-		}
-		newBotsSlice = append(newBotsSlice, bot)
-		statement = `UPDATE bots SET Lat=?,Lon=? WHERE BotID=?;`
-		_, err = db.Exec(statement, bot.Lat, bot.Lon, bot.ID)
-
-	}
-	db.Close()
-	return newBotsSlice
-}
-
-// Delete all "maybe" pois.
-func refresh() {
-	db, err := sql.Open("sqlite3", "database.db")
-	check(err)
-	statement := `DELETE FROM botpois WHERE visitype="maybe"; DELETE FROM taginfo;`
-	_, err = db.Exec(statement)
-}
-
 type tagsStruct struct {
 	Amenity          string
 	Name             string
@@ -299,6 +284,42 @@ type tagsStruct struct {
 	Wheelchair       string
 }
 
+// The tags taginfo keeps, from a POI's OSM tags.
+func tagsFromOSM(tags map[string]string) tagsStruct {
+	return tagsStruct{
+		Amenity:          tags["amenity"],
+		Name:             tags["name"],
+		Name_en:          tags["name:en"],
+		Addr_housenumber: tags["addr:housenumber"],
+		Addr_street:      tags["addr:street"],
+		Opening_hours:    tags["opening_hours"],
+		Phone:            tags["phone"],
+		Cuisine:          tags["cuisine"],
+		Description:      tags["description"],
+		Internet_access:  tags["internet_access"],
+		Smoking:          tags["smoking"],
+		Wheelchair:       tags["wheelchair"],
+	}
+}
+
+// The tags as the map page shows them.
+func (tags tagsStruct) tagMap() map[string]string {
+	return map[string]string{
+		"Amenity":          tags.Amenity,
+		"Name":             tags.Name,
+		"Name_en":          tags.Name_en,
+		"Addr_housenumber": tags.Addr_housenumber,
+		"Addr_street":      tags.Addr_street,
+		"Opening_hours":    tags.Opening_hours,
+		"Phone":            tags.Phone,
+		"Cuisine":          tags.Cuisine,
+		"Description":      tags.Description,
+		"Internet_access":  tags.Internet_access,
+		"Smoking":          tags.Smoking,
+		"Wheelchair":       tags.Wheelchair,
+	}
+}
+
 func getTags(db *sql.DB, workingPOI poi) poi {
 	newPOI := poi{}
 
@@ -340,32 +361,18 @@ func getTags(db *sql.DB, workingPOI poi) poi {
 		err = rows.Err()
 		check(err)
 
-		workingPOI.Tags = make(map[string]string)
-		workingPOI.Tags["Amenity"] = tags.Amenity
-		workingPOI.Tags["Name"] = tags.Name
-		workingPOI.Tags["Name_en"] = tags.Name_en
-		workingPOI.Tags["Addr_housenumber"] = tags.Addr_housenumber
-		workingPOI.Tags["Addr_street"] = tags.Addr_street
-		workingPOI.Tags["Opening_hours"] = tags.Opening_hours
-		workingPOI.Tags["Phone"] = tags.Phone
-		workingPOI.Tags["Cuisine"] = tags.Cuisine
-		workingPOI.Tags["Description"] = tags.Description
-		workingPOI.Tags["Internet_access"] = tags.Internet_access
-		workingPOI.Tags["Smoking"] = tags.Smoking
-		workingPOI.Tags["Wheelchair"] = tags.Wheelchair
+		workingPOI.Tags = tags.tagMap()
+		workingPOI.Completeness, workingPOI.Missing = tags.completeness()
 
 		newPOI = workingPOI
 	}
 	return newPOI
 }
 
-func GetTravelPlans() []byte {
-	bots := GetTravelBots()
+func GetTravelPlans(db *sql.DB) []byte {
+	bots := GetTravelBots(db)
 	newBotsSlice := []bot{}
 
-	db, err := sql.Open("sqlite3", "database.db")
-	check(err)
-
 	for _, bot := range bots {
 
 		// Get data from table botpois.
@@ -395,7 +402,6 @@ func GetTravelPlans() []byte {
 
 		newBotsSlice = append(newBotsSlice, bot)
 	}
-	db.Close()
 
 	botsJSON, err := json.Marshal(newBotsSlice)
 	check(err)
@@ -410,21 +416,67 @@ func GetTravelPlans() []byte {
 	return botsJSON
 }
 
-func GoTravel() {
-
-	for {
-		travelBots := GetTravelBots()
-		query := createOSMQuery(travelBots)
-		pois := getPOIs(query)
-		travelBots = getNearestPOIs(travelBots, pois, 1000)
-		insertBotPOIsDB(travelBots)
-		travelBots = pickNewPOI(travelBots)
-		time.Sleep(10 * time.Second)
-		refresh()
-
-		for _, bot := range travelBots {
-			fmt.Println(bot.Name, bot.Lat, bot.Lon)
-			fmt.Println("")
+// Runs one travel tick: find POIs near each bot and move it to one, with bots worked on in parallel by processBots,
+// then award the achievements they've earned. Returns the bots and the IDs of those that failed. Bots that failed
+// are counted and logged, carry on next tick, and aren't checked for achievements until a tick they finish, since
+// they're part way through their move. The tick still counts as done, so one bot that always fails can't keep
+// the engine unready. It fails, with an error, only if the database does or every bot that wasn't paused failed.
+// Failed ticks are counted as errors and don't stop GoTravel.
+func runTick(logger *slog.Logger, db *sql.DB, cfg config.Config) (travelBots []bot, failed map[int]bool, err error) {
+	start := time.Now()
+	defer func() {
+		if p := recover(); p != nil {
+			ticksTotal.WithLabelValues("error").Inc()
+			logger.Error("travel tick failed", "err", p)
+			travelBots, failed = nil, nil
+			err = fmt.Errorf("%v", p)
 		}
+	}()
+
+	logger.Debug("travel tick started")
+	saveMissingRoutines(db)
+	travelBots = GetTravelBots(db)
+
+	failed = processBots(logger, db, cfg, travelBots)
+	finished := []bot{}
+	working := 0
+	for _, b := range travelBots {
+		if !b.Paused {
+			working++
+		}
+		if !failed[b.ID] {
+			finished = append(finished, b)
+		}
+	}
+	awardAchievements(logger, db, cfg, finished)
+	if len(failed) > 0 {
+		botsFailed.Add(float64(len(failed)))
+		logger.Warn("bots failed a tick step", "failed", len(failed), "bots", working)
+		if len(failed) == working {
+			ticksTotal.WithLabelValues("error").Inc()
+			err = fmt.Errorf("all %d bots failed a tick step", len(failed))
+			logger.Error("travel tick failed", "err", err)
+			return nil, failed, err
+		}
+	}
+
+	tickDuration.Observe(time.Since(start).Seconds())
+	ticksTotal.WithLabelValues("ok").Inc()
+	botsProcessed.Add(float64(len(travelBots) - len(failed)))
+	markTickDone()
+
+	for _, bot := range travelBots {
+		logger.Info("bot location", "bot_id", bot.ID, "name", bot.Name, "lat", bot.Lat, "lon", bot.Lon, "slot", bot.Slot.Name)
+	}
+	logger.Info("travel tick done", "bots", len(travelBots), "failed", len(failed), "duration", time.Since(start))
+	return travelBots, failed, nil
+}
+
+// GoTravel moves the travel bots every cfg.TickInterval, forever. Every line logged during a tick has its tick_id.
+func GoTravel(logger *slog.Logger, db *sql.DB, cfg config.Config) {
+	for tickID := 1; ; tickID++ {
+		tickLogger := logger.With("tick_id", tickID)
+		runTick(tickLogger, db, cfg)
+		time.Sleep(cfg.TickInterval.Duration)
 	}
 }
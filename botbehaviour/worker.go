@@ -0,0 +1,240 @@
+package botbehaviour
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alexalexyang/botschaft/config"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// One lock per bot ID, so a bot is never worked on by two goroutines at once, even across ticks.
+var botLocks sync.Map
+
+// Locks a bot until the returned function is called.
+func lockBot(botID int) func() {
+	l, _ := botLocks.LoadOrStore(botID, &sync.Mutex{})
+	mutex := l.(*sync.Mutex)
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+// A counting semaphore. Callers block in acquire while n others hold it, which keeps a slow Overpass from
+// being sent more and more queries.
+type limiter chan struct{}
+
+func newLimiter(n int) limiter {
+	return make(limiter, n)
+}
+
+func (l limiter) acquire() {
+	overpassWaiting.Inc()
+	l <- struct{}{}
+	overpassWaiting.Dec()
+}
+
+func (l limiter) release() {
+	<-l
+}
+
+// How many bots search in one Overpass query. Bots near each other go in the same batch, so the areas they
+// search overlap and the answer isn't much bigger than one bot's.
+const searchBatch = 50
+
+// Says whether a bot searches for POIs this tick. Paused bots, bots part way through a tick, and bots whose
+// type already knows where they're going don't. Panics are returned as errors, as in processBot.
+func needsSearch(db dbtx, b bot) (needs bool, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%v", p)
+		}
+	}()
+
+	t := botTypes[b.Type]
+	return !b.Paused && !b.Tick.resuming() && t.Searches && (t.Planned == nil || !t.Planned(db, b)), nil
+}
+
+// What a bot's search found, or why its batch failed.
+type searchResult struct {
+	bot bot
+	err error
+}
+
+// Searches for every bot that needs it, searchBatch bots near each other to a query, with at most
+// cfg.OverpassConcurrency queries at once. Returns what each bot found by its index in bots.
+func searchBatches(logger *slog.Logger, db *sql.DB, cfg config.Config, bots []bot) map[int]searchResult {
+	results := map[int]searchResult{}
+	pending := []int{}
+	for i := range bots {
+		needs, err := needsSearch(db, bots[i])
+		if err != nil {
+			results[i] = searchResult{err: err}
+		} else if needs {
+			pending = append(pending, i)
+		}
+	}
+	// Bands a degree of latitude high, west to east, so each batch is of bots close together.
+	sort.SliceStable(pending, func(x, y int) bool {
+		a, b := bots[pending[x]], bots[pending[y]]
+		if bandA, bandB := math.Floor(a.Lat), math.Floor(b.Lat); bandA != bandB {
+			return bandA < bandB
+		}
+		return a.Lon < b.Lon
+	})
+
+	overpass := newLimiter(cfg.OverpassConcurrency)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for start := 0; start < len(pending); start += searchBatch {
+		end := start + searchBatch
+		if end > len(pending) {
+			end = len(pending)
+		}
+		batch := pending[start:end]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			searching := []bot{}
+			for _, i := range batch {
+				searching = append(searching, bots[i])
+			}
+
+			overpass.acquire()
+			searched, err := func() (searched []bot, err error) {
+				defer func() {
+					if p := recover(); p != nil {
+						err = fmt.Errorf("%v", p)
+					}
+				}()
+				return searchPOIs(logger, db, cfg, searching)
+			}()
+			overpass.release()
+			if err != nil {
+				logger.Error("search failed", "bots", len(batch), "err", err)
+			}
+
+			mutex.Lock()
+			for k, i := range batch {
+				if err != nil {
+					results[i] = searchResult{err: err}
+				} else {
+					results[i] = searchResult{bot: searched[k]}
+				}
+			}
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// Takes one bot through its whole tick: save the candidates its search found, choose, move, the way its type
+// does them. found is what its search found, if it searched. Bots part way through a tick from before a restart
+// skip the steps they've done. Panics are returned as errors so one bot can't stop the others.
+// A bot deleted since the tick started is left alone, and errBotGone returned.
+func processBot(logger *slog.Logger, db *sql.DB, b *bot, found *searchResult, others []bot) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%v", p)
+		}
+	}()
+
+	unlock := lockBot(b.ID)
+	defer unlock()
+
+	t := botTypes[b.Type]
+	if b.Tick.resuming() {
+		logger.Info("resuming bot", "state", b.Tick.State)
+	} else {
+		if found != nil {
+			// Overpass was asked before anything was saved, so a failed query leaves the bot as it was.
+			if found.err != nil {
+				return found.err
+			}
+			*b = found.bot
+			err = saveCandidates(db, b)
+		} else {
+			err = keepCandidates(db, b)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Each bot gets its own random source so bots in the same place don't pick the same POI, and one for the
+	// whole tick so choosing and arriving don't draw the same numbers.
+	rng := botRand(b.ID)
+	if b.Tick.State == stateCandidates {
+		err = chooseNext(logger, db, t, rng, b, others)
+		if err != nil {
+			return err
+		}
+	}
+	if b.Tick.State == stateChosen {
+		return moveBot(db, t, rng, b)
+	}
+	return nil
+}
+
+// Searches for the bots that need it with searchBatches, then runs processBot for every bot that isn't paused on
+// cfg.Workers goroutines. Each goroutine only writes its own bots[i], and others is a copy taken before any bot moves.
+// Returns the IDs of the bots that failed; their errors are logged and they carry on from their last committed step next tick.
+func processBots(logger *slog.Logger, db *sql.DB, cfg config.Config, bots []bot) map[int]bool {
+	others := make([]bot, len(bots))
+	copy(others, bots)
+	searched := searchBatches(logger, db, cfg, bots)
+
+	jobs := make(chan int)
+	failures := make(chan int, len(bots))
+	var wg sync.WaitGroup
+
+	for w := 0; w < cfg.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				workersBusy.Inc()
+				start := time.Now()
+				botLogger := logger.With("bot_id", bots[i].ID)
+
+				var found *searchResult
+				if result, ok := searched[i]; ok {
+					found = &result
+				}
+				err := processBot(botLogger, db, &bots[i], found, others)
+				if errors.Is(err, errBotGone) {
+					botLogger.Info("bot was deleted during the tick")
+				} else if err != nil {
+					botLogger.Error("bot tick failed", "state", bots[i].Tick.State, "err", err)
+					failures <- bots[i].ID
+				}
+				botDuration.Observe(time.Since(start).Seconds())
+				workersBusy.Dec()
+			}
+		}()
+	}
+
+	// Sending blocks until a worker is free, so bots are only handed out as fast as they're done.
+	for i := range bots {
+		if bots[i].Paused {
+			continue
+		}
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	close(failures)
+
+	failed := map[int]bool{}
+	for botID := range failures {
+		failed[botID] = true
+	}
+	return failed
+}
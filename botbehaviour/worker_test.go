@@ -0,0 +1,174 @@
+package botbehaviour
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An Overpass that keeps track of how many queries it's answering at once, and takes a while to answer, so
+// queries that aren't limited overlap.
+type slowOverpass struct {
+	*fakeOverpass
+	mutex    sync.Mutex
+	inFlight int
+	most     int
+}
+
+func (o *slowOverpass) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mutex.Lock()
+	o.inFlight++
+	if o.inFlight > o.most {
+		o.most = o.inFlight
+	}
+	o.mutex.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+	o.fakeOverpass.ServeHTTP(w, r)
+
+	o.mutex.Lock()
+	o.inFlight--
+	o.mutex.Unlock()
+}
+
+// Runs processBots over many bots close enough together that they find the same POIs and meet each other,
+// on several workers at once. Run it with -race.
+func TestProcessBots(t *testing.T) {
+	var overpass *slowOverpass
+	f := newTickFixture(t, func(o *fakeOverpass) http.Handler {
+		overpass = &slowOverpass{fakeOverpass: o}
+		return overpass
+	})
+	f.addBots(t, 40, 500, 1500)
+	db, cfg := f.db, f.cfg
+	cfg.Workers = 8
+	cfg.OverpassConcurrency = 2
+	logger := discardLogger()
+
+	for round := 1; round <= 3; round++ {
+		bots := GetTravelBots(db)
+		if failed := processBots(logger, db, cfg, bots); len(failed) > 0 {
+			t.Fatalf("round %d: %d bots failed", round, len(failed))
+		}
+
+		for _, b := range bots {
+			state := getTickState(db, b.ID)
+			if state.State != stateMoved {
+				t.Errorf("round %d: bot %d ended in state %s, want %s", round, b.ID, state.State, stateMoved)
+			}
+			saved, ok := getBot(db, b.ID)
+			if !ok {
+				t.Fatalf("round %d: bot %d is gone", round, b.ID)
+			}
+			if saved.Lat != b.Lat || saved.Lon != b.Lon {
+				t.Errorf("round %d: bot %d is at %f, %f, but its worker had it at %f, %f", round, b.ID, saved.Lat, saved.Lon, b.Lat, b.Lon)
+			}
+		}
+		f.clock = f.clock.Add(30 * time.Minute)
+	}
+
+	if len(overpass.queries) == 0 {
+		t.Error("no bot asked Overpass for POIs")
+	}
+	// Each round the bots search together, and again for the ones that found nothing.
+	if len(overpass.queries) >= 40 {
+		t.Errorf("%d Overpass queries for 40 bots in 3 rounds, so bots searched on their own", len(overpass.queries))
+	}
+	if overpass.most > cfg.OverpassConcurrency {
+		t.Errorf("%d Overpass queries were sent at once, want at most %d", overpass.most, cfg.OverpassConcurrency)
+	}
+
+	// Every bot went somewhere each round, and only its own worker saved its visits.
+	var visits, strays int
+	err := db.QueryRow(`SELECT COUNT(*) FROM botpois WHERE visitype="visited";`).Scan(&visits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRow(`SELECT COUNT(*) FROM botpois WHERE botid NOT IN (SELECT BotID FROM bots);`).Scan(&strays)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if visits == 0 {
+		t.Error("no bot visited a POI")
+	}
+	if strays > 0 {
+		t.Errorf("%d POIs were saved for bots that don't exist", strays)
+	}
+
+	var friendships int
+	err = db.QueryRow(`SELECT COUNT(*) FROM botfriends;`).Scan(&friendships)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if friendships == 0 {
+		t.Error("no bots met, so the test doesn't cover bots sharing POIs")
+	}
+}
+
+// A bot deleted after the tick read it is left alone by its worker, rather than saved again.
+func TestProcessBotsDeleted(t *testing.T) {
+	f := newTickFixture(t, nil)
+	f.addBots(t, 6, 500, 1500)
+	bots := GetTravelBots(f.db)
+	gone := bots[0].ID
+	deleted, err := DeleteBot(f.db, gone)
+	if err != nil || !deleted {
+		t.Fatalf("deleting bot %d: %v, %v", gone, deleted, err)
+	}
+
+	if failed := processBots(discardLogger(), f.db, f.cfg, bots); len(failed) > 0 {
+		t.Fatalf("%d bots failed", len(failed))
+	}
+	awardAchievements(discardLogger(), f.db, f.cfg, bots)
+
+	for table, column := range botTables {
+		var n int
+		err = f.db.QueryRow(`SELECT COUNT(*) FROM "`+table+`" WHERE "`+column+`"=$1;`, gone).Scan(&n)
+		if err != nil {
+			t.Fatalf("%s: %v", table, err)
+		}
+		if n > 0 {
+			t.Errorf("%d rows in %s for bot %d, which was deleted", n, table, gone)
+		}
+	}
+	if state := getTickState(f.db, bots[1].ID); state.State != stateMoved {
+		t.Errorf("bot %d ended in state %s, want %s", bots[1].ID, state.State, stateMoved)
+	}
+}
+
+// A bot that always fails doesn't fail the tick for the others, and the tick still counts as done.
+func TestRunTickFailedBot(t *testing.T) {
+	f := newTickFixture(t, nil)
+	f.addBots(t, 4, 500, 1500)
+	bots := GetTravelBots(f.db)
+	// Part way through a tick, with a candidate whose latitude isn't a number.
+	broken := bots[0].ID
+	err := setTickState(f.db, broken, tickState{State: stateCandidates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.db.Exec(`INSERT INTO botpois (botid, osmid, latitude, longitude, visitype) values ($1, 1, 'north', 13.4, 'maybe');`, broken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastTick.Lock()
+	lastTick.at = time.Time{}
+	lastTick.Unlock()
+	ticked, failed, err := runTick(discardLogger(), f.db, f.cfg)
+	if err != nil {
+		t.Fatalf("tick failed: %v", err)
+	}
+	if len(failed) != 1 || !failed[broken] {
+		t.Errorf("bots %v failed, want just bot %d", failed, broken)
+	}
+	for _, b := range ticked {
+		if b.ID != broken && b.Tick.State != stateMoved {
+			t.Errorf("bot %d ended in state %s, want %s", b.ID, b.Tick.State, stateMoved)
+		}
+	}
+	if LastTick().IsZero() {
+		t.Error("the tick wasn't marked done")
+	}
+}
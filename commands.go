@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/alexalexyang/botschaft/botbehaviour"
+	"github.com/alexalexyang/botschaft/config"
+	"github.com/alexalexyang/botschaft/logging"
+	"github.com/alexalexyang/botschaft/models"
+)
+
+// A subcommand, like "bots list". run gets the arguments after its name, and parses them with fs, which
+// already has the config flags' usage set up.
+type command struct {
+	name string
+	// args: what comes after the flags, for the usage message.
+	args    string
+	summary string
+	run     func(fs *flag.FlagSet, args []string) error
+}
+
+// The subcommands, in the order help lists them. Set up in init, since help refers to them.
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "", "Run the web server and a travel tick every tickinterval. The default.", serve},
+		{"migrate", "", "Create every table and index that doesn't exist yet.", migrate},
+		{"seed", "", "Create demo users and bots.", seed},
+		{"tick", "", "Run one travel tick now and print what each bot did.", tick},
+		{"simulate", "<scenario.json>", "Run a scenario on a simulated clock, without the server or Overpass, and report on it.", simulate},
+		{"bots list", "", "List every bot.", listBots},
+		{"bots create", "", "Create a bot.", createBot},
+		{"bots move", "<id> <lat> <lon>", "Put a bot somewhere without it travelling there.", moveBot},
+		{"bots delete", "<id>...", "Delete bots and everything kept for them.", deleteBots},
+		{"bots import", "<file>", "Create bots for each point or polygon in a CSV or GeoJSON file.", importBots},
+		{"users password", "<id>", "Set a user's password to the first line of stdin.", setPassword},
+		{"import-osm", "<file.json>", "Load the amenity nodes in an Overpass JSON file, for poisource local.", importOSM},
+		{"export geojson", "", "Export bots, visited POIs and trails as GeoJSON.", exportGeoJSON},
+		{"export gpx", "", "Export bots' trails as GPX tracks.", exportGPX},
+		{"db vacuum", "", "Give back the space deleted rows took up.", vacuum},
+		{"db backup", "<path>", "Write a copy of the database to path while it's in use.", backup},
+		{"help", "", "List the commands.", help},
+	}
+}
+
+// Finds the command args start with. Arguments that start with a flag, or none, mean serve.
+func findCommand(args []string) (command, []string, error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return commands[0], args, nil
+	}
+	for _, c := range commands {
+		words := strings.Fields(c.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == c.name {
+			return c, args[len(words):], nil
+		}
+	}
+	return command{}, nil, errors.New("unknown command: " + strings.Join(args, " "))
+}
+
+func (c command) flagSet(output io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("botschaft "+c.name, flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.Usage = func() {
+		fmt.Fprintf(output, "usage: botschaft %s [flags] %s\n%s\n\nflags:\n", c.name, c.args, c.summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func printCommands(w io.Writer) {
+	fmt.Fprintln(w, "usage: botschaft <command> [flags] [args]")
+	fmt.Fprintln(w, "\ncommands:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", c.name, c.args, c.summary)
+	}
+	tw.Flush()
+	fmt.Fprintln(w, "\nRun botschaft <command> -h for a command's flags.")
+}
+
+func help(fs *flag.FlagSet, args []string) error {
+	printCommands(os.Stdout)
+	return nil
+}
+
+// What most commands need: the config, a logger, and the database with its tables made.
+type session struct {
+	cfg    config.Config
+	logger *slog.Logger
+	db     *sql.DB
+}
+
+// Loads the config from fs and args, opens the database and makes every table in it. Close s.db when done.
+func setup(fs *flag.FlagSet, args []string) (session, error) {
+	s := session{}
+	var err error
+	s.cfg, err = config.LoadFlags(fs, args)
+	if err != nil {
+		return s, err
+	}
+
+	s.logger, err = logging.New(os.Stderr, s.cfg.LogLevel, s.cfg.LogFormat)
+	if err != nil {
+		return s, err
+	}
+	slog.SetDefault(s.logger)
+
+	s.db, err = models.Open(s.cfg.Database)
+	if err != nil {
+		return s, err
+	}
+	// Workers wait for a free connection rather than piling more work onto the database.
+	s.db.SetMaxOpenConns(s.cfg.DBConnections)
+
+	err = models.CreateTables(s.db)
+	if err != nil {
+		s.db.Close()
+		return s, err
+	}
+	botbehaviour.Migrate(s.db)
+	return s, nil
+}
+
+// Checks there are n arguments after the flags.
+func wantArgs(fs *flag.FlagSet, n int) error {
+	if fs.NArg() != n {
+		return errors.New("wrong number of arguments; see " + fs.Name() + " -h")
+	}
+	return nil
+}
+
+// Writes data to path, or to stdout if path is empty.
+func writeOutput(path string, data []byte) error {
+	if path == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Parses a comma separated list of bot IDs like 1,2,3.
+func parseIDs(list string) ([]int, error) {
+	ids := []int{}
+	for _, id := range strings.Split(list, ",") {
+		if strings.TrimSpace(id) == "" {
+			continue
+		}
+		botID, err := strconv.Atoi(strings.TrimSpace(id))
+		if err != nil {
+			return nil, errors.New("bot ids must be a list like 1,2,3")
+		}
+		ids = append(ids, botID)
+	}
+	return ids, nil
+}
+
+func migrate(fs *flag.FlagSet, args []string) error {
+	s, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer s.db.Close()
+
+	// setup has already made every table.
+	fmt.Println(s.cfg.Database, "is up to date")
+	return nil
+}
+
+func seed(fs *flag.FlagSet, args []string) error {
+	demo := botbehaviour.DemoSeed{}
+	fs.IntVar(&demo.Users, "users", 2, "demo users to create")
+	fs.IntVar(&demo.BotsPerUser, "bots", 3, "bots to create for each user")
+	fs.StringVar(&demo.Type, "type", "travelbot", "the bots' type")
+	fs.Float64Var(&demo.Lat, "lat", 52.52, "latitude of the middle of where bots are put")
+	fs.Float64Var(&demo.Lon, "lon", 13.405, "longitude of the middle of where bots are put")
+	fs.Float64Var(&demo.Spread, "spread", 2000, "how far in metres from lat, lon bots are put")
+	fs.Float64Var(&demo.Radius, "radius", 0, "the bots' radius in metres (default defaultradius)")
+	fs.Int64Var(&demo.Seed, "seed", 1, "random seed for where bots are put")
+	s, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer s.db.Close()
+
+	if demo.Radius == 0 {
+		demo.Radius = s.cfg.DefaultRadius
+	}
+	seeded, err := botbehaviour.SeedDemo(s.db, demo)
+	fmt.Println("users:", joinIDs(seeded.UserIDs))
+	fmt.Println("bots:", joinIDs(seeded.BotIDs))
+	return err
+}
+
+func joinIDs(ids []int) string {
+	strs := []string{}
+	for _, id := range ids {
+		strs = append(strs, strconv.Itoa(id))
+	}
+	return strings.Join(strs, " ")
+}
+
+func tick(fs *flag.FlagSet, args []string) error {
+	s, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer s.db.Close()
+
+	report, err := botbehaviour.RunTick(s.logger, s.db, s.cfg)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSLOT\tFROM\tTO\tVISITED\tNOTE")
+	for _, b := range report.Bots {
+		note := ""
+		if b.Paused {
+			note = "paused"
+		} else if b.Failed {
+			note = "failed"
+		} else if b.Stuck {
+			note = "stuck"
+		}
+		visited := "-"
+		if b.Visited != 0 {
+			visited = "node/" + strconv.Itoa(b.Visited)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%.5f,%.5f\t%.5f,%.5f\t%s\t%s\n", b.ID, b.Name, b.Slot, b.From[0], b.From[1], b.To[0], b.To[1], visited, note)
+	}
+	tw.Flush()
+	fmt.Printf("%d bots in %s\n", len(report.Bots), report.Duration)
+	return nil
+}
+
+func simulate(fs *flag.FlagSet, args []string) error {
+	jsonPath := fs.String("json", "", "file to write the report to as JSON (default stdout)")
+	csvPath := fs.String("csv", "", "file to write a CSV row for each bot to")
+	keep := fs.String("keep", "", "path to keep the simulation's database at (default a temporary file)")
+	cfg, err := config.LoadFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if err = wantArgs(fs, 1); err != nil {
+		return err
+	}
+	logger, err := logging.New(os.Stderr, cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		return err
+	}
+
+	scenario, err := botbehaviour.LoadScenario(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	path := *keep
+	if path == "" {
+		dir, err := ioutil.TempDir("", "botschaft-simulation")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		path = filepath.Join(dir, "simulation.db")
+	} else if _, err := os.Stat(path); err == nil {
+		return errors.New(path + " already exists")
+	}
+	db, err := models.Open(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	report, err := botbehaviour.Simulate(logger, db, cfg, scenario)
+	if err != nil {
+		return err
+	}
+
+	reportJSON, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeOutput(*jsonPath, append(reportJSON, '\n'))
+	if err != nil || *csvPath == "" {
+		return err
+	}
+	f, err := os.Create(*csvPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return report.WriteCSV(f)
+}
+
+func listBots(fs *flag.FlagSet, args []string) error {
+	s, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer s.db.Close()
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSER\tNAME\tTYPE\tLOCATION\tRADIUS\tNOTE")
+	for _, b := range botbehaviour.ListBots(s.db) {
+		note := ""
+		if b.Paused {
+			note = "paused"
+		} else if b.Stuck {
+			note = "stuck"
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%.5f,%.5f\t%.0f\t%s\n", b.ID, b.UserID, b.Name, b.Type, b.Lat, b.Lon, b.Radius, note)
+	}
+	return tw.Flush()
+}
+
+func createBot(fs *flag.FlagSet, args []string) error {
+	nb := botbehaviour.NewBot{}
+	fs.IntVar(&nb.UserID, "user", 0, "the owner's user ID")
+	fs.StringVar(&nb.Name, "name", "", "the bot's name")
+	fs.Float64Var(&nb.Lat, "lat", 0, "latitude to start at")
+	fs.Float64Var(&nb.Lon, "lon", 0, "longitude to start at")
+	fs.Float64Var(&nb.Radius, "radius", 0, "search radius in metres (default defaultradius)")
+	fs.StringVar(&nb.Type, "type", "travelbot", "the bot's type")
+	categories := fs.String("categories", "", "comma separated amenities to look for instead of the routine's")
+	state := fs.String("state", "", `the type's settings as JSON, like {"budget": 5000}`)
+	s, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer s.db.Close()
+
+	if nb.Radius == 0 {
+		nb.Radius = s.cfg.DefaultRadius
+	}
+	for _, category := range strings.Split(*categories, ",") {
+		if strings.TrimSpace(category) != "" {
+			nb.Categories = append(nb.Categories, strings.TrimSpace(category))
+		}
+	}
+	if *state != "" {
+		nb.State = []byte(*state)
+	}
+
+	botID, err := botbehaviour.CreateBot(s.db, nb)
+	if err != nil {
+		return err
+	}
+	fmt.Println(botID)
+	return nil
+}
+
+func moveBot(fs *flag.FlagSet, args []string) error {
+	s, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer s.db.Close()
+	if err = wantArgs(fs, 3); err != nil {
+		return err
+	}
+
+	botID, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		return errors.New("bot id must be a number")
+	}
+	lat, errLat := strconv.ParseFloat(fs.Arg(1), 64)
+	lon, errLon := strconv.ParseFloat(fs.Arg(2), 64)
+	if errLat != nil || errLon != nil {
+		return errors.New("lat and lon must be numbers")
+	}
+	return botbehaviour.PlaceBot(s.db, botID, lat, lon)
+}
+
+func deleteBots(fs *flag.FlagSet, args []string) error {
+	s, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer s.db.Close()
+	if fs.NArg() == 0 {
+		return wantArgs(fs, 1)
+	}
+
+	for _, arg := range fs.Args() {
+		botID, err := strconv.Atoi(arg)
+		if err != nil {
+			return errors.New("bot id must be a number: " + arg)
+		}
+		ok, err := botbehaviour.DeleteBot(s.db, botID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("no bot with id " + arg)
+		}
+		fmt.Println("deleted", botID)
+	}
+	return nil
+}
+
+func importBots(fs *flag.FlagSet, args []string) error {
+	templatePath := fs.String("template", "", "JSON file saying what bots to make for each feature (default 1 travelbot)")
+	userID := fs.Int("user", 0, "the owner's user ID, instead of the template's")
+	randomSeed := fs.Int64("seed", 1, "random seed for where bots are put, and their types and personalities")
+	s, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer s.db.Close()
+	if err = wantArgs(fs, 1); err != nil {
+		return err
+	}
+
+	templateJSON := []byte{}
+	if *templatePath != "" {
+		templateJSON, err = ioutil.ReadFile(*templatePath)
+		if err != nil {
+			return err
+		}
+	}
+	template, err := botbehaviour.ParseSeedTemplate(templateJSON)
+	if err != nil {
+		return err
+	}
+	if *userID != 0 {
+		template.UserID = *userID
+	}
+	if template.Radius == 0 {
+		template.Radius = s.cfg.DefaultRadius
+	}
+	data, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	seeded, err := botbehaviour.BulkSeed(s.db, template, data, *randomSeed)
+	for _, f := range seeded {
+		fmt.Printf("%s: %s\n", f.Feature, joinIDs(f.BotIDs))
+	}
+	return err
+}
+
+func setPassword(fs *flag.FlagSet, args []string) error {
+	s, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer s.db.Close()
+	if err = wantArgs(fs, 1); err != nil {
+		return err
+	}
+	userID, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		return errors.New("user id must be a number")
+	}
+	if _, err = models.GetUser(s.db, userID); err == sql.ErrNoRows {
+		return errors.New("no user with id " + fs.Arg(0))
+	} else if err != nil {
+		return err
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	err = models.SetPassword(s.db, userID, strings.TrimRight(line, "\r\n"))
+	if err != nil {
+		return err
+	}
+	fmt.Println("set the password of user", userID)
+	return nil
+}
+
+func importOSM(fs *flag.FlagSet, args []string) error {
+	s, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer s.db.Close()
+	if err = wantArgs(fs, 1); err != nil {
+		return err
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	imported, err := botbehaviour.ImportOSM(s.db, f)
+	if err != nil {
+		return err
+	}
+	fmt.Println("imported", imported, "POIs")
+	return nil
+}
+
+func exportGeoJSON(fs *flag.FlagSet, args []string) error {
+	output := fs.String("o", "", "file to write to (default stdout)")
+	s, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer s.db.Close()
+
+	return writeOutput(*output, botbehaviour.ExportGeoJSON(s.db))
+}
+
+func exportGPX(fs *flag.FlagSet, args []string) error {
+	output := fs.String("o", "", "file to write to (default stdout)")
+	bots := fs.String("bots", "", "comma separated IDs of the bots to export (default all)")
+	s, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer s.db.Close()
+
+	botIDs, err := parseIDs(*bots)
+	if err != nil {
+		return err
+	}
+	return writeOutput(*output, botbehaviour.ExportGPX(s.db, botIDs))
+}
+
+func vacuum(fs *flag.FlagSet, args []string) error {
+	s, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer s.db.Close()
+
+	return models.Vacuum(s.db)
+}
+
+func backup(fs *flag.FlagSet, args []string) error {
+	s, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer s.db.Close()
+	if err = wantArgs(fs, 1); err != nil {
+		return err
+	}
+
+	err = models.Backup(s.db, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Println("backed up", s.cfg.Database, "to", fs.Arg(0))
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/alexalexyang/botschaft/botbehaviour"
+	"github.com/alexalexyang/botschaft/models"
+)
+
+func TestFindCommand(t *testing.T) {
+	cases := []struct {
+		args []string
+		name string
+		rest []string
+	}{
+		{[]string{}, "serve", []string{}},
+		{[]string{"-addr", ":9000"}, "serve", []string{"-addr", ":9000"}},
+		{[]string{"migrate"}, "migrate", []string{}},
+		{[]string{"bots", "list", "-database", "x.db"}, "bots list", []string{"-database", "x.db"}},
+		{[]string{"bots", "move", "1", "52.5", "13.4"}, "bots move", []string{"1", "52.5", "13.4"}},
+		{[]string{"export", "gpx", "-o", "trails.gpx"}, "export gpx", []string{"-o", "trails.gpx"}},
+	}
+	for _, c := range cases {
+		command, rest, err := findCommand(c.args)
+		if err != nil {
+			t.Errorf("%v: %v", c.args, err)
+			continue
+		}
+		if command.name != c.name || !reflect.DeepEqual(rest, c.rest) {
+			t.Errorf("%v is %q with %v, want %q with %v", c.args, command.name, rest, c.name, c.rest)
+		}
+	}
+
+	for _, args := range [][]string{{"bots"}, {"bots", "lis"}, {"list", "bots"}, {"serve-ish"}} {
+		if command, _, err := findCommand(args); err == nil {
+			t.Errorf("%v is %q, want an unknown command", args, command.name)
+		}
+	}
+}
+
+func TestParseIDs(t *testing.T) {
+	ids, err := parseIDs(" 1,2, 30,,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []int{1, 2, 30}) {
+		t.Errorf("got %v, want [1 2 30]", ids)
+	}
+	if ids, err := parseIDs(""); err != nil || len(ids) != 0 {
+		t.Errorf("an empty list is %v, %v, want no ids", ids, err)
+	}
+	if _, err := parseIDs("1,two"); err == nil {
+		t.Error("1,two was allowed")
+	}
+}
+
+// Runs a command the way main does, with its output thrown away, and returns its error.
+func run(t *testing.T, args ...string) error {
+	t.Helper()
+	c, rest, err := findCommand(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.run(c.flagSet(ioutil.Discard), rest)
+}
+
+// Commands take their flags before their arguments, and check how many arguments they got.
+func TestCommandArgs(t *testing.T) {
+	database := filepath.Join(t.TempDir(), "test.db")
+
+	err := run(t, "bots", "create", "-database", database, "-name", "Bot", "-lat", "52.5", "-lon", "13.4", "-radius", "1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run(t, "bots", "list", "-h"); err != flag.ErrHelp {
+		t.Errorf("-h gave %v, want flag.ErrHelp", err)
+	}
+	if err := run(t, "bots", "list", "-nosuchflag"); err == nil {
+		t.Error("an unknown flag was allowed")
+	}
+
+	bad := [][]string{
+		{"bots", "move", "-database", database, "1", "52.5"},
+		{"bots", "move", "-database", database, "one", "52.5", "13.4"},
+		{"bots", "move", "-database", database, "1", "north", "13.4"},
+		{"bots", "delete", "-database", database},
+		{"bots", "delete", "-database", database, "2"},
+		{"users", "password", "-database", database},
+		{"bots", "create", "-database", database, "-name", "Commuter", "-type", "commuter"},
+	}
+	for _, args := range bad {
+		if err := run(t, args...); err == nil {
+			t.Errorf("%v was allowed", args)
+		}
+	}
+
+	err = run(t, "bots", "move", "-database", database, "1", "48.1", "11.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = run(t, "bots", "delete", "-database", database, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := models.Open(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if bots := botbehaviour.ListBots(db); len(bots) != 0 {
+		t.Errorf("%d bots left, want none", len(bots))
+	}
+}
@@ -0,0 +1,360 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is everything botschaft can be set up with. Settings are read from, in increasing priority:
+// the defaults in Default(), a JSON config file, BOTSCHAFT_* environment variables, and command-line flags.
+type Config struct {
+	// Addr: where the web server listens.
+	Addr string `json:"addr"`
+	// Database: path to the SQLite database.
+	Database string `json:"database"`
+	// Views, Static: directories with the templates and the static files.
+	Views  string `json:"views"`
+	Static string `json:"static"`
+	// OverpassURL: the Overpass QL API interpreter endpoint.
+	OverpassURL string `json:"overpassurl"`
+	// OverpassTimeout: how long a query to OverpassURL can take, answer and all, before it's given up on.
+	OverpassTimeout Duration `json:"overpasstimeout"`
+	// POISource: where bots find POIs. "overpass" asks OverpassURL, "local" looks in the POIs loaded with import-osm.
+	POISource string `json:"poisource"`
+	// TickInterval: how long bots wait between travel ticks.
+	TickInterval Duration `json:"tickinterval"`
+	// DefaultRadius, MaxSearchRadius: in metres. New bots search within DefaultRadius, and
+	// bots that find nothing search wider and wider up to MaxSearchRadius.
+	DefaultRadius   float64 `json:"defaultradius"`
+	MaxSearchRadius float64 `json:"maxsearchradius"`
+	// Workers: how many bots are worked on at once in a tick. OverpassConcurrency: how many Overpass queries
+	// can be sent at once; other bots wait. DBConnections: the most database connections open at once.
+	Workers             int `json:"workers"`
+	OverpassConcurrency int `json:"overpassconcurrency"`
+	DBConnections       int `json:"dbconnections"`
+	// TileURL, TileAccessToken, TileAttribution: the background map tiles, in Leaflet's tileLayer format.
+	// Keep the access token out of committed files; set it with BOTSCHAFT_TILE_ACCESS_TOKEN.
+	TileURL         string `json:"tileurl"`
+	TileAccessToken string `json:"tileaccesstoken"`
+	TileAttribution string `json:"tileattribution"`
+	// Basemap: a local MBTiles file the background map is served from at /basemap/{z}/{x}/{y}, instead of TileURL.
+	Basemap string `json:"basemap"`
+	// SessionSecret: signs login cookies. If empty, a random one is made at startup and logins don't survive a restart.
+	// Keep it out of committed files; set it with BOTSCHAFT_SESSION_SECRET.
+	SessionSecret string `json:"sessionsecret"`
+	// Admins: the users who can change geofences for every bot.
+	Admins UserIDs `json:"admins"`
+	// LogLevel: debug, info, warn or error. LogFormat: text or json.
+	LogLevel  string `json:"loglevel"`
+	LogFormat string `json:"logformat"`
+}
+
+// Duration is a time.Duration written like "10s" or "30m" in the config file.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UserIDs is a list of user IDs, written like 1,2,3 in flags and environment variables.
+type UserIDs []int
+
+func (ids *UserIDs) String() string {
+	strs := []string{}
+	for _, id := range *ids {
+		strs = append(strs, strconv.Itoa(id))
+	}
+	return strings.Join(strs, ",")
+}
+
+func (ids *UserIDs) Set(list string) error {
+	*ids = UserIDs{}
+	for _, id := range strings.Split(list, ",") {
+		if strings.TrimSpace(id) == "" {
+			continue
+		}
+		userID, err := strconv.Atoi(strings.TrimSpace(id))
+		if err != nil {
+			return errors.New("user ids must be a list like 1,2,3")
+		}
+		*ids = append(*ids, userID)
+	}
+	return nil
+}
+
+// Contains says whether userID is in the list.
+func (ids UserIDs) Contains(userID int) bool {
+	for _, id := range ids {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// Default returns the settings botschaft uses when nothing else is set.
+func Default() Config {
+	return Config{
+		Addr:                ":3000",
+		Database:            "database.db",
+		Views:               "views",
+		Static:              "static",
+		OverpassURL:         "https://overpass-api.de/api/interpreter",
+		OverpassTimeout:     Duration{30 * time.Second},
+		POISource:           "overpass",
+		TickInterval:        Duration{10 * time.Second},
+		DefaultRadius:       1000,
+		MaxSearchRadius:     16000,
+		Workers:             4,
+		OverpassConcurrency: 2,
+		DBConnections:       4,
+		TileURL:             "https://{s}.tile.openstreetmap.org/{z}/{x}/{y}.png",
+		TileAttribution:     `Map data &copy; <a href="https://www.openstreetmap.org/">OpenStreetMap</a> contributors, <a href="https://creativecommons.org/licenses/by-sa/2.0/">CC-BY-SA</a>`,
+		LogLevel:            "info",
+		LogFormat:           "text",
+	}
+}
+
+// Finds -config in args before the flags are parsed, since the file has to be read first.
+func configPath(args []string) string {
+	for i, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if arg == name {
+			continue
+		}
+		if name == "config" && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(name, "config=") {
+			return strings.TrimPrefix(name, "config=")
+		}
+	}
+	return os.Getenv("BOTSCHAFT_CONFIG")
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(c)
+	if err != nil {
+		return errors.New(path + ": " + err.Error())
+	}
+	return nil
+}
+
+func (c *Config) loadEnv() error {
+	stringSettings := map[string]*string{
+		"BOTSCHAFT_ADDR":              &c.Addr,
+		"BOTSCHAFT_DATABASE":          &c.Database,
+		"BOTSCHAFT_VIEWS":             &c.Views,
+		"BOTSCHAFT_STATIC":            &c.Static,
+		"BOTSCHAFT_OVERPASS_URL":      &c.OverpassURL,
+		"BOTSCHAFT_POI_SOURCE":        &c.POISource,
+		"BOTSCHAFT_TILE_URL":          &c.TileURL,
+		"BOTSCHAFT_TILE_ACCESS_TOKEN": &c.TileAccessToken,
+		"BOTSCHAFT_TILE_ATTRIBUTION":  &c.TileAttribution,
+		"BOTSCHAFT_BASEMAP":           &c.Basemap,
+		"BOTSCHAFT_SESSION_SECRET":    &c.SessionSecret,
+		"BOTSCHAFT_LOG_LEVEL":         &c.LogLevel,
+		"BOTSCHAFT_LOG_FORMAT":        &c.LogFormat,
+	}
+	for name, setting := range stringSettings {
+		if value, ok := os.LookupEnv(name); ok {
+			*setting = value
+		}
+	}
+
+	floatSettings := map[string]*float64{
+		"BOTSCHAFT_DEFAULT_RADIUS":    &c.DefaultRadius,
+		"BOTSCHAFT_MAX_SEARCH_RADIUS": &c.MaxSearchRadius,
+	}
+	for name, setting := range floatSettings {
+		if value, ok := os.LookupEnv(name); ok {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return errors.New(name + " must be a number")
+			}
+			*setting = f
+		}
+	}
+
+	intSettings := map[string]*int{
+		"BOTSCHAFT_WORKERS":              &c.Workers,
+		"BOTSCHAFT_OVERPASS_CONCURRENCY": &c.OverpassConcurrency,
+		"BOTSCHAFT_DB_CONNECTIONS":       &c.DBConnections,
+	}
+	for name, setting := range intSettings {
+		if value, ok := os.LookupEnv(name); ok {
+			i, err := strconv.Atoi(value)
+			if err != nil {
+				return errors.New(name + " must be a whole number")
+			}
+			*setting = i
+		}
+	}
+
+	if value, ok := os.LookupEnv("BOTSCHAFT_ADMINS"); ok {
+		err := c.Admins.Set(value)
+		if err != nil {
+			return errors.New("BOTSCHAFT_ADMINS: " + err.Error())
+		}
+	}
+
+	durationSettings := map[string]*time.Duration{
+		"BOTSCHAFT_TICK_INTERVAL":    &c.TickInterval.Duration,
+		"BOTSCHAFT_OVERPASS_TIMEOUT": &c.OverpassTimeout.Duration,
+	}
+	for name, setting := range durationSettings {
+		if value, ok := os.LookupEnv(name); ok {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return errors.New(name + " must be a duration like 10s")
+			}
+			*setting = d
+		}
+	}
+	return nil
+}
+
+func (c *Config) addFlags(fs *flag.FlagSet) {
+	fs.String("config", "", "JSON config file (env BOTSCHAFT_CONFIG)")
+	fs.StringVar(&c.Addr, "addr", c.Addr, "address to listen on (env BOTSCHAFT_ADDR)")
+	fs.StringVar(&c.Database, "database", c.Database, "SQLite database path (env BOTSCHAFT_DATABASE)")
+	fs.StringVar(&c.Views, "views", c.Views, "templates directory (env BOTSCHAFT_VIEWS)")
+	fs.StringVar(&c.Static, "static", c.Static, "static files directory (env BOTSCHAFT_STATIC)")
+	fs.StringVar(&c.OverpassURL, "overpass-url", c.OverpassURL, "Overpass QL API interpreter URL (env BOTSCHAFT_OVERPASS_URL)")
+	fs.DurationVar(&c.OverpassTimeout.Duration, "overpass-timeout", c.OverpassTimeout.Duration, "how long an Overpass query can take (env BOTSCHAFT_OVERPASS_TIMEOUT)")
+	fs.StringVar(&c.POISource, "poi-source", c.POISource, "where bots find POIs: overpass or local (env BOTSCHAFT_POI_SOURCE)")
+	fs.DurationVar(&c.TickInterval.Duration, "tick-interval", c.TickInterval.Duration, "time between travel ticks (env BOTSCHAFT_TICK_INTERVAL)")
+	fs.Float64Var(&c.DefaultRadius, "default-radius", c.DefaultRadius, "search radius in metres for new bots (env BOTSCHAFT_DEFAULT_RADIUS)")
+	fs.Float64Var(&c.MaxSearchRadius, "max-search-radius", c.MaxSearchRadius, "largest search radius in metres before a bot is stuck (env BOTSCHAFT_MAX_SEARCH_RADIUS)")
+	fs.IntVar(&c.Workers, "workers", c.Workers, "bots worked on at once in a tick (env BOTSCHAFT_WORKERS)")
+	fs.IntVar(&c.OverpassConcurrency, "overpass-concurrency", c.OverpassConcurrency, "Overpass queries sent at once (env BOTSCHAFT_OVERPASS_CONCURRENCY)")
+	fs.IntVar(&c.DBConnections, "db-connections", c.DBConnections, "most database connections open at once (env BOTSCHAFT_DB_CONNECTIONS)")
+	fs.StringVar(&c.TileURL, "tile-url", c.TileURL, "map tile URL template (env BOTSCHAFT_TILE_URL)")
+	fs.StringVar(&c.TileAccessToken, "tile-access-token", c.TileAccessToken, "map tile access token (env BOTSCHAFT_TILE_ACCESS_TOKEN)")
+	fs.StringVar(&c.TileAttribution, "tile-attribution", c.TileAttribution, "map tile attribution HTML (env BOTSCHAFT_TILE_ATTRIBUTION)")
+	fs.StringVar(&c.Basemap, "basemap", c.Basemap, "MBTiles file to serve the background map from (env BOTSCHAFT_BASEMAP)")
+	fs.StringVar(&c.SessionSecret, "session-secret", c.SessionSecret, "secret for signing login cookies (env BOTSCHAFT_SESSION_SECRET)")
+	fs.Var(&c.Admins, "admins", "comma separated ids of users who can change every bot's geofences (env BOTSCHAFT_ADMINS)")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "log level: debug, info, warn or error (env BOTSCHAFT_LOG_LEVEL)")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log format: text or json (env BOTSCHAFT_LOG_FORMAT)")
+}
+
+// Load reads the config from the file named by -config or BOTSCHAFT_CONFIG, the environment and args, and validates it.
+// args are the command-line arguments without the program name. Returns flag.ErrHelp if -h was asked for.
+func Load(name string, args []string, output io.Writer) (Config, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(output)
+	return LoadFlags(fs, args)
+}
+
+// LoadFlags is Load with a flag set that may have flags of its own, like a subcommand's. Arguments after
+// the flags are left in fs.Args().
+func LoadFlags(fs *flag.FlagSet, args []string) (Config, error) {
+	c := Default()
+
+	path := configPath(args)
+	if path != "" {
+		err := c.loadFile(path)
+		if err != nil {
+			return c, err
+		}
+	}
+
+	err := c.loadEnv()
+	if err != nil {
+		return c, err
+	}
+
+	c.addFlags(fs)
+	err = fs.Parse(args)
+	if err != nil {
+		return c, err
+	}
+	return c, c.Validate()
+}
+
+// Validate checks every setting makes sense.
+func (c Config) Validate() error {
+	if c.Addr == "" {
+		return errors.New("addr can't be empty")
+	}
+	if c.Database == "" {
+		return errors.New("database can't be empty")
+	}
+	for _, dir := range []string{c.Views, c.Static} {
+		info, err := os.Stat(dir)
+		if err != nil || !info.IsDir() {
+			return errors.New(dir + " must be a directory")
+		}
+	}
+
+	u, err := url.Parse(c.OverpassURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("overpassurl must be an http or https URL")
+	}
+	if c.OverpassTimeout.Duration <= 0 {
+		return errors.New("overpasstimeout must be more than 0")
+	}
+	if c.POISource != "overpass" && c.POISource != "local" {
+		return errors.New("poisource must be overpass or local")
+	}
+
+	if c.TickInterval.Duration < time.Second {
+		return errors.New("tickinterval must be at least 1s")
+	}
+	if c.DefaultRadius <= 0 {
+		return errors.New("defaultradius must be more than 0")
+	}
+	if c.MaxSearchRadius < c.DefaultRadius {
+		return errors.New("maxsearchradius can't be less than defaultradius")
+	}
+	if c.Workers < 1 || c.OverpassConcurrency < 1 || c.DBConnections < 1 {
+		return errors.New("workers, overpassconcurrency and dbconnections must be at least 1")
+	}
+	if c.TileURL == "" {
+		return errors.New("tileurl can't be empty")
+	}
+	if c.Basemap != "" {
+		info, err := os.Stat(c.Basemap)
+		if err != nil || info.IsDir() {
+			return errors.New("basemap must be an MBTiles file")
+		}
+	}
+
+	var level slog.Level
+	if level.UnmarshalText([]byte(c.LogLevel)) != nil {
+		return errors.New("loglevel must be debug, info, warn or error")
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return errors.New("logformat must be text or json")
+	}
+	return nil
+}
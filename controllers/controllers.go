@@ -1,12 +1,26 @@
 package controllers
 
 import (
-	"fmt"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"html/template"
+	"io/ioutil"
 	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/alexalexyang/botschaft/basemap"
 	"github.com/alexalexyang/botschaft/botbehaviour"
+	"github.com/alexalexyang/botschaft/config"
+	"github.com/alexalexyang/botschaft/logging"
 	"github.com/alexalexyang/botschaft/models"
+	"github.com/alexalexyang/botschaft/mvt"
+	"github.com/gorilla/mux"
 )
 
 func check(err error) {
@@ -15,25 +29,643 @@ func check(err error) {
 	}
 }
 
+// Env is what the handlers need: the database, the config, and the basemap if one is configured.
+// Handlers are methods on it.
+type Env struct {
+	DB      *sql.DB
+	Config  config.Config
+	Basemap *basemap.MBTiles
+}
+
+// Parses templates from the views directory.
+func (env *Env) parseViews(names ...string) (*template.Template, error) {
+	paths := []string{}
+	for _, name := range names {
+		paths = append(paths, filepath.Join(env.Config.Views, name))
+	}
+	return template.ParseFiles(paths...)
+}
+
 // BotsTravel ---------------------------------------------------------------
 
-func BotsTravelHandler(w http.ResponseWriter, r *http.Request) {
-	t, err := template.ParseFiles("views/base.gohtml", "views/index.gohtml", "views/botbehaviour/travel.gohtml")
+// Data for the travel map template. The tile settings come from the config so tokens stay out of static files.
+// The bots and POIs are fetched by the page from /api/v1/map.
+// With a basemap, tiles come from /basemap instead, and TileVector is true if they're vector tiles.
+type travelPage struct {
+	TileURL         string
+	TileAccessToken string
+	TileAttribution string
+	TileVector      bool
+	TileMaxZoom     int
+}
+
+func (env *Env) BotsTravelHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := env.parseViews("base.gohtml", "index.gohtml", "botbehaviour/travel.gohtml")
+	check(err)
+
+	page := travelPage{
+		TileURL:         env.Config.TileURL,
+		TileAccessToken: env.Config.TileAccessToken,
+		TileAttribution: env.Config.TileAttribution,
+		TileMaxZoom:     18,
+	}
+	if env.Basemap != nil {
+		page.TileURL = "/basemap/{z}/{x}/{y}"
+		page.TileAccessToken = ""
+		page.TileVector = env.Basemap.Vector()
+		page.TileMaxZoom = env.Basemap.MaxZoom
+		if env.Basemap.Attribution != "" {
+			page.TileAttribution = env.Basemap.Attribution
+		}
+	}
+	t.ExecuteTemplate(w, "base", page)
+}
+
+// BasemapHandler returns a background map tile from the configured MBTiles file.
+func (env *Env) BasemapHandler(w http.ResponseWriter, r *http.Request) {
+	if env.Basemap == nil {
+		http.Error(w, "no basemap is configured", http.StatusNotFound)
+		return
+	}
+	vars := mux.Vars(r)
+	z, errZ := strconv.Atoi(vars["z"])
+	x, errX := strconv.Atoi(vars["x"])
+	y, errY := strconv.Atoi(vars["y"])
+	if err := firstError(errZ, errX, errY); err != nil {
+		http.Error(w, "z, x and y must be numbers", http.StatusBadRequest)
+		return
+	}
+
+	tile, gzipped, err := env.Basemap.Tile(z, x, y)
+	if err == basemap.ErrNoTile {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("reading basemap tile failed", "err", err)
+		http.Error(w, "reading the tile failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", env.Basemap.ContentType())
+	if gzipped {
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	// The file doesn't change while botschaft runs.
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(tile)
+}
+
+// MapHandler returns the bots and candidate POIs in ?bbox=west,south,east,north at ?zoom as JSON, with POIs
+// clustered when zoomed out. It sends an ETag, and 304 Not Modified if the page already has the same data.
+func (env *Env) MapHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := botbehaviour.ParseMapQuery(r.FormValue("bbox"), r.FormValue("zoom"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data := botbehaviour.GetMapData(env.DB, q)
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Whether an If-None-Match header has etag in it. Weak ETags match too.
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// HistoryHandler returns where bots were at each ?step from ?from to ?to, and what they visited, as JSON.
+// ?bots=1,2 limits it to some bots.
+func (env *Env) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := botbehaviour.ParseHistoryQuery(r.FormValue("from"), r.FormValue("to"), r.FormValue("step"), r.FormValue("bots"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(botbehaviour.GetHistory(env.DB, q))
+}
+
+// TileHandler returns the Mapbox Vector Tile at /tiles/{z}/{x}/{y}.mvt, with layers bots, candidates,
+// visited and trails.
+func (env *Env) TileHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	z, errZ := strconv.Atoi(vars["z"])
+	x, errX := strconv.Atoi(vars["x"])
+	y, errY := strconv.Atoi(vars["y"])
+	if err := firstError(errZ, errX, errY); err != nil {
+		http.Error(w, "z, x and y must be numbers", http.StatusBadRequest)
+		return
+	}
+	t, err := mvt.NewTile(z, x, y)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	w.Write(botbehaviour.GetTile(env.DB, t))
+}
+
+// DataGapsHandler returns the OSM completeness report for POIs found by bots as JSON.
+func (env *Env) DataGapsHandler(w http.ResponseWriter, r *http.Request) {
+	report := botbehaviour.GetDataGapReport(env.DB)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(report)
+}
+
+// MapRouletteHandler returns POIs with missing or suspicious tags as a MapRoulette challenge file.
+func (env *Env) MapRouletteHandler(w http.ResponseWriter, r *http.Request) {
+	challenge := botbehaviour.GetMapRouletteChallenge(env.DB)
+
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.Header().Set("Content-Disposition", `attachment; filename="botschaft-challenge.geojson"`)
+	w.Write(challenge)
+}
+
+// OSMNotesHandler returns POIs with missing or suspicious tags as OSM note drafts.
+func (env *Env) OSMNotesHandler(w http.ResponseWriter, r *http.Request) {
+	notes := botbehaviour.GetOSMNoteDrafts(env.DB)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(notes)
+}
+
+// StuckBotsHandler returns the bots that couldn't find any POIs even at the largest search radius as JSON.
+func (env *Env) StuckBotsHandler(w http.ResponseWriter, r *http.Request) {
+	stuck := botbehaviour.GetStuckBots(env.DB)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(stuck)
+}
+
+// PersonalityHandler gets a bot's personality on GET and replaces it on PUT. Only the bot's owner can replace it.
+func (env *Env) PersonalityHandler(w http.ResponseWriter, r *http.Request) {
+	botID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "bot id must be a number", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		if !env.checkOwner(w, r, botID) {
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		check(err)
+		defer r.Body.Close()
+
+		err = botbehaviour.SetPersonality(env.DB, botID, body)
+		if errors.Is(err, botbehaviour.ErrNoBot) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	personality, ok := botbehaviour.GetPersonality(env.DB, botID)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(personality)
+}
+
+// RoutineHandler gets a bot's home and daily routine on GET and changes them on PUT. Only the bot's owner can
+// change them.
+func (env *Env) RoutineHandler(w http.ResponseWriter, r *http.Request) {
+	botID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "bot id must be a number", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		if !env.checkOwner(w, r, botID) {
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		check(err)
+		defer r.Body.Close()
+
+		err = botbehaviour.SetRoutine(env.DB, botID, body)
+		if errors.Is(err, botbehaviour.ErrNoBot) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	routine, ok := botbehaviour.GetRoutine(env.DB, botID)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(routine)
+}
+
+// ProfileHandler returns a bot's public profile as JSON.
+func (env *Env) ProfileHandler(w http.ResponseWriter, r *http.Request) {
+	botID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "bot id must be a number", http.StatusBadRequest)
+		return
+	}
+	profile, ok := botbehaviour.GetProfile(env.DB, botID)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	profileJSON, err := json.Marshal(profile)
+	check(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(profileJSON)
+}
+
+// ProfilePageHandler shows a bot's public profile page at /bots/{id}.
+func (env *Env) ProfilePageHandler(w http.ResponseWriter, r *http.Request) {
+	botID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	profile, ok := botbehaviour.GetProfile(env.DB, botID)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	t, err := env.parseViews("base.gohtml", "botbehaviour/profile.gohtml")
 	check(err)
+	t.ExecuteTemplate(w, "base", profile)
+}
 
-	// Get travelbots - impt parts: bot, and its pois.
-	// Marshal into json.
-	// Test first with bot only without pois.
-	bots := botbehaviour.GetTravelPlans()
+// AchievementsHandler returns the badges a bot has been awarded.
+func (env *Env) AchievementsHandler(w http.ResponseWriter, r *http.Request) {
+	botID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "bot id must be a number", http.StatusBadRequest)
+		return
+	}
+	achievements, ok := botbehaviour.GetAchievements(env.DB, botID)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(achievements)
+}
 
-	t.ExecuteTemplate(w, "base", string(bots))
+// LeaderboardsHandler returns the leaderboards by distance, unique POIs and data gaps found.
+func (env *Env) LeaderboardsHandler(w http.ResponseWriter, r *http.Request) {
+	leaderboardsJSON, err := json.Marshal(botbehaviour.GetLeaderboards(env.DB))
+	check(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(leaderboardsJSON)
+}
+
+// LeaderboardsPageHandler shows the leaderboards.
+func (env *Env) LeaderboardsPageHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := env.parseViews("base.gohtml", "botbehaviour/leaderboards.gohtml")
+	check(err)
+	t.ExecuteTemplate(w, "base", botbehaviour.GetLeaderboards(env.DB))
+}
+
+// BotTypesHandler returns the bot types bots can be created with, and what each does, as JSON.
+func (env *Env) BotTypesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(botbehaviour.GetBotTypes())
+}
+
+// CreateBotAPIHandler creates a bot of any registered type for the logged in user from JSON like
+// {"name": "Ada", "lat": 52.52, "lon": 13.40, "type": "commuter", "state": {...}}, and returns its id.
+func (env *Env) CreateBotAPIHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := env.currentUser(r)
+	if !ok {
+		http.Error(w, "log in to create bots", http.StatusUnauthorized)
+		return
+	}
+
+	newBot := botbehaviour.NewBot{}
+	err := json.NewDecoder(r.Body).Decode(&newBot)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	newBot.UserID = userID
+	if newBot.Radius == 0 {
+		newBot.Radius = env.Config.DefaultRadius
+	}
+
+	botID, err := botbehaviour.CreateBot(env.DB, newBot)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	idJSON, err := json.Marshal(map[string]int{"id": botID})
+	check(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(idJSON)
+}
+
+// ImportBotsHandler creates bots for the logged in user from JSON like {"template": {"count": 3, "types":
+// {"travelbot": 2, "commuter": 1}}, "features": {GeoJSON}, "seed": 1}, where features can also be a CSV string,
+// and returns the new bots' ids by feature.
+func (env *Env) ImportBotsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := env.currentUser(r)
+	if !ok {
+		http.Error(w, "log in to create bots", http.StatusUnauthorized)
+		return
+	}
+
+	body := struct {
+		Template json.RawMessage `json:"template"`
+		Features json.RawMessage `json:"features"`
+		Seed     *int64          `json:"seed"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	seedTemplate, err := botbehaviour.ParseSeedTemplate(body.Template)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	seedTemplate.UserID = userID
+	if seedTemplate.Radius == 0 {
+		seedTemplate.Radius = env.Config.DefaultRadius
+	}
+	data := []byte(body.Features)
+	csv := ""
+	if json.Unmarshal(body.Features, &csv) == nil {
+		data = []byte(csv)
+	}
+	seed := time.Now().UnixNano()
+	if body.Seed != nil {
+		seed = *body.Seed
+	}
+
+	seeded, err := botbehaviour.BulkSeed(env.DB, seedTemplate, data, seed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string][]botbehaviour.SeededFeature{"features": seeded})
+}
+
+// BotHandler changes a bot on PATCH, from JSON like {"radius": 500, "home": {"lat": 52.52, "lon": 13.40},
+// "categories": ["cafe"], "paused": true}, and deletes it on DELETE. Only the bot's owner can do either.
+func (env *Env) BotHandler(w http.ResponseWriter, r *http.Request) {
+	botID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "bot id must be a number", http.StatusBadRequest)
+		return
+	}
+	if !env.checkOwner(w, r, botID) {
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		_, err = botbehaviour.DeleteBot(env.DB, botID)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("deleting bot", "bot_id", botID, "err", err)
+			http.Error(w, "couldn't delete bot", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	changes := botbehaviour.BotChanges{}
+	err = json.NewDecoder(r.Body).Decode(&changes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = botbehaviour.ChangeBot(env.DB, botID, changes)
+	if errors.Is(err, botbehaviour.ErrNoBot) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RatingsHandler returns the restaurants a foodcritic bot has rated as JSON.
+func (env *Env) RatingsHandler(w http.ResponseWriter, r *http.Request) {
+	botID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "bot id must be a number", http.StatusBadRequest)
+		return
+	}
+
+	ratings, ok := botbehaviour.GetRatings(env.DB, botID)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(ratings)
+}
+
+// TourHandler returns a surveyor bot's planned tour as JSON.
+func (env *Env) TourHandler(w http.ResponseWriter, r *http.Request) {
+	botID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "bot id must be a number", http.StatusBadRequest)
+		return
+	}
+
+	tour, ok := botbehaviour.GetTour(env.DB, botID)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(tour)
+}
+
+// GeofencesHandler returns every geofence as GeoJSON on GET. On POST it imports the polygons in a GeoJSON
+// body as fences for every bot, or for one bot on /api/bots/{id}/geofences. The kind and name query parameters
+// are used for features that don't have "kind" and "name" properties. Only admins can import fences for every
+// bot, and only a bot's owner fences for it.
+func (env *Env) GeofencesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/geo+json")
+		w.Write(botbehaviour.GetGeofences(env.DB))
+		return
+	}
+
+	botID := 0
+	if id, ok := mux.Vars(r)["id"]; ok {
+		var err error
+		botID, err = strconv.Atoi(id)
+		if err != nil {
+			http.Error(w, "bot id must be a number", http.StatusBadRequest)
+			return
+		}
+		if !env.checkOwner(w, r, botID) {
+			return
+		}
+	} else if !env.checkAdmin(w, r) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	check(err)
+	defer r.Body.Close()
+
+	ids, err := botbehaviour.ImportGeofences(env.DB, botID, r.FormValue("kind"), r.FormValue("name"), body)
+	if errors.Is(err, botbehaviour.ErrNoBot) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	idsJSON, err := json.Marshal(map[string][]int{"ids": ids})
+	check(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(idsJSON)
+}
+
+// DeleteGeofenceHandler deletes a geofence. Only admins can delete fences for every bot, and only a bot's
+// owner fences for it.
+func (env *Env) DeleteGeofenceHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "geofence id must be a number", http.StatusBadRequest)
+		return
+	}
+
+	botID, ok := botbehaviour.GeofenceBot(env.DB, id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if botID == 0 && !env.checkAdmin(w, r) {
+		return
+	}
+	if botID != 0 && !env.checkOwner(w, r, botID) {
+		return
+	}
+
+	if !botbehaviour.DeleteGeofence(env.DB, id) {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// EventsHandler returns a bot's latest events as JSON.
+func (env *Env) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	botID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "bot id must be a number", http.StatusBadRequest)
+		return
+	}
+
+	events, ok := botbehaviour.GetEvents(env.DB, botID)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(events)
+}
+
+// HealthzHandler reports whether the database is reachable and when the last travel tick succeeded.
+func (env *Env) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	health := botbehaviour.CheckHealth(env.DB, env.Config)
+	writeHealth(w, health, health.Database == "ok")
+}
+
+// ReadyzHandler is like HealthzHandler, but also fails if no travel tick has succeeded recently.
+func (env *Env) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	health := botbehaviour.CheckHealth(env.DB, env.Config)
+	writeHealth(w, health, health.Ready)
+}
+
+func writeHealth(w http.ResponseWriter, health botbehaviour.Health, ok bool) {
+	healthJSON, err := json.Marshal(health)
+	check(err)
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(healthJSON)
 }
 
 // CRUD handlers ---------------------------------------------------------------
 
-func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
+// Reads a form field as a number, with the field's name in the error if it isn't one.
+func formInt(r *http.Request, name string) (int, error) {
+	i, err := strconv.Atoi(r.FormValue(name))
+	if err != nil {
+		return 0, errors.New(name + " must be a whole number")
+	}
+	return i, nil
+}
+
+func formFloat(r *http.Request, name string) (float64, error) {
+	f, err := strconv.ParseFloat(r.FormValue(name), 64)
+	if err != nil {
+		return 0, errors.New(name + " must be a number")
+	}
+	return f, nil
+}
+
+// Returns the first error in errs, for checking several form fields at once.
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (env *Env) CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 
-	t, err := template.ParseFiles("views/base.gohtml", "views/crud/createuser.gohtml")
+	t, err := env.parseViews("base.gohtml", "crud/createuser.gohtml")
 	check(err)
 
 	if r.Method != http.MethodPost {
@@ -41,23 +673,34 @@ func CreateUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jsonMap := make(map[string]interface{})
-
-	jsonMap["UserID"] = r.FormValue("userid")
-	jsonMap["Name"] = r.FormValue("name")
-	jsonMap["Age"] = r.FormValue("age")
-	jsonMap["Gender"] = r.FormValue("gender")
-	jsonMap["City"] = r.FormValue("city")
-	jsonMap["Country"] = r.FormValue("country")
+	user := models.User{
+		Name:    r.FormValue("name"),
+		Gender:  r.FormValue("gender"),
+		City:    r.FormValue("city"),
+		Country: r.FormValue("country"),
+	}
+	var userIDErr, ageErr error
+	user.UserID, userIDErr = formInt(r, "userid")
+	user.Age, ageErr = formInt(r, "age")
+	err = firstError(userIDErr, ageErr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	models.CreateInserttoDB("users", jsonMap)
+	err = models.InsertUser(env.DB, user)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("creating user", "err", err)
+		http.Error(w, "couldn't create user", http.StatusInternalServerError)
+		return
+	}
 
-	http.Redirect(w, r, "http://localhost:3000", http.StatusSeeOther)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-func CreateBotHandler(w http.ResponseWriter, r *http.Request) {
+func (env *Env) CreateBotHandler(w http.ResponseWriter, r *http.Request) {
 
-	t, err := template.ParseFiles("views/base.gohtml", "views/crud/createbot.gohtml")
+	t, err := env.parseViews("base.gohtml", "crud/createbot.gohtml")
 	check(err)
 
 	if r.Method != http.MethodPost {
@@ -65,24 +708,37 @@ func CreateBotHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jsonMap := make(map[string]interface{})
+	bot := models.BotBaseProfile{Name: r.FormValue("name"), BotType: "travelbot"}
+	var userIDErr, botIDErr, latErr, lonErr error
+	bot.UserID, userIDErr = formInt(r, "userid")
+	bot.BotID, botIDErr = formInt(r, "botid")
+	bot.Lat, latErr = formFloat(r, "latitude")
+	bot.Lon, lonErr = formFloat(r, "longitude")
+	err = firstError(userIDErr, botIDErr, latErr, lonErr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	jsonMap["UserID"] = r.FormValue("userid")
-	jsonMap["BotID"] = r.FormValue("botid")
-	jsonMap["Name"] = r.FormValue("name")
-	jsonMap["Lat"] = r.FormValue("latitude")
-	jsonMap["Lon"] = r.FormValue("longitude")
-	jsonMap["Radius"] = 100
+	bot.Radius, err = formFloat(r, "radius")
+	if err != nil || bot.Radius <= 0 {
+		bot.Radius = env.Config.DefaultRadius
+	}
 
-	fmt.Println(jsonMap)
-	models.CreateInserttoDB("bots", jsonMap)
+	err = models.InsertBot(env.DB, bot)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("creating bot", "bot_id", bot.BotID, "err", err)
+		http.Error(w, "couldn't create bot", http.StatusInternalServerError)
+		return
+	}
+	botbehaviour.CreateRandomPersonality(env.DB, bot.BotID)
 
-	http.Redirect(w, r, "http://localhost:3000", http.StatusSeeOther)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
 
 }
 
-func CreateBotPoisHandler(w http.ResponseWriter, r *http.Request) {
-	t, err := template.ParseFiles("views/base.gohtml", "views/crud/createbotpois.gohtml")
+func (env *Env) CreateBotPoisHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := env.parseViews("base.gohtml", "crud/createbotpois.gohtml")
 	check(err)
 
 	if r.Method != http.MethodPost {
@@ -90,20 +746,27 @@ func CreateBotPoisHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	jsonMap := make(map[string]interface{})
-
-	jsonMap["bsid"] = r.FormValue("bsid")
-	jsonMap["osmid"] = r.FormValue("osmid")
-	jsonMap["botid"] = r.FormValue("botid")
-	jsonMap["latitude"] = r.FormValue("latitude")
-	jsonMap["longitude"] = r.FormValue("longitude")
-	// visitype typo
-	jsonMap["visitype"] = r.FormValue("visittype")
+	botPOI := models.BotPOIs{VisitType: r.FormValue("visittype")}
+	var bsidErr, osmidErr, botIDErr, latErr, lonErr error
+	botPOI.BSID, bsidErr = formInt(r, "bsid")
+	botPOI.OSMID, osmidErr = formInt(r, "osmid")
+	botPOI.BotID, botIDErr = formInt(r, "botid")
+	botPOI.Lat, latErr = formFloat(r, "latitude")
+	botPOI.Lon, lonErr = formFloat(r, "longitude")
+	err = firstError(bsidErr, osmidErr, botIDErr, latErr, lonErr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	fmt.Println(jsonMap)
-	models.CreateInserttoDB("botpois", jsonMap)
+	err = models.InsertBotPOI(env.DB, botPOI)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("creating bot POI", "bot_id", botPOI.BotID, "err", err)
+		http.Error(w, "couldn't create bot POI", http.StatusInternalServerError)
+		return
+	}
 
-	http.Redirect(w, r, "http://localhost:3000", http.StatusSeeOther)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
 
 }
 
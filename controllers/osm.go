@@ -21,7 +21,7 @@ type jsonStruct struct {
 }
 
 // Get data from Overpass QL API and put it into a *jsonStruct, to be formatted by formatPOIData().
-func getPOIs(bots map[string]models.BotBaseProfile) *jsonStruct {
+func getPOIs(overpassURL string, bots map[string]models.BotBaseProfile) *jsonStruct {
 
 	// Template string for part of query for each bot location.
 	pointTemplate := "node(around:{radius},{lat},{lon})[{poiKey}={poiValue}];"
@@ -48,8 +48,8 @@ func getPOIs(bots map[string]models.BotBaseProfile) *jsonStruct {
 	}
 
 	// Insert parts into main query.
-	link := "https://overpass-api.de/api/interpreter?data=[out:json];({buffer});out;"
-	replacements = strings.NewReplacer("{buffer}", buffer.String())
+	link := "{overpassURL}?data=[out:json];({buffer});out;"
+	replacements = strings.NewReplacer("{overpassURL}", overpassURL, "{buffer}", buffer.String())
 	query := replacements.Replace(link)
 
 	// Send a GET request to Overpass to get all POIs for all bot locations.
@@ -77,7 +77,7 @@ func formatPOIData(poiData *jsonStruct) map[models.LatLonStruct]map[string]strin
 	for _, item := range poiData.Elements {
 
 		// Key: struct of POI identifiers.
-		latlon := models.LatLonStruct{item["lat"].(float64), item["lon"].(float64), int(item["id"].(float64))}
+		latlon := models.LatLonStruct{Lat: item["lat"].(float64), Lon: item["lon"].(float64), ID: int(item["id"].(float64))}
 
 		// Value: map of POI tags.
 		tagsMap := make(map[string]string)
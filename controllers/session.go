@@ -0,0 +1,225 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alexalexyang/botschaft/botbehaviour"
+	"github.com/alexalexyang/botschaft/logging"
+	"github.com/alexalexyang/botschaft/models"
+)
+
+// Users stay logged in for this long.
+const sessionLength = 30 * 24 * time.Hour
+
+const sessionCookie = "botschaft_session"
+
+// Made once at startup if the config has no session secret.
+var randomSessionKey = func() []byte {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	check(err)
+	return key
+}()
+
+func (env *Env) sessionKey() []byte {
+	if env.Config.SessionSecret != "" {
+		return []byte(env.Config.SessionSecret)
+	}
+	return randomSessionKey
+}
+
+func (env *Env) sign(value string) string {
+	mac := hmac.New(sha256.New, env.sessionKey())
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sets a cookie saying who the user is, until when, signed so it can't be changed.
+func (env *Env) startSession(w http.ResponseWriter, userID int) {
+	expires := time.Now().Add(sessionLength)
+	value := strconv.Itoa(userID) + "." + strconv.FormatInt(expires.Unix(), 10)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value + "." + env.sign(value),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Returns the UserID of the logged in user. False if nobody is, or the cookie has expired or been changed.
+func (env *Env) currentUser(r *http.Request) (int, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return 0, false
+	}
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	value := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(env.sign(value))) {
+		return 0, false
+	}
+
+	userID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return 0, false
+	}
+	return userID, true
+}
+
+// Checks the logged in user owns the bot, and if not says why and returns false.
+func (env *Env) checkOwner(w http.ResponseWriter, r *http.Request, botID int) bool {
+	userID, ok := env.currentUser(r)
+	if !ok {
+		http.Error(w, "log in to change bots", http.StatusUnauthorized)
+		return false
+	}
+	owner, ok := botbehaviour.BotOwner(env.DB, botID)
+	if !ok {
+		http.NotFound(w, r)
+		return false
+	}
+	if owner != userID {
+		http.Error(w, "that's not your bot", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// Checks the logged in user is an admin, and if not says why and returns false.
+func (env *Env) checkAdmin(w http.ResponseWriter, r *http.Request) bool {
+	userID, ok := env.currentUser(r)
+	if !ok {
+		http.Error(w, "log in to change every bot's geofences", http.StatusUnauthorized)
+		return false
+	}
+	if !env.Config.Admins.Contains(userID) {
+		http.Error(w, "only admins can change every bot's geofences", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+type sessionUser struct {
+	UserID int    `json:"userid"`
+	Name   string `json:"name"`
+}
+
+// What login and signup take. The password is never sent back.
+type credentials struct {
+	UserID   int    `json:"userid"`
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	vJSON, err := json.Marshal(v)
+	check(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(vJSON)
+}
+
+// LoginHandler logs a user in from JSON like {"userid": 1, "password": "..."}.
+func (env *Env) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	login := credentials{}
+	err := json.NewDecoder(r.Body).Decode(&login)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ok, err := models.CheckPassword(env.DB, login.UserID, login.Password)
+	check(err)
+	if !ok {
+		http.Error(w, "wrong user id or password", http.StatusUnauthorized)
+		return
+	}
+	user, err := models.GetUser(env.DB, login.UserID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "wrong user id or password", http.StatusUnauthorized)
+		return
+	}
+	check(err)
+
+	env.startSession(w, user.UserID)
+	writeJSON(w, http.StatusOK, sessionUser{user.UserID, user.Name})
+}
+
+// SignupHandler creates a user from JSON like {"name": "Ada", "password": "..."} and logs them in. The new
+// user's id is in the response, and is what they log in with.
+func (env *Env) SignupHandler(w http.ResponseWriter, r *http.Request) {
+	signup := credentials{}
+	err := json.NewDecoder(r.Body).Decode(&signup)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if signup.Name == "" {
+		http.Error(w, "users need a name", http.StatusBadRequest)
+		return
+	}
+	if len(signup.Password) < models.MinPasswordLength || len(signup.Password) > models.MaxPasswordLength {
+		http.Error(w, models.ErrBadPassword.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// In one transaction, so there's never a user without the password they signed up with.
+	tx, err := env.DB.Begin()
+	check(err)
+	userID, err := models.CreateUser(tx, models.User{Name: signup.Name})
+	if err == nil {
+		err = models.SetPassword(tx, userID, signup.Password)
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("creating user", "err", err)
+		http.Error(w, "couldn't create user", http.StatusInternalServerError)
+		return
+	}
+
+	env.startSession(w, userID)
+	writeJSON(w, http.StatusCreated, sessionUser{userID, signup.Name})
+}
+
+// LogoutHandler logs the user out.
+func (env *Env) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MeHandler returns the logged in user as JSON, or 401 if nobody is logged in.
+func (env *Env) MeHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := env.currentUser(r)
+	if !ok {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		return
+	}
+	user, err := models.GetUser(env.DB, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		return
+	}
+	check(err)
+	writeJSON(w, http.StatusOK, sessionUser{user.UserID, user.Name})
+}
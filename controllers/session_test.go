@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexalexyang/botschaft/botbehaviour"
+	"github.com/alexalexyang/botschaft/config"
+	"github.com/alexalexyang/botschaft/models"
+	"github.com/gorilla/mux"
+)
+
+func testEnv(t *testing.T) (*Env, http.Handler) {
+	db, err := models.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = models.CreateTables(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	botbehaviour.Migrate(db)
+
+	cfg := config.Default()
+	cfg.SessionSecret = "test secret"
+	env := &Env{DB: db, Config: cfg}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/login", env.LoginHandler).Methods("POST")
+	router.HandleFunc("/api/signup", env.SignupHandler).Methods("POST")
+	router.HandleFunc("/api/me", env.MeHandler).Methods("GET")
+	router.HandleFunc("/api/bots/{id:[0-9]+}", env.BotHandler).Methods("PATCH", "DELETE")
+	return env, router
+}
+
+// Sends a request with the cookie, if there is one, and returns the response.
+func send(router http.Handler, method string, path string, body string, cookie *http.Cookie) *http.Response {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w.Result()
+}
+
+func sessionOf(t *testing.T, resp *http.Response) *http.Cookie {
+	t.Helper()
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookie {
+			return c
+		}
+	}
+	t.Fatalf("%s has no session cookie", resp.Status)
+	return nil
+}
+
+// Signs a user up and returns their id and session cookie.
+func signup(t *testing.T, router http.Handler, name string, password string) (int, *http.Cookie) {
+	t.Helper()
+	resp := send(router, "POST", "/api/signup", `{"name": "`+name+`", "password": "`+password+`"}`, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("signing up %s: %s", name, resp.Status)
+	}
+	user := sessionUser{}
+	err := json.NewDecoder(resp.Body).Decode(&user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user.UserID, sessionOf(t, resp)
+}
+
+// Signing up logs the user in, and only a cookie the server signed, that hasn't expired, keeps them logged in.
+func TestSession(t *testing.T) {
+	env, router := testEnv(t)
+
+	_, cookie := signup(t, router, "Ada", "correct horse")
+	if resp := send(router, "GET", "/api/me", "", cookie); resp.StatusCode != http.StatusOK {
+		t.Errorf("me after signing up: %s", resp.Status)
+	}
+	userID, ok := env.currentUser(httptest.NewRequest("GET", "/", nil))
+	if ok {
+		t.Errorf("user %d is logged in without a cookie", userID)
+	}
+
+	parts := strings.Split(cookie.Value, ".")
+	expired := parts[0] + "." + strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	bad := map[string]string{
+		"someone else's id": "2." + parts[1] + "." + parts[2],
+		"a later expiry":    parts[0] + "." + strconv.FormatInt(time.Now().Add(time.Hour*24*365).Unix(), 10) + "." + parts[2],
+		"no signature":      parts[0] + "." + parts[1],
+		"expired":           expired + "." + env.sign(expired),
+	}
+	for name, value := range bad {
+		c := &http.Cookie{Name: sessionCookie, Value: value}
+		if resp := send(router, "GET", "/api/me", "", c); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("me with %s: %s, want 401", name, resp.Status)
+		}
+	}
+
+	logins := []struct {
+		body   string
+		status int
+	}{
+		{`{"userid": 1, "password": "correct horse"}`, http.StatusOK},
+		{`{"userid": 1, "password": "wrong horse"}`, http.StatusUnauthorized},
+		{`{"userid": 2, "password": "correct horse"}`, http.StatusUnauthorized},
+		{`{"userid": 1}`, http.StatusUnauthorized},
+	}
+	for _, l := range logins {
+		if resp := send(router, "POST", "/api/login", l.body, nil); resp.StatusCode != l.status {
+			t.Errorf("logging in with %s: %s, want %d", l.body, resp.Status, l.status)
+		}
+	}
+}
+
+// Only a bot's owner can change or delete it.
+func TestCheckOwner(t *testing.T) {
+	env, router := testEnv(t)
+	ownerID, owner := signup(t, router, "Ada", "correct horse")
+	_, other := signup(t, router, "Grace", "battery staple")
+	botID, err := botbehaviour.CreateBot(env.DB, botbehaviour.NewBot{UserID: ownerID, Name: "Bot", Lat: 52.52, Lon: 13.4, Radius: 1000, Type: "travelbot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/api/bots/" + strconv.Itoa(botID)
+
+	requests := []struct {
+		method string
+		path   string
+		cookie *http.Cookie
+		status int
+	}{
+		{"PATCH", path, nil, http.StatusUnauthorized},
+		{"DELETE", path, nil, http.StatusUnauthorized},
+		{"PATCH", path, other, http.StatusForbidden},
+		{"DELETE", path, other, http.StatusForbidden},
+		{"DELETE", "/api/bots/" + strconv.Itoa(botID+1), owner, http.StatusNotFound},
+		{"PATCH", path, owner, http.StatusNoContent},
+		{"DELETE", path, owner, http.StatusNoContent},
+		{"DELETE", path, owner, http.StatusNotFound},
+	}
+	for _, req := range requests {
+		resp := send(router, req.method, req.path, `{"paused": true}`, req.cookie)
+		if resp.StatusCode != req.status {
+			t.Errorf("%s %s: %s, want %d", req.method, req.path, resp.Status, req.status)
+		}
+	}
+}
@@ -1,26 +1,108 @@
 package main
 
 import (
-	"log"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
 
+	"github.com/alexalexyang/botschaft/basemap"
 	"github.com/alexalexyang/botschaft/botbehaviour"
+	"github.com/alexalexyang/botschaft/config"
 	"github.com/alexalexyang/botschaft/controllers"
+	"github.com/alexalexyang/botschaft/logging"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// Runs the subcommand in the arguments, or serve if there isn't one. See commands.go.
 func main() {
-	go botbehaviour.GoTravel()
-	log.Fatal(http.ListenAndServe(":3000", initRouter()))
+	c, args, err := findCommand(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		printCommands(os.Stderr)
+		os.Exit(2)
+	}
+
+	err = c.run(c.flagSet(os.Stderr), args)
+	if err == flag.ErrHelp {
+		return
+	}
+	// Not log.Fatal: commands set the default logger, and errors shouldn't look like info.
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "botschaft:", err)
+		os.Exit(1)
+	}
 }
 
-func initRouter() *mux.Router {
+// Runs the web server, and a travel tick every cfg.TickInterval.
+func serve(fs *flag.FlagSet, args []string) error {
+	s, err := setup(fs, args)
+	if err != nil {
+		return err
+	}
+	defer s.db.Close()
+
+	var tiles *basemap.MBTiles
+	if s.cfg.Basemap != "" {
+		tiles, err = basemap.Open(s.cfg.Basemap)
+		if err != nil {
+			return err
+		}
+		defer tiles.Close()
+		s.logger.Info("serving basemap", "file", s.cfg.Basemap, "format", tiles.Format)
+	}
+
+	go botbehaviour.GoTravel(s.logger.With("component", "travel"), s.db, s.cfg)
+
+	s.logger.Info("listening", "addr", s.cfg.Addr)
+	return http.ListenAndServe(s.cfg.Addr, initRouter(s.logger.With("component", "http"), s.db, s.cfg, tiles))
+}
+
+func initRouter(logger *slog.Logger, db *sql.DB, cfg config.Config, tiles *basemap.MBTiles) *mux.Router {
+	env := &controllers.Env{DB: db, Config: cfg, Basemap: tiles}
+
 	router := mux.NewRouter()
-	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
-	router.HandleFunc("/", controllers.BotsTravelHandler)
-	// router.HandleFunc("/createuser", controllers.CreateUserHandler)
-	// router.HandleFunc("/createbot", controllers.CreateBotHandler)
-	// router.HandleFunc("/createbotpois", controllers.CreateBotPoisHandler)
+	router.Use(logging.Middleware(logger))
+	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir(cfg.Static))))
+	router.HandleFunc("/", env.BotsTravelHandler)
+	router.Handle("/metrics", promhttp.Handler())
+	router.HandleFunc("/bots/{id:[0-9]+}", env.ProfilePageHandler).Methods("GET")
+	router.HandleFunc("/leaderboards", env.LeaderboardsPageHandler).Methods("GET")
+	router.HandleFunc("/healthz", env.HealthzHandler)
+	router.HandleFunc("/readyz", env.ReadyzHandler)
+	router.HandleFunc("/api/v1/map", env.MapHandler).Methods("GET")
+	router.HandleFunc("/api/v1/history", env.HistoryHandler).Methods("GET")
+	router.HandleFunc("/tiles/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.mvt", env.TileHandler).Methods("GET")
+	router.HandleFunc("/basemap/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}", env.BasemapHandler).Methods("GET")
+	router.HandleFunc("/api/datagaps", env.DataGapsHandler).Methods("GET")
+	router.HandleFunc("/api/tasks/maproulette.geojson", env.MapRouletteHandler).Methods("GET")
+	router.HandleFunc("/api/tasks/notes", env.OSMNotesHandler).Methods("GET")
+	router.HandleFunc("/api/bottypes", env.BotTypesHandler).Methods("GET")
+	router.HandleFunc("/api/geofences", env.GeofencesHandler).Methods("GET", "POST")
+	router.HandleFunc("/api/geofences/{id}", env.DeleteGeofenceHandler).Methods("DELETE")
+	router.HandleFunc("/api/bots", env.CreateBotAPIHandler).Methods("POST")
+	router.HandleFunc("/api/bots/import", env.ImportBotsHandler).Methods("POST")
+	router.HandleFunc("/api/bots/stuck", env.StuckBotsHandler).Methods("GET")
+	router.HandleFunc("/api/bots/{id:[0-9]+}", env.BotHandler).Methods("PATCH", "DELETE")
+	router.HandleFunc("/api/login", env.LoginHandler).Methods("POST")
+	router.HandleFunc("/api/logout", env.LogoutHandler).Methods("POST")
+	router.HandleFunc("/api/signup", env.SignupHandler).Methods("POST")
+	router.HandleFunc("/api/me", env.MeHandler).Methods("GET")
+	router.HandleFunc("/api/bots/{id}/personality", env.PersonalityHandler).Methods("GET", "PUT")
+	router.HandleFunc("/api/bots/{id}/routine", env.RoutineHandler).Methods("GET", "PUT")
+	router.HandleFunc("/api/bots/{id}/ratings", env.RatingsHandler).Methods("GET")
+	router.HandleFunc("/api/bots/{id}/tour", env.TourHandler).Methods("GET")
+	router.HandleFunc("/api/bots/{id}/geofences", env.GeofencesHandler).Methods("POST")
+	router.HandleFunc("/api/bots/{id}/events", env.EventsHandler).Methods("GET")
+	router.HandleFunc("/api/bots/{id}/profile", env.ProfileHandler).Methods("GET")
+	router.HandleFunc("/api/bots/{id}/achievements", env.AchievementsHandler).Methods("GET")
+	router.HandleFunc("/api/v1/leaderboards", env.LeaderboardsHandler).Methods("GET")
+	// router.HandleFunc("/createuser", env.CreateUserHandler)
+	// router.HandleFunc("/createbot", env.CreateBotHandler)
+	// router.HandleFunc("/createbotpois", env.CreateBotPoisHandler)
 	// router.HandleFunc("/createentry", controllers.CreateHandler).Methods("POST")
 	return router
 }
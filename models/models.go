@@ -1,10 +1,9 @@
 package models
 
 import (
-	"bytes"
 	"database/sql"
-	"fmt"
-	"strings"
+	"errors"
+	"os"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -15,10 +14,10 @@ func check(err error) {
 	}
 }
 
-type userStruct struct {
-	ID      int
+type User struct {
+	UserID  int
 	Name    string
-	Age     string
+	Age     int
 	Gender  string
 	City    string
 	Country string
@@ -31,6 +30,8 @@ type BotBaseProfile struct {
 	Lat    float64
 	Lon    float64
 	Radius float64
+	// BotType: what the bot does, e.g. "travelbot".
+	BotType string
 }
 
 type BotPOIs struct {
@@ -75,90 +76,27 @@ type LatLonStruct struct {
 	ID  int
 }
 
-// PrepSQLValues processes incoming JSON and returns two []interfaces{}, one for its keys, and one for values.
-func PrepSQLValues(jsonBody map[string]interface{}) ([]interface{}, []interface{}) {
-
-	var columns []interface{}
-	var row []interface{}
-
-	for key, value := range jsonBody {
-		columns = append(columns, key)
-		row = append(row, value)
+// Open opens the SQLite database at path. Callers share the *sql.DB, so it waits for locks rather than failing straight away.
+// Transactions take the write lock when they begin, so two can't deadlock upgrading from reading to writing.
+func Open(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		return nil, err
 	}
-
-	return columns, row
+	return db, db.Ping()
 }
 
-// Concatenate the columns into a string suitable for an SQL statement.
-func concatColtoCreateTable(jsonBody map[string]interface{}) string {
-	var buffer bytes.Buffer
-	for k, v := range jsonBody {
-
-		var substring string
-		switch v.(type) {
-		case int:
-			fmt.Println("create int: ", v)
-			substring = k + ` INTEGER NULL,`
-		case float64:
-			if v == float64(int(v.(float64))) {
-				fmt.Println(" is defo an int.")
-				substring = k + ` INTEGER NULL,`
-			} else {
-				fmt.Println("create float64: ", v)
-				substring = k + ` REAL NULL,`
-			}
-		default:
-			fmt.Println("create string: ", v)
-			substring = k + ` TEXT NULL,`
-		}
-		buffer.WriteString(substring)
-	}
-	bufferString := buffer.String()[:len(buffer.String())-1]
-	return bufferString
+// Vacuum rebuilds the database to give back the space deleted rows took up.
+func Vacuum(db *sql.DB) error {
+	_, err := db.Exec(`VACUUM;`)
+	return err
 }
 
-// Concatenate the columns into a string suitable for an SQL statement.
-func concatColtoInsert(columns []interface{}) string {
-	fmt.Println("columns: ", columns)
-	var buffer bytes.Buffer
-	for _, item := range columns {
-		substring := item.(string) + ","
-		buffer.WriteString(substring)
+// Backup writes a consistent copy of the database to path while it's in use. path mustn't exist yet.
+func Backup(db *sql.DB, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return errors.New(path + " already exists")
 	}
-	bufferString := buffer.String()[:len(buffer.String())-1]
-	fmt.Println("bufferstring: ", bufferString)
-	return bufferString
-}
-
-// CreateInserttoDB takes in variable numbers of columns and row values to create and/or insert into a database.
-func CreateInserttoDB(tableName string, jsonBody map[string]interface{}) {
-
-	columns, row := PrepSQLValues(jsonBody)
-
-	db, err := sql.Open("sqlite3", "database.db")
-	check(err)
-
-	// Create table if not exists.
-	queryTemplate := `CREATE TABLE IF NOT EXISTS {tableName} ({buffer});`
-	buffer := concatColtoCreateTable(jsonBody)
-	replacements := strings.NewReplacer("{tableName}", tableName, "{buffer}", buffer)
-	query := replacements.Replace(queryTemplate)
-
-	stmt, err := db.Prepare(query)
-	_, err = stmt.Exec()
-
-	// Insert values.
-	buffer = concatColtoInsert(columns)
-
-	placeholders := strings.Repeat("?,", len(row))
-	placeholders = placeholders[:len(placeholders)-1]
-
-	queryTemplate = `INSERT INTO {tableName} ({buffer}) values ({placeholders});`
-	replacements = strings.NewReplacer("{tableName}", tableName, "{buffer}", buffer, "{placeholders}", placeholders)
-	query = replacements.Replace(queryTemplate)
-
-	stmt, err = db.Prepare(query)
-	_, err = stmt.Exec(row...)
-
-	db.Close()
+	_, err := db.Exec(`VACUUM INTO $1;`, path)
+	return err
 }
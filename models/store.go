@@ -0,0 +1,320 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrNotAllowed is returned for a table or column that isn't in the schema.
+var ErrNotAllowed = errors.New("not an allowed table or column")
+
+// DBTX is a *sql.DB or a *sql.Tx, so writes can be part of a caller's transaction.
+type DBTX interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// The tables the generic functions may write to, and their columns with types. This is the allow-list:
+// table and column names can't be passed as query parameters, so only names from here ever go into SQL.
+var schema = map[string]map[string]string{
+	"users": {
+		"UserID":  "INTEGER",
+		"Name":    "TEXT",
+		"Age":     "INTEGER",
+		"Gender":  "TEXT",
+		"City":    "TEXT",
+		"Country": "TEXT",
+	},
+	"bots": {
+		"UserID":  "INTEGER",
+		"BotID":   "INTEGER",
+		"Name":    "TEXT",
+		"Lat":     "REAL",
+		"Lon":     "REAL",
+		"Radius":  "INTEGER",
+		"bottype": "TEXT",
+	},
+	"botpois": {
+		"bsid":      "INTEGER",
+		"osmid":     "INTEGER",
+		"botid":     "INTEGER",
+		"latitude":  "REAL",
+		"longitude": "REAL",
+		"visitype":  "TEXT",
+	},
+	// Passwords are kept apart from users, hashed, so nothing that reads users can leak them.
+	"usercredentials": {
+		"UserID":       "INTEGER",
+		"PasswordHash": "TEXT",
+	},
+	"taginfo": {
+		"botid":            "INTEGER",
+		"osmid":            "TEXT",
+		"amenity":          "TEXT",
+		"name":             "TEXT",
+		"name_en":          "TEXT",
+		"addr_housenumber": "TEXT",
+		"addr_street":      "TEXT",
+		"opening_hours":    "TEXT",
+		"phone":            "TEXT",
+		"cuisine":          "TEXT",
+		"description":      "TEXT",
+		"internet_access":  "TEXT",
+		"smoking":          "TEXT",
+		"wheelchair":       "TEXT",
+	},
+}
+
+func sortedColumns(table string) []string {
+	columns := []string{}
+	for column := range schema[table] {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// Checks table and columns are in the schema, and returns them quoted for SQL.
+func allowed(table string, columns []string) (string, []string, error) {
+	tableColumns, ok := schema[table]
+	if !ok {
+		return "", nil, fmt.Errorf("%w: table %q", ErrNotAllowed, table)
+	}
+
+	quoted := []string{}
+	for _, column := range columns {
+		if _, ok := tableColumns[column]; !ok {
+			return "", nil, fmt.Errorf("%w: column %q in %s", ErrNotAllowed, column, table)
+		}
+		quoted = append(quoted, `"`+column+`"`)
+	}
+	return `"` + table + `"`, quoted, nil
+}
+
+// CreateTables creates the tables in the schema that don't exist yet. Existing tables are left alone.
+func CreateTables(db *sql.DB) error {
+	tables := []string{}
+	for table := range schema {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	for _, table := range tables {
+		definitions := []string{}
+		for _, column := range sortedColumns(table) {
+			definitions = append(definitions, `"`+column+`" `+schema[table][column]+` NULL`)
+		}
+		_, err := db.Exec(`CREATE TABLE IF NOT EXISTS "` + table + `" (` + strings.Join(definitions, ", ") + `);`)
+		if err != nil {
+			return fmt.Errorf("creating %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// Insert inserts a row of column names to values into table. Only tables and columns in the schema are allowed,
+// and values are always passed as parameters.
+func Insert(db DBTX, table string, row map[string]interface{}) error {
+	columns := []string{}
+	for column := range row {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	quotedTable, quotedColumns, err := allowed(table, columns)
+	if err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return errors.New("nothing to insert into " + table)
+	}
+
+	values := []interface{}{}
+	for _, column := range columns {
+		values = append(values, row[column])
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	query := `INSERT INTO ` + quotedTable + ` (` + strings.Join(quotedColumns, ", ") + `) VALUES (` + placeholders + `);`
+	_, err = db.Exec(query, values...)
+	return err
+}
+
+// Update sets columns to values in the rows of table where whereColumn is whereValue. Returns how many rows changed.
+func Update(db DBTX, table string, row map[string]interface{}, whereColumn string, whereValue interface{}) (int64, error) {
+	columns := []string{}
+	for column := range row {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	quotedTable, quotedColumns, err := allowed(table, append(columns, whereColumn))
+	if err != nil {
+		return 0, err
+	}
+	if len(columns) == 0 {
+		return 0, errors.New("nothing to update in " + table)
+	}
+
+	sets := []string{}
+	values := []interface{}{}
+	for i, column := range columns {
+		sets = append(sets, quotedColumns[i]+` = ?`)
+		values = append(values, row[column])
+	}
+	values = append(values, whereValue)
+
+	query := `UPDATE ` + quotedTable + ` SET ` + strings.Join(sets, ", ") + ` WHERE ` + quotedColumns[len(columns)] + ` = ?;`
+	result, err := db.Exec(query, values...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Users ---------------------------------------------------------------
+
+func (u User) row() map[string]interface{} {
+	return map[string]interface{}{
+		"UserID":  u.UserID,
+		"Name":    u.Name,
+		"Age":     u.Age,
+		"Gender":  u.Gender,
+		"City":    u.City,
+		"Country": u.Country,
+	}
+}
+
+// InsertUser saves a new user.
+func InsertUser(db DBTX, u User) error {
+	return Insert(db, "users", u.row())
+}
+
+// CreateUser saves a new user with the next free UserID, and returns the ID.
+func CreateUser(db DBTX, u User) (int, error) {
+	// Older databases have TEXT ids, which MAX would compare as text, so "9" after "10".
+	err := db.QueryRow(`SELECT COALESCE(MAX(CAST(UserID AS INTEGER)), 0) + 1 FROM users;`).Scan(&u.UserID)
+	if err != nil {
+		return 0, err
+	}
+	return u.UserID, InsertUser(db, u)
+}
+
+// GetUser gets the user with userID. Returns sql.ErrNoRows if there is no such user.
+func GetUser(db DBTX, userID int) (User, error) {
+	u := User{UserID: userID}
+	err := db.QueryRow(`SELECT COALESCE(Name, ''), COALESCE(Age, 0), COALESCE(Gender, ''), COALESCE(City, ''), COALESCE(Country, '') FROM users WHERE UserID=$1;`, userID).
+		Scan(&u.Name, &u.Age, &u.Gender, &u.City, &u.Country)
+	return u, err
+}
+
+// UpdateUser saves changes to the user with u's UserID. Returns sql.ErrNoRows if there is no such user.
+func UpdateUser(db DBTX, u User) error {
+	changed, err := Update(db, "users", u.row(), "UserID", u.UserID)
+	if err == nil && changed == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+// Passwords need to be this long. bcrypt ignores anything after 72 bytes, so longer ones aren't allowed.
+const (
+	MinPasswordLength = 8
+	MaxPasswordLength = 72
+)
+
+// ErrBadPassword is returned for a password that's too short or too long.
+var ErrBadPassword = fmt.Errorf("passwords must be %d to %d bytes long", MinPasswordLength, MaxPasswordLength)
+
+// SetPassword sets the password of the user with userID, replacing any they had. Only a bcrypt hash of it is kept.
+func SetPassword(db DBTX, userID int, password string) error {
+	if len(password) < MinPasswordLength || len(password) > MaxPasswordLength {
+		return ErrBadPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`DELETE FROM usercredentials WHERE UserID=$1;`, userID)
+	if err != nil {
+		return err
+	}
+	return Insert(db, "usercredentials", map[string]interface{}{"UserID": userID, "PasswordHash": string(hash)})
+}
+
+// CheckPassword says whether password is the password of the user with userID. Users without a password,
+// like demo users, can't log in until they're given one.
+func CheckPassword(db DBTX, userID int, password string) (bool, error) {
+	var hash string
+	err := db.QueryRow(`SELECT COALESCE(PasswordHash, '') FROM usercredentials WHERE UserID=$1;`, userID).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Bots ---------------------------------------------------------------
+
+func (b BotBaseProfile) row() map[string]interface{} {
+	return map[string]interface{}{
+		"UserID":  b.UserID,
+		"BotID":   b.BotID,
+		"Name":    b.Name,
+		"Lat":     b.Lat,
+		"Lon":     b.Lon,
+		"Radius":  b.Radius,
+		"bottype": b.BotType,
+	}
+}
+
+// InsertBot saves a new bot.
+func InsertBot(db DBTX, b BotBaseProfile) error {
+	return Insert(db, "bots", b.row())
+}
+
+// CreateBot saves a new bot with the next free BotID, and returns the ID. Use it in a transaction so two bots
+// created at once can't get the same ID.
+func CreateBot(db DBTX, b BotBaseProfile) (int, error) {
+	// As in CreateUser, older databases' ids are TEXT.
+	err := db.QueryRow(`SELECT COALESCE(MAX(CAST(BotID AS INTEGER)), 0) + 1 FROM bots;`).Scan(&b.BotID)
+	if err != nil {
+		return 0, err
+	}
+	return b.BotID, InsertBot(db, b)
+}
+
+// UpdateBot saves changes to the bot with b's BotID. Returns sql.ErrNoRows if there is no such bot.
+func UpdateBot(db DBTX, b BotBaseProfile) error {
+	changed, err := Update(db, "bots", b.row(), "BotID", b.BotID)
+	if err == nil && changed == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+// Bot POIs ---------------------------------------------------------------
+
+// InsertBotPOI saves a POI a bot might visit or has visited.
+func InsertBotPOI(db DBTX, p BotPOIs) error {
+	return Insert(db, "botpois", map[string]interface{}{
+		"bsid":      p.BSID,
+		"osmid":     p.OSMID,
+		"botid":     p.BotID,
+		"latitude":  p.Lat,
+		"longitude": p.Lon,
+		"visitype":  p.VisitType,
+	})
+}
@@ -0,0 +1,234 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// Names that would change the statement if they went into SQL as they are.
+var hostileNames = []string{
+	"name; DROP TABLE bots--",
+	`Name" TEXT); DROP TABLE users; --`,
+	`"Name"`,
+	"`Name`",
+	"[Name]",
+	"Name = 1 OR 1=1",
+	"name",
+	"",
+}
+
+func testDB(t *testing.T) *sql.DB {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = CreateTables(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// Opens a copy of the database.db shipped with the repo, whose tables are older and keep ids and coordinates as TEXT.
+func shippedDB(t *testing.T) *sql.DB {
+	shipped, err := ioutil.ReadFile(filepath.Join("..", "database.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "database.db")
+	err = ioutil.WriteFile(path, shipped, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// Fails the test if any of the schema's tables has gone.
+func checkTables(t *testing.T, db *sql.DB) {
+	t.Helper()
+	for table := range schema {
+		var n int
+		err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name=$1;`, table).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("table %s is gone", table)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	table, columns, err := allowed("users", []string{"Name", "UserID"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table != `"users"` || len(columns) != 2 || columns[0] != `"Name"` || columns[1] != `"UserID"` {
+		t.Errorf("got %s %v, want \"users\" [\"Name\" \"UserID\"]", table, columns)
+	}
+
+	for _, name := range hostileNames {
+		_, _, err := allowed(name, nil)
+		if !errors.Is(err, ErrNotAllowed) {
+			t.Errorf("table %q: got %v, want ErrNotAllowed", name, err)
+		}
+		_, _, err = allowed("users", []string{"UserID", name})
+		if !errors.Is(err, ErrNotAllowed) {
+			t.Errorf("column %q: got %v, want ErrNotAllowed", name, err)
+		}
+	}
+}
+
+func TestInsertRejectsNames(t *testing.T) {
+	db := testDB(t)
+
+	for _, name := range hostileNames {
+		err := Insert(db, name, map[string]interface{}{"Name": "Ada"})
+		if !errors.Is(err, ErrNotAllowed) {
+			t.Errorf("table %q: got %v, want ErrNotAllowed", name, err)
+		}
+		err = Insert(db, "users", map[string]interface{}{"UserID": 1, name: "Ada"})
+		if !errors.Is(err, ErrNotAllowed) {
+			t.Errorf("column %q: got %v, want ErrNotAllowed", name, err)
+		}
+	}
+	checkTables(t, db)
+
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM users;`).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d users were inserted, want none", n)
+	}
+}
+
+func TestUpdateRejectsNames(t *testing.T) {
+	db := testDB(t)
+	err := InsertUser(db, User{UserID: 1, Name: "Ada"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range hostileNames {
+		_, err := Update(db, name, map[string]interface{}{"Name": "Bob"}, "UserID", 1)
+		if !errors.Is(err, ErrNotAllowed) {
+			t.Errorf("table %q: got %v, want ErrNotAllowed", name, err)
+		}
+		_, err = Update(db, "users", map[string]interface{}{name: "Bob"}, "UserID", 1)
+		if !errors.Is(err, ErrNotAllowed) {
+			t.Errorf("column %q: got %v, want ErrNotAllowed", name, err)
+		}
+		_, err = Update(db, "users", map[string]interface{}{"Name": "Bob"}, name, 1)
+		if !errors.Is(err, ErrNotAllowed) {
+			t.Errorf("where column %q: got %v, want ErrNotAllowed", name, err)
+		}
+	}
+	checkTables(t, db)
+
+	u, err := GetUser(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "Ada" {
+		t.Errorf("name changed to %q", u.Name)
+	}
+}
+
+func TestValuesAreParameters(t *testing.T) {
+	db := testDB(t)
+	values := []string{
+		"Robert'); DROP TABLE users; --",
+		`Ada" WHERE 1=1; --`,
+		"?",
+		"$1",
+		"",
+	}
+
+	for i, value := range values {
+		userID := i + 1
+		err := InsertUser(db, User{UserID: userID, Name: value, City: value})
+		if err != nil {
+			t.Fatalf("inserting %q: %v", value, err)
+		}
+		u, err := GetUser(db, userID)
+		if err != nil {
+			t.Fatalf("getting %q: %v", value, err)
+		}
+		if u.Name != value || u.City != value {
+			t.Errorf("inserted %q, got name %q and city %q", value, u.Name, u.City)
+		}
+	}
+	checkTables(t, db)
+
+	// Only the row whose UserID is the where value changes, even when it looks like SQL.
+	changed, err := Update(db, "users", map[string]interface{}{"Country": "1 OR 1=1"}, "UserID", "1 OR 1=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed != 0 {
+		t.Errorf("a where value of \"1 OR 1=1\" changed %d rows, want 0", changed)
+	}
+	err = UpdateUser(db, User{UserID: 2, Name: "'; DELETE FROM users; --"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := GetUser(db, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "'; DELETE FROM users; --" {
+		t.Errorf("got name %q", u.Name)
+	}
+
+	var n int
+	err = db.QueryRow(`SELECT COUNT(*) FROM users;`).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(values) {
+		t.Errorf("%d users, want %d", n, len(values))
+	}
+}
+
+// New ids follow the biggest one as a number, in new databases and in the shipped one with TEXT ids.
+func TestCreateIDs(t *testing.T) {
+	for name, db := range map[string]*sql.DB{"new": testDB(t), "shipped": shippedDB(t)} {
+		var users, bots int
+		err := db.QueryRow(`SELECT COALESCE(MAX(CAST(UserID AS INTEGER)), 0) FROM users;`).Scan(&users)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.QueryRow(`SELECT COALESCE(MAX(CAST(BotID AS INTEGER)), 0) FROM bots;`).Scan(&bots)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 1; i <= 3; i++ {
+			userID, err := CreateUser(db, User{Name: "Ada"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if userID != users+i {
+				t.Errorf("%s: user %d got id %d, want %d", name, i, userID, users+i)
+			}
+			botID, err := CreateBot(db, BotBaseProfile{UserID: userID, Name: "Bot", Lat: 52.52, Lon: 13.4, Radius: 1000, BotType: "travelbot"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if botID != bots+i {
+				t.Errorf("%s: bot %d got id %d, want %d", name, i, botID, bots+i)
+			}
+		}
+	}
+}
@@ -0,0 +1,324 @@
+// Package mvt encodes Mapbox Vector Tiles, version 2.1: https://github.com/mapbox/vector-tile-spec
+// It only does what botschaft needs: points and lines with properties, in Web Mercator tiles.
+package mvt
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Extent: tile coordinates go from 0 to Extent across a tile.
+const Extent = 4096
+
+// Buffer: how far past a tile's edges, in tile coordinates, features are kept so they aren't cut off
+// where tiles meet.
+const Buffer = 64
+
+// MaxZoom is the highest zoom tiles are made for.
+const MaxZoom = 22
+
+// Tile is a tile in the XYZ scheme Leaflet uses, with Y counted from the north.
+type Tile struct {
+	Z, X, Y int
+}
+
+// NewTile checks z, x and y are a tile that exists.
+func NewTile(z int, x int, y int) (Tile, error) {
+	if z < 0 || z > MaxZoom {
+		return Tile{}, errors.New("zoom must be from 0 to " + strconv.Itoa(MaxZoom))
+	}
+	n := 1 << uint(z)
+	if x < 0 || x >= n || y < 0 || y >= n {
+		return Tile{}, errors.New("x and y must be from 0 to " + strconv.Itoa(n-1) + " at zoom " + strconv.Itoa(z))
+	}
+	return Tile{z, x, y}, nil
+}
+
+// Web Mercator x and y from 0 to 1 across the world.
+func project(lat float64, lon float64) (float64, float64) {
+	lat = math.Max(math.Min(lat, 85.0511), -85.0511)
+	x := (lon + 180) / 360
+	sin := math.Sin(lat * math.Pi / 180)
+	y := 0.5 - math.Log((1+sin)/(1-sin))/(4*math.Pi)
+	return x, y
+}
+
+func unproject(x float64, y float64) (float64, float64) {
+	lon := x*360 - 180
+	lat := math.Atan(math.Sinh(math.Pi*(1-2*y))) * 180 / math.Pi
+	return lat, lon
+}
+
+// Point returns where lat, lon is in the tile's coordinates. Points outside the tile are outside 0 to Extent.
+func (t Tile) Point(lat float64, lon float64) [2]float64 {
+	x, y := project(lat, lon)
+	n := math.Exp2(float64(t.Z))
+	return [2]float64{(x*n - float64(t.X)) * Extent, (y*n - float64(t.Y)) * Extent}
+}
+
+// Bounds returns the tile's south, west, north and east edges in degrees, widened by Buffer.
+func (t Tile) Bounds() (float64, float64, float64, float64) {
+	n := math.Exp2(float64(t.Z))
+	margin := float64(Buffer) / Extent
+	north, west := unproject((float64(t.X)-margin)/n, (float64(t.Y)-margin)/n)
+	south, east := unproject((float64(t.X)+1+margin)/n, (float64(t.Y)+1+margin)/n)
+	return south, math.Max(west, -180), north, math.Min(east, 180)
+}
+
+// Inside is whether a point in tile coordinates is within the tile and its buffer.
+func Inside(p [2]float64) bool {
+	return p[0] >= -Buffer && p[0] <= Extent+Buffer && p[1] >= -Buffer && p[1] <= Extent+Buffer
+}
+
+// ClipLine cuts the line from a to b, in tile coordinates, to the tile and its buffer with Liang-Barsky.
+// Returns false if none of it is in the tile.
+func ClipLine(a [2]float64, b [2]float64) ([2]float64, [2]float64, bool) {
+	low, high := 0.0, 1.0
+	d := [2]float64{b[0] - a[0], b[1] - a[1]}
+	for axis := 0; axis < 2; axis++ {
+		for _, edge := range []struct{ p, q float64 }{
+			{-d[axis], a[axis] + Buffer},
+			{d[axis], Extent + Buffer - a[axis]},
+		} {
+			if edge.p == 0 {
+				if edge.q < 0 {
+					return a, b, false
+				}
+				continue
+			}
+			r := edge.q / edge.p
+			if edge.p < 0 && r > low {
+				low = r
+			} else if edge.p > 0 && r < high {
+				high = r
+			}
+			if low > high {
+				return a, b, false
+			}
+		}
+	}
+	return [2]float64{a[0] + low*d[0], a[1] + low*d[1]}, [2]float64{a[0] + high*d[0], a[1] + high*d[1]}, true
+}
+
+// GeometryType is what kind of geometry a feature has.
+type GeometryType int
+
+// The geometry types botschaft uses. Polygons aren't supported.
+const (
+	Point      GeometryType = 1
+	LineString GeometryType = 2
+)
+
+// Feature is a point or a set of lines in tile coordinates.
+type Feature struct {
+	ID   uint64
+	Type GeometryType
+	// Geometry: for a Point, one part with one or more points. For a LineString, one part per line,
+	// each with two or more points.
+	Geometry [][][2]float64
+	// Properties: values can be strings, ints, float64s or bools.
+	Properties map[string]interface{}
+}
+
+// Layer is a named set of features.
+type Layer struct {
+	Name     string
+	Features []Feature
+}
+
+// Protocol buffer wire types.
+const (
+	wireVarint = 0
+	wire64bit  = 1
+	wireBytes  = 2
+)
+
+type buffer []byte
+
+func (b *buffer) varint(v uint64) {
+	for v >= 0x80 {
+		*b = append(*b, byte(v)|0x80)
+		v >>= 7
+	}
+	*b = append(*b, byte(v))
+}
+
+func (b *buffer) key(field int, wire int) {
+	b.varint(uint64(field<<3 | wire))
+}
+
+func (b *buffer) bytes(field int, v []byte) {
+	b.key(field, wireBytes)
+	b.varint(uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *buffer) uint(field int, v uint64) {
+	b.key(field, wireVarint)
+	b.varint(v)
+}
+
+func (b *buffer) packed(field int, vs []uint32) {
+	packed := buffer{}
+	for _, v := range vs {
+		packed.varint(uint64(v))
+	}
+	b.bytes(field, packed)
+}
+
+func zigzag(v int32) uint32 {
+	return uint32((v << 1) ^ (v >> 31))
+}
+
+func command(id uint32, count int) uint32 {
+	return id&0x7 | uint32(count)<<3
+}
+
+// Encodes the geometry as MoveTo and LineTo commands, with each point relative to the one before.
+func (f Feature) commands() []uint32 {
+	commands := []uint32{}
+	var x, y int32
+	moveTo := func(points [][2]float64) {
+		commands = append(commands, command(1, len(points)))
+		for _, p := range points {
+			px, py := int32(math.Round(p[0])), int32(math.Round(p[1]))
+			commands = append(commands, zigzag(px-x), zigzag(py-y))
+			x, y = px, py
+		}
+	}
+
+	for _, part := range f.Geometry {
+		if len(part) == 0 {
+			continue
+		}
+		if f.Type == Point {
+			moveTo(part)
+			continue
+		}
+		if len(part) < 2 {
+			continue
+		}
+		lastX, lastY := x, y
+		moveTo(part[:1])
+		start := len(commands)
+		commands = append(commands, 0)
+		count := 0
+		for _, p := range part[1:] {
+			px, py := int32(math.Round(p[0])), int32(math.Round(p[1]))
+			if px == x && py == y {
+				continue
+			}
+			commands = append(commands, zigzag(px-x), zigzag(py-y))
+			x, y = px, py
+			count++
+		}
+		if count == 0 {
+			// The line rounds to a single point, so there's nothing to draw.
+			commands = commands[:start-3]
+			x, y = lastX, lastY
+			continue
+		}
+		commands[start] = command(2, count)
+	}
+	return commands
+}
+
+// Encodes a property value as a Value message.
+func value(v interface{}) ([]byte, bool) {
+	b := buffer{}
+	switch v := v.(type) {
+	case string:
+		b.bytes(1, []byte(v))
+	case float64:
+		b.key(3, wire64bit)
+		bits := math.Float64bits(v)
+		for i := 0; i < 8; i++ {
+			b = append(b, byte(bits>>(8*i)))
+		}
+	case int:
+		b.key(6, wireVarint)
+		b.varint(uint64((int64(v) << 1) ^ (int64(v) >> 63)))
+	case bool:
+		flag := uint64(0)
+		if v {
+			flag = 1
+		}
+		b.uint(7, flag)
+	default:
+		return nil, false
+	}
+	return b, true
+}
+
+func (l Layer) encode() []byte {
+	keys := []string{}
+	keyIndex := map[string]int{}
+	values := [][]byte{}
+	valueIndex := map[string]int{}
+
+	features := buffer{}
+	for _, f := range l.Features {
+		commands := f.commands()
+		if len(commands) == 0 {
+			continue
+		}
+
+		names := []string{}
+		for name := range f.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		tags := []uint32{}
+		for _, name := range names {
+			encoded, ok := value(f.Properties[name])
+			if !ok {
+				continue
+			}
+			if _, ok := keyIndex[name]; !ok {
+				keyIndex[name] = len(keys)
+				keys = append(keys, name)
+			}
+			if _, ok := valueIndex[string(encoded)]; !ok {
+				valueIndex[string(encoded)] = len(values)
+				values = append(values, encoded)
+			}
+			tags = append(tags, uint32(keyIndex[name]), uint32(valueIndex[string(encoded)]))
+		}
+
+		feature := buffer{}
+		if f.ID != 0 {
+			feature.uint(1, f.ID)
+		}
+		if len(tags) > 0 {
+			feature.packed(2, tags)
+		}
+		feature.uint(3, uint64(f.Type))
+		feature.packed(4, commands)
+		features.bytes(2, feature)
+	}
+
+	layer := buffer{}
+	layer.uint(15, 2)
+	layer.bytes(1, []byte(l.Name))
+	layer = append(layer, features...)
+	for _, key := range keys {
+		layer.bytes(3, []byte(key))
+	}
+	for _, v := range values {
+		layer.bytes(4, v)
+	}
+	layer.uint(5, Extent)
+	return layer
+}
+
+// Encode encodes layers as a vector tile. Features with nothing to draw are left out.
+func Encode(layers []Layer) []byte {
+	tile := buffer{}
+	for _, l := range layers {
+		tile.bytes(3, l.encode())
+	}
+	return tile
+}
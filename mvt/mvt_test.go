@@ -0,0 +1,346 @@
+package mvt
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// A protocol buffer field as read off the wire. Varints and 64 bit fields are in number, messages and
+// strings in bytes.
+type field struct {
+	number int
+	wire   int
+	value  uint64
+	bytes  []byte
+}
+
+// Reads a message's fields, failing the test if the message is cut short or has a wire type Encode
+// doesn't write.
+func readFields(t *testing.T, b []byte) []field {
+	t.Helper()
+	varint := func() uint64 {
+		var v uint64
+		for shift := uint(0); ; shift += 7 {
+			if len(b) == 0 || shift > 63 {
+				t.Fatal("varint is cut short")
+			}
+			c := b[0]
+			b = b[1:]
+			v |= uint64(c&0x7f) << shift
+			if c < 0x80 {
+				return v
+			}
+		}
+	}
+
+	fields := []field{}
+	for len(b) > 0 {
+		key := varint()
+		f := field{number: int(key >> 3), wire: int(key & 0x7)}
+		switch f.wire {
+		case wireVarint:
+			f.value = varint()
+		case wire64bit:
+			if len(b) < 8 {
+				t.Fatal("64 bit field is cut short")
+			}
+			for i := 0; i < 8; i++ {
+				f.value |= uint64(b[i]) << (8 * i)
+			}
+			b = b[8:]
+		case wireBytes:
+			n := varint()
+			if uint64(len(b)) < n {
+				t.Fatal("bytes field is cut short")
+			}
+			f.bytes, b = b[:n], b[n:]
+		default:
+			t.Fatalf("field %d has wire type %d", f.number, f.wire)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func readPacked(t *testing.T, b []byte) []uint32 {
+	t.Helper()
+	vs := []uint32{}
+	for len(b) > 0 {
+		var v uint64
+		shift := uint(0)
+		for {
+			if len(b) == 0 {
+				t.Fatal("packed varint is cut short")
+			}
+			c := b[0]
+			b = b[1:]
+			v |= uint64(c&0x7f) << shift
+			shift += 7
+			if c < 0x80 {
+				break
+			}
+		}
+		vs = append(vs, uint32(v))
+	}
+	return vs
+}
+
+func unzigzag(v uint32) int32 {
+	return int32(v>>1) ^ -int32(v&1)
+}
+
+type decodedFeature struct {
+	ID         uint64
+	Type       GeometryType
+	Properties map[string]interface{}
+	// Geometry: one part per MoveTo, with the points after it, in absolute tile coordinates.
+	Geometry [][][2]int32
+}
+
+type decodedLayer struct {
+	Name     string
+	Version  uint64
+	Extent   uint64
+	Features []decodedFeature
+}
+
+// Decodes a tile the way a vector tile reader would, following the spec rather than Encode.
+func decode(t *testing.T, tile []byte) []decodedLayer {
+	t.Helper()
+	layers := []decodedLayer{}
+	for _, lf := range readFields(t, tile) {
+		if lf.number != 3 {
+			t.Fatalf("tile has field %d, want only layers", lf.number)
+		}
+
+		layer := decodedLayer{}
+		keys := []string{}
+		values := []interface{}{}
+		features := [][]field{}
+		for _, f := range readFields(t, lf.bytes) {
+			switch f.number {
+			case 1:
+				layer.Name = string(f.bytes)
+			case 2:
+				features = append(features, readFields(t, f.bytes))
+			case 3:
+				keys = append(keys, string(f.bytes))
+			case 4:
+				vf := readFields(t, f.bytes)
+				if len(vf) != 1 {
+					t.Fatalf("value has %d fields, want 1", len(vf))
+				}
+				switch vf[0].number {
+				case 1:
+					values = append(values, string(vf[0].bytes))
+				case 3:
+					values = append(values, math.Float64frombits(vf[0].value))
+				case 6:
+					values = append(values, int(int64(vf[0].value>>1)^-int64(vf[0].value&1)))
+				case 7:
+					values = append(values, vf[0].value == 1)
+				default:
+					t.Fatalf("value has field %d", vf[0].number)
+				}
+			case 5:
+				layer.Extent = f.value
+			case 15:
+				layer.Version = f.value
+			default:
+				t.Fatalf("layer has field %d", f.number)
+			}
+		}
+
+		for _, fields := range features {
+			feature := decodedFeature{Properties: map[string]interface{}{}}
+			for _, f := range fields {
+				switch f.number {
+				case 1:
+					feature.ID = f.value
+				case 2:
+					tags := readPacked(t, f.bytes)
+					if len(tags)%2 != 0 {
+						t.Fatalf("feature has %d tags, want pairs", len(tags))
+					}
+					for i := 0; i < len(tags); i += 2 {
+						if int(tags[i]) >= len(keys) || int(tags[i+1]) >= len(values) {
+							t.Fatalf("tag %d, %d is past the layer's keys or values", tags[i], tags[i+1])
+						}
+						feature.Properties[keys[tags[i]]] = values[tags[i+1]]
+					}
+				case 3:
+					feature.Type = GeometryType(f.value)
+				case 4:
+					feature.Geometry = decodeGeometry(t, readPacked(t, f.bytes))
+				default:
+					t.Fatalf("feature has field %d", f.number)
+				}
+			}
+			layer.Features = append(layer.Features, feature)
+		}
+		layers = append(layers, layer)
+	}
+	return layers
+}
+
+func decodeGeometry(t *testing.T, commands []uint32) [][][2]int32 {
+	t.Helper()
+	parts := [][][2]int32{}
+	var x, y int32
+	for i := 0; i < len(commands); {
+		id, count := commands[i]&0x7, int(commands[i]>>3)
+		i++
+		if id != 1 && id != 2 {
+			t.Fatalf("command %d, want MoveTo or LineTo", id)
+		}
+		if count == 0 || i+2*count > len(commands) {
+			t.Fatalf("command %d has %d points with %d integers left", id, count, len(commands)-i)
+		}
+		if id == 1 {
+			parts = append(parts, [][2]int32{})
+		} else if len(parts) == 0 {
+			t.Fatal("LineTo before any MoveTo")
+		}
+		for k := 0; k < count; k++ {
+			x += unzigzag(commands[i])
+			y += unzigzag(commands[i+1])
+			i += 2
+			parts[len(parts)-1] = append(parts[len(parts)-1], [2]int32{x, y})
+		}
+	}
+	return parts
+}
+
+func TestEncodePoints(t *testing.T) {
+	layers := decode(t, Encode([]Layer{
+		{Name: "pois", Features: []Feature{
+			{ID: 2000085, Type: Point, Geometry: [][][2]float64{{{100.4, 200.6}}},
+				Properties: map[string]interface{}{"osmid": 2000085, "count": 3, "name": "Cafe 8", "open": true, "score": 0.75}},
+			// Points are relative to the last one, across features too, and can be off the tile in its buffer.
+			{ID: 7, Type: Point, Geometry: [][][2]float64{{{-10, 4100}, {50, 50}}},
+				Properties: map[string]interface{}{"count": 3, "skipped": []int{1}}},
+		}},
+		{Name: "empty"},
+	}))
+
+	want := []decodedLayer{
+		{Name: "pois", Version: 2, Extent: Extent, Features: []decodedFeature{
+			{ID: 2000085, Type: Point, Geometry: [][][2]int32{{{100, 201}}},
+				Properties: map[string]interface{}{"osmid": 2000085, "count": 3, "name": "Cafe 8", "open": true, "score": 0.75}},
+			{ID: 7, Type: Point, Geometry: [][][2]int32{{{-10, 4100}, {50, 50}}},
+				Properties: map[string]interface{}{"count": 3}},
+		}},
+		{Name: "empty", Version: 2, Extent: Extent},
+	}
+	if !reflect.DeepEqual(layers, want) {
+		t.Errorf("got  %+v\nwant %+v", layers, want)
+	}
+}
+
+func TestEncodeLines(t *testing.T) {
+	layers := decode(t, Encode([]Layer{
+		{Name: "trails", Features: []Feature{
+			{ID: 1, Type: LineString, Geometry: [][][2]float64{
+				{{0, 0}, {10, 0}, {10, 0.2}, {10, 10}},
+				// Too short to draw, so it's left out of the feature.
+				{{500, 500}, {500.3, 499.8}},
+				{{4000, 4000}, {4096, 4096}},
+			}, Properties: map[string]interface{}{"botid": 1}},
+			// Nothing to draw at all, so the feature is left out.
+			{ID: 2, Type: LineString, Geometry: [][][2]float64{{{5, 5}}, {{6, 6}, {6.1, 6.1}}}},
+			{ID: 3, Type: LineString, Geometry: [][][2]float64{{{4096, 0}, {0, 4096}}}},
+		}},
+	}))
+
+	want := []decodedLayer{
+		{Name: "trails", Version: 2, Extent: Extent, Features: []decodedFeature{
+			{ID: 1, Type: LineString, Geometry: [][][2]int32{
+				{{0, 0}, {10, 0}, {10, 10}},
+				{{4000, 4000}, {4096, 4096}},
+			}, Properties: map[string]interface{}{"botid": 1}},
+			{ID: 3, Type: LineString, Geometry: [][][2]int32{{{4096, 0}, {0, 4096}}},
+				Properties: map[string]interface{}{}},
+		}},
+	}
+	if !reflect.DeepEqual(layers, want) {
+		t.Errorf("got  %+v\nwant %+v", layers, want)
+	}
+}
+
+func TestClipLine(t *testing.T) {
+	low, high := float64(-Buffer), float64(Extent+Buffer)
+	cases := []struct {
+		name   string
+		a, b   [2]float64
+		ok     bool
+		ca, cb [2]float64
+	}{
+		{"inside", [2]float64{10, 20}, [2]float64{4000, 30}, true, [2]float64{10, 20}, [2]float64{4000, 30}},
+		{"out the east edge", [2]float64{2048, 100}, [2]float64{8192, 100}, true, [2]float64{2048, 100}, [2]float64{high, 100}},
+		{"in the west edge", [2]float64{-1000, 2048}, [2]float64{2048, 2048}, true, [2]float64{low, 2048}, [2]float64{2048, 2048}},
+		{"across north to south", [2]float64{1000, -5000}, [2]float64{1000, 9000}, true, [2]float64{1000, low}, [2]float64{1000, high}},
+		{"across a corner", [2]float64{-200, 100}, [2]float64{100, -200}, true, [2]float64{low, -36}, [2]float64{-36, low}},
+		{"within the buffer", [2]float64{-30, -30}, [2]float64{-10, -50}, true, [2]float64{-30, -30}, [2]float64{-10, -50}},
+		{"all to the east", [2]float64{5000, 0}, [2]float64{6000, 4096}, false, [2]float64{}, [2]float64{}},
+		{"past the corner", [2]float64{-300, 100}, [2]float64{100, -300}, false, [2]float64{}, [2]float64{}},
+		{"along an edge outside", [2]float64{-100, 0}, [2]float64{-100, 4096}, false, [2]float64{}, [2]float64{}},
+	}
+	for _, c := range cases {
+		ca, cb, ok := ClipLine(c.a, c.b)
+		if ok != c.ok {
+			t.Errorf("%s: got %v, want %v", c.name, ok, c.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		for _, p := range [][2][2]float64{{ca, c.ca}, {cb, c.cb}} {
+			if math.Abs(p[0][0]-p[1][0]) > 1e-9 || math.Abs(p[0][1]-p[1][1]) > 1e-9 {
+				t.Errorf("%s: clipped to %v, %v, want %v, %v", c.name, ca, cb, c.ca, c.cb)
+				break
+			}
+		}
+		if !Inside(ca) || !Inside(cb) {
+			t.Errorf("%s: clipped to %v, %v, which isn't inside", c.name, ca, cb)
+		}
+	}
+
+	// A clipped line encodes with its ends on the buffer's edges.
+	a, b, _ := ClipLine([2]float64{-1000, 2048}, [2]float64{9000, 2048})
+	layers := decode(t, Encode([]Layer{{Name: "trails", Features: []Feature{
+		{ID: 1, Type: LineString, Geometry: [][][2]float64{{a, b}}},
+	}}}))
+	got := layers[0].Features[0].Geometry
+	want := [][][2]int32{{{-Buffer, 2048}, {Extent + Buffer, 2048}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("clipped line encoded as %v, want %v", got, want)
+	}
+}
+
+func TestTilePoint(t *testing.T) {
+	tile, err := NewTile(14, 8802, 5373)
+	if err != nil {
+		t.Fatal(err)
+	}
+	south, west, north, east := tile.Bounds()
+	corners := []struct {
+		lat, lon float64
+		want     [2]float64
+	}{
+		{north, west, [2]float64{-Buffer, -Buffer}},
+		{south, east, [2]float64{Extent + Buffer, Extent + Buffer}},
+	}
+	for _, c := range corners {
+		p := tile.Point(c.lat, c.lon)
+		if math.Abs(p[0]-c.want[0]) > 1e-6 || math.Abs(p[1]-c.want[1]) > 1e-6 {
+			t.Errorf("%f, %f is at %v, want %v", c.lat, c.lon, p, c.want)
+		}
+	}
+
+	for _, bad := range [][3]int{{-1, 0, 0}, {MaxZoom + 1, 0, 0}, {2, 4, 0}, {2, 0, -1}} {
+		if _, err := NewTile(bad[0], bad[1], bad[2]); err == nil {
+			t.Errorf("tile %v was allowed", bad)
+		}
+	}
+}
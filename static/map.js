@@ -2,72 +2,551 @@
 // var mymap = L.map('map').fitWorld();
 // mymap.locate({ setView: true, maxZoom: 16 });
 
-var mymap = L.map('map').setView([bots[0].Lat, bots[0].Lon], 13);
+var mymap = L.map('map').setView([20, 0], 2);
 
-L.tileLayer('https://api.tiles.mapbox.com/v4/{id}/{z}/{x}/{y}.png?access_token={accessToken}', {
-    attribution: 'Map data &copy; <a href="https://www.openstreetmap.org/">OpenStreetMap</a> contributors, <a href="https://creativecommons.org/licenses/by-sa/2.0/">CC-BY-SA</a>, Imagery © <a href="https://www.mapbox.com/">Mapbox</a>',
-    maxZoom: 18,
-    id: 'mapbox.streets',
-    accessToken: 'pk.eyJ1IjoiYWxleGFsZXh5YW5nIiwiYSI6ImNqdTg2aGhtcTA2dzgzem9iMzk2ejNkbmoifQ.agUSBaqeL35dVXu9rBGPjA'
+// Tile settings come from the server's config, see travel.gohtml. A basemap of vector tiles is drawn with
+// Leaflet.VectorGrid's default styles, and zoomed in past its last zoom level.
+if (tiles.vector && L.vectorGrid) {
+    L.vectorGrid.protobuf(tiles.url, {
+        attribution: tiles.attribution,
+        maxNativeZoom: tiles.maxZoom,
+        maxZoom: 22
+    }).addTo(mymap);
+} else {
+    L.tileLayer(tiles.url, {
+        attribution: tiles.attribution,
+        maxNativeZoom: tiles.maxZoom,
+        maxZoom: Math.max(tiles.maxZoom, 18),
+        id: 'mapbox.streets',
+        accessToken: tiles.accessToken
+    }).addTo(mymap);
+}
+
+// Candidate POIs in red, and the same POIs coloured by how complete their OSM tags are.
+var candidatesLayer = L.layerGroup().addTo(mymap);
+var completenessLayer = L.layerGroup();
+// Geofences: forbidden zones in red, allowed regions in blue.
+var geofencesLayer = L.layerGroup().addTo(mymap);
+// Trails and visited POIs in purple, from the server's vector tiles. The tiles have bots and candidates too,
+// but those are drawn from /api/v1/map, so they're left out here.
+var trailsLayer = L.layerGroup();
+if (L.vectorGrid) {
+    trailsLayer = L.vectorGrid.protobuf('/tiles/{z}/{x}/{y}.mvt', {
+        maxNativeZoom: 22,
+        vectorTileLayerStyles: {
+            bots: [],
+            candidates: [],
+            visited: { radius: 3, color: 'purple', fill: true, fillColor: 'purple', fillOpacity: 0.6, weight: 1 },
+            trails: { color: 'purple', weight: 1.5, opacity: 0.6 }
+        }
+    });
+}
+trailsLayer.addTo(mymap);
+
+L.control.layers(null, {
+    'Next possible locations': candidatesLayer,
+    'OSM data gaps': completenessLayer,
+    'Geofences': geofencesLayer,
+    'Trails': trailsLayer
 }).addTo(mymap);
 
-// Do stuff on the map.
+fetch('/api/geofences')
+    .then(function(response) { return response.json(); })
+    .then(function(fences) {
+        L.geoJSON(fences, {
+            style: function(feature) {
+                var forbidden = feature.properties.kind === 'forbidden';
+                return {
+                    color: forbidden ? 'red' : 'blue',
+                    weight: 1,
+                    dashArray: forbidden ? null : '4',
+                    fillOpacity: forbidden ? 0.15 : 0.05
+                };
+            },
+            onEachFeature: function(feature, layer) {
+                var p = feature.properties;
+                layer.bindPopup('<h3>' + (p.name || 'Geofence ' + feature.id) + '</h3>' +
+                    '<p>' + p.kind + (p.botid ? ' for bot ' + p.botid : ' for every bot') + '</p>');
+            }
+        }).addTo(geofencesLayer);
+    });
 
-for (i = 0; i < bots.length; i++) {
-    console.log("Bot is: ", bots[i].Name)
+// Red for no expected tags, through yellow, to green for all of them.
+function completenessColour(completeness) {
+    return 'hsl(' + Math.round(completeness * 120) + ', 90%, 45%)';
+}
 
-    var name = bots[i].Name
-    var lat = bots[i].Lat
-    var lon = bots[i].Lon
 
-    var botCircle = L.circle([lat, lon], {
-        color: 'green',
-        fillColor: 'green',
+// Bots in green, stuck bots grey, paused bots orange.
+var botsLayer = L.layerGroup().addTo(mymap);
+var bots = [];
+
+function drawBot(bot) {
+    var botColour = bot.Stuck ? 'grey' : 'green'
+    if (bot.Paused) {
+        botColour = 'orange'
+    }
+
+    var botCircle = L.circle([bot.Lat, bot.Lon], {
+        color: botColour,
+        fillColor: botColour,
         fillOpacity: 0.2,
         weight: 0.6,
         radius: 50
-    }).addTo(mymap);
+    }).addTo(botsLayer);
+
+    var botText = '<h3>' + bot.Name + '</h3>' +
+        '<p>I\'m here!</p>' +
+        '<p>' + bot.Lat + ', ' + bot.Lon + '</p>' +
+        '<p><a href="/bots/' + bot.ID + '">Profile</a></p>'
 
-    botText = '<h3>' + bots[i].Name + '</h3>' +
-        '</p>I\'m here!</h3>' +
-        '<p>' + lat + ', ' + lon + '</p>'
+    if (bot.Stuck) {
+        botText += '<p>I\'m stuck! Nothing within ' + bot.SearchRadius + ' m since ' + bot.StuckSince + '.</p>'
+    }
 
     botCircle.bindPopup(botText);
+}
+
+function drawPOI(poi) {
+    var circle = L.circle([poi.lat, poi.lon], {
+        color: 'red',
+        fillColor: '#f03',
+        fillOpacity: 0.2,
+        weight: 0.6,
+        radius: 10
+    }).addTo(candidatesLayer);
+
+    var text = 'Amenity: ' + poi.tags.Amenity + '</br>' +
+        poi.lat + ', ' + poi.lon + '</br>' +
+        '<h3>Name: ' + poi.tags.Name_en + '</h3>' +
+        '<p>Description: ' + poi.tags.Description + '</p>' +
+        'Address: </br>' +
+        '<p>' + poi.tags.Addr_housenumber + " " + poi.tags.Addr_street + '</p>' +
+        '<p>Opening hours: ' + poi.tags.Opening_hours + '</p>' +
+        '<p>Phone: ' + poi.tags.Phone + '</p>' +
+        '<p>Cuisine: ' + poi.tags.Cuisine + '</p>' +
+        '<p>Internet: ' + poi.tags.Internet_access + '</p>' +
+        '<p>Wheelchair: ' + poi.tags.Wheelchair + '</p>' +
+        '<p>Smoking: ' + poi.tags.Smoking + '</p>'
+
+    circle.bindPopup(text);
+
+    var missing = poi.missing || [];
+    var gapCircle = L.circle([poi.lat, poi.lon], {
+        color: completenessColour(poi.completeness),
+        fillColor: completenessColour(poi.completeness),
+        fillOpacity: 0.6,
+        weight: 0.6,
+        radius: 10
+    }).addTo(completenessLayer);
+
+    var gapText = '<h3>' + Math.round(poi.completeness * 100) + '% complete</h3>' +
+        '<p>Missing: ' + (missing.length > 0 ? missing.join(', ') : 'nothing!') + '</p>' +
+        '<a href="https://www.openstreetmap.org/node/' + poi.id + '" target="_blank">Edit on OSM</a>'
+
+    gapCircle.bindPopup(gapText);
+}
+
+// POIs the server grouped because they're too close together at this zoom. Clicking one zooms in on it.
+function drawCluster(cluster) {
+    var size = 20 + Math.min(cluster.count, 100) / 5;
+    var layers = [
+        [candidatesLayer, 'rgba(255, 0, 51, 0.6)'],
+        [completenessLayer, completenessColour(cluster.completeness)]
+    ];
+    layers.forEach(function(layer) {
+        L.marker([cluster.lat, cluster.lon], {
+            icon: L.divIcon({
+                className: 'poi-cluster',
+                html: '<span style="background: ' + layer[1] + '">' + cluster.count + '</span>',
+                iconSize: [size, size]
+            })
+        }).on('click', function() {
+            mymap.setView([cluster.lat, cluster.lon], mymap.getZoom() + 2);
+        }).addTo(layer[0]);
+    });
+}
+
+function drawMap(data) {
+    bots = data.bots;
+    botsLayer.clearLayers();
+    candidatesLayer.clearLayers();
+    completenessLayer.clearLayers();
+
+    bots.forEach(drawBot);
+    data.pois.forEach(drawPOI);
+    data.clusters.forEach(drawCluster);
+    showAccount();
+}
+
+// Longitudes from Leaflet go past 180 when the map is scrolled round the world.
+function wrapLon(lon) {
+    return ((lon + 180) % 360 + 360) % 360 - 180;
+}
+
+// The map is fetched for what's in view whenever the view changes, and every 10 seconds. The server answers
+// 304 Not Modified if nothing changed since mapETag. It isn't redrawn under open popups or drags, unless forced.
+var mapETag = null;
+var mapBusy = 0;
+// Whether the history is being replayed instead of showing bots live.
+var replaying = false;
+var mapLoaded = false;
+
+function loadMap(force) {
+    if (replaying || (mapBusy > 0 && !force)) {
+        return;
+    }
+
+    var bounds = mymap.getBounds();
+    var west = -180;
+    var east = 180;
+    if (bounds.getEast() - bounds.getWest() < 360) {
+        west = wrapLon(bounds.getWest());
+        east = wrapLon(bounds.getEast());
+    }
+    var south = Math.max(bounds.getSouth(), -90);
+    var north = Math.min(bounds.getNorth(), 90);
+    var url = '/api/v1/map?bbox=' + [west, south, east, north].join(',') + '&zoom=' + mymap.getZoom();
+
+    var headers = {};
+    if (mapETag && !force) {
+        headers['If-None-Match'] = mapETag;
+    }
+    fetch(url, { headers: headers, cache: 'no-store', credentials: 'same-origin' }).then(function(response) {
+        if (response.status === 304) {
+            return;
+        }
+        if (!response.ok) {
+            return response.text().then(function(text) { throw new Error(text.trim()); });
+        }
+        mapETag = response.headers.get('ETag');
+        return response.json().then(function(data) {
+            // Start zoomed in on the first bot, like before.
+            if (!mapLoaded && data.bots.length > 0) {
+                mapLoaded = true;
+                mymap.setView([data.bots[0].Lat, data.bots[0].Lon], 13);
+                return;
+            }
+            mapLoaded = true;
+            drawMap(data);
+        });
+    }).catch(function(err) {
+        console.log('Loading the map failed: ', err.message);
+    });
+}
+
+mymap.on('moveend', function() { loadMap(); });
+mymap.on('popupopen', function() { mapBusy++; });
+mymap.on('popupclose', function() { mapBusy = Math.max(mapBusy - 1, 0); });
+setInterval(loadMap, 10000);
+
+// Bot management. Logged in users can click the map to place a new bot, and change or delete their own bots.
+var me = null;
+var botTypes = [];
+var manageLayer = L.layerGroup().addTo(mymap);
 
-    var pois = bots[i].Pois
-        // In case there are no POIs, we check for null.
-    if (pois != null) {
-        for (j = 0; j < pois.length; j++) {
-            // console.log(pois[j])
-            var circle = L.circle([pois[j].lat, pois[j].lon], {
-                color: 'red',
-                fillColor: '#f03',
-                fillOpacity: 0.2,
-                weight: 0.6,
-                radius: 10
-            }).addTo(mymap);
-
-            // console.log(pois[j].tags)
-
-            text = 'Amenity: ' + pois[j].tags.Amenity + '</br>' +
-                pois[j].lat + ', ' + pois[j].lon + '</br>' +
-                '<h3>Name: ' + pois[j].tags.Name_en + '</h3>' +
-                '<p>Description: ' + pois[j].tags.Description + '</p>' +
-                'Address: </br>' +
-                '<p>' + pois[j].tags.Addr_housenumber + " " + pois[j].tags.Addr_street + '</p>' +
-                '<p>Opening hours: ' + pois[j].tags.Opening_hours + '</p>' +
-                '<p>Phone: ' + pois[j].tags.Phone + '</p>' +
-                '<p>Cuisine: ' + pois[j].tags.Cuisine + '</p>' +
-                '<p>Internet: ' + pois[j].tags.Internet + '</p>' +
-                '<p>Wheelchair: ' + pois[j].tags.Wheelchair + '</p>' +
-                '<p>Smoking: ' + pois[j].tags.Smoking + '</p>'
-
-            circle.bindPopup(text);
+// Calls the JSON API. Rejects with the server's message if the request fails.
+function api(method, url, body) {
+    var options = { method: method, credentials: 'same-origin', headers: {} };
+    if (body !== undefined) {
+        options.headers['Content-Type'] = 'application/json';
+        options.body = JSON.stringify(body);
+    }
+    return fetch(url, options).then(function(response) {
+        if (!response.ok) {
+            return response.text().then(function(text) { throw new Error(text.trim()); });
+        }
+        return response.status === 204 ? null : response.json();
+    });
+}
+
+function showError(err) {
+    document.getElementById('account-error').textContent = err.message;
+}
+
+// Makes an element. Text is set with textContent, so names typed by users can't inject HTML.
+function el(tag, attributes, children) {
+    var element = document.createElement(tag);
+    for (var name in attributes || {}) {
+        element.setAttribute(name, attributes[name]);
+    }
+    (children || []).forEach(function(child) {
+        element.appendChild(typeof child === 'string' ? document.createTextNode(child) : child);
+    });
+    return element;
+}
+
+function categoriesFromText(text) {
+    return text.split(',').map(function(c) { return c.trim(); }).filter(function(c) { return c !== ''; });
+}
+
+function showAccount() {
+    if (!document.getElementById('account')) {
+        return;
+    }
+    document.getElementById('loggedout').hidden = me !== null;
+    document.getElementById('loggedin').hidden = me === null;
+    document.getElementById('whoami').textContent = me ? 'Logged in as ' + me.name + ' (user ' + me.userid + ')' : '';
+    document.getElementById('account-error').textContent = '';
+    manageLayer.clearLayers();
+    if (me) {
+        bots.forEach(function(bot) {
+            if (bot.UserID === me.userid) {
+                addBotControls(bot);
+            }
+        });
+    }
+}
+
+function newBotForm(latlng) {
+    var name = el('input', { type: 'text' });
+    var type = el('select', {}, botTypes.map(function(t) {
+        return el('option', { value: t.name, title: t.description }, [t.name]);
+    }));
+    var categories = el('input', { type: 'text', placeholder: 'cafe, bar' });
+    var radius = el('input', { type: 'number', value: '1000' });
+    var state = el('input', { type: 'text', placeholder: '{"work": {"lat": 0, "lon": 0}}' });
+    var create = el('button', {}, ['Create bot']);
+
+    create.addEventListener('click', function() {
+        var newBot = {
+            name: name.value,
+            lat: latlng.lat,
+            lon: latlng.lng,
+            radius: Number(radius.value),
+            type: type.value,
+            categories: categoriesFromText(categories.value)
+        };
+        try {
+            if (state.value.trim() !== '') {
+                newBot.state = JSON.parse(state.value);
+            }
+        } catch (err) {
+            showError(err);
+            return;
         }
+        api('POST', '/api/bots', newBot).then(function() { loadMap(true); }).catch(showError);
+    });
+
+    return el('div', { 'class': 'bot-form' }, [
+        el('h3', {}, ['New bot here']),
+        el('label', {}, ['Name ', name]),
+        el('label', {}, ['Type ', type]),
+        el('label', {}, ['Categories ', categories]),
+        el('label', {}, ['Radius (metres) ', radius]),
+        el('label', {}, ['Type settings (JSON) ', state]),
+        create
+    ]);
+}
 
+function botForm(bot) {
+    var categories = el('input', { type: 'text', value: (bot.Categories || []).join(', ') });
+    var save = el('button', {}, ['Save categories']);
+    var pause = el('button', {}, [bot.Paused ? 'Resume' : 'Pause']);
+    var remove = el('button', {}, ['Delete']);
+
+    save.addEventListener('click', function() {
+        api('PATCH', '/api/bots/' + bot.ID, { categories: categoriesFromText(categories.value) })
+            .then(function() { loadMap(true); }).catch(showError);
+    });
+    pause.addEventListener('click', function() {
+        api('PATCH', '/api/bots/' + bot.ID, { paused: !bot.Paused })
+            .then(function() { loadMap(true); }).catch(showError);
+    });
+    remove.addEventListener('click', function() {
+        if (confirm('Delete ' + bot.Name + ' and everything it has done?')) {
+            api('DELETE', '/api/bots/' + bot.ID).then(function() { loadMap(true); }).catch(showError);
+        }
+    });
+
+    return el('div', { 'class': 'bot-form' }, [
+        el('h3', {}, [bot.Name + ' (' + bot.Type + ')']),
+        el('label', {}, ['Categories ', categories]),
+        save, pause, remove
+    ]);
+}
+
+// A draggable home marker, and a dashed radius circle with a handle on its east edge to resize it.
+function addBotControls(bot) {
+    var home = bot.Routine && bot.Routine.home ? [bot.Routine.home.lat, bot.Routine.home.lon] : [bot.Lat, bot.Lon];
+    var homeMarker = L.marker(home, { draggable: true, title: bot.Name + '\'s home' }).addTo(manageLayer);
+    homeMarker.bindPopup(botForm(bot));
+    homeMarker.on('dragstart', function() { mapBusy++; });
+    homeMarker.on('dragend', function() {
+        mapBusy--;
+        var latlng = homeMarker.getLatLng();
+        api('PATCH', '/api/bots/' + bot.ID, { home: { lat: latlng.lat, lon: latlng.lng } })
+            .then(function() { loadMap(true); }).catch(showError);
+    });
+
+    var centre = L.latLng(bot.Lat, bot.Lon);
+    var radiusCircle = L.circle(centre, {
+        radius: bot.Radius,
+        color: 'green',
+        weight: 1,
+        dashArray: '4',
+        fill: false
+    }).addTo(manageLayer);
 
+    var handle = L.marker([centre.lat, radiusCircle.getBounds().getEast()], {
+        draggable: true,
+        title: 'Drag to change ' + bot.Name + '\'s radius',
+        icon: L.divIcon({ className: '', html: '&#8596;', iconSize: [16, 16] })
+    }).addTo(manageLayer);
+    handle.on('dragstart', function() { mapBusy++; });
+    handle.on('drag', function() {
+        radiusCircle.setRadius(centre.distanceTo(handle.getLatLng()));
+    });
+    handle.on('dragend', function() {
+        mapBusy--;
+        var radius = Math.round(centre.distanceTo(handle.getLatLng()));
+        api('PATCH', '/api/bots/' + bot.ID, { radius: radius })
+            .then(function() { loadMap(true); }).catch(showError);
+    });
+}
 
+mymap.on('click', function(e) {
+    if (me) {
+        L.popup().setLatLng(e.latlng).setContent(newBotForm(e.latlng)).openOn(mymap);
     }
+});
 
+function loginWith(url, body) {
+    api('POST', url, body).then(function(user) {
+        me = user;
+        showAccount();
+    }).catch(showError);
+}
+
+if (document.getElementById('account')) {
+    document.getElementById('login').addEventListener('click', function() {
+        loginWith('/api/login', {
+            userid: Number(document.getElementById('login-userid').value),
+            password: document.getElementById('login-password').value
+        });
+    });
+    document.getElementById('signup').addEventListener('click', function() {
+        loginWith('/api/signup', {
+            name: document.getElementById('login-name').value,
+            password: document.getElementById('login-password').value
+        });
+    });
+    document.getElementById('logout').addEventListener('click', function() {
+        api('POST', '/api/logout').then(function() {
+            me = null;
+            showAccount();
+        }).catch(showError);
+    });
+
+    api('GET', '/api/bottypes').then(function(types) { botTypes = types; }).catch(showError);
+    api('GET', '/api/me').then(function(user) {
+        me = user;
+        showAccount();
+    }).catch(function() { showAccount(); });
+}
+
+loadMap();
+
+
+// Replaying history. /api/v1/history gives each bot's position at every step of the window; the slider picks
+// a step, and each bot is shown there with its trail so far and the POIs it has visited by then.
+var historyLayer = L.layerGroup();
+var replay = null;
+var replayTimer = null;
+
+function showFrame(frame) {
+    historyLayer.clearLayers();
+    var time = replay.times[frame];
+    document.getElementById('history-slider').value = frame;
+    document.getElementById('history-time').textContent = time;
+
+    replay.bots.forEach(function(bot) {
+        var trail = bot.positions.slice(0, frame + 1);
+        L.polyline(trail, { color: 'purple', weight: 1.5, opacity: 0.6 }).addTo(historyLayer);
+        L.circle(trail[trail.length - 1], {
+            color: 'green',
+            fillColor: 'green',
+            fillOpacity: 0.4,
+            weight: 0.6,
+            radius: 50
+        }).bindTooltip(bot.name).addTo(historyLayer);
+    });
+
+    replay.visits.forEach(function(visit) {
+        // Times are all RFC 3339 in UTC, so they compare as strings.
+        if (visit.at <= time) {
+            L.circleMarker([visit.lat, visit.lon], {
+                radius: 3,
+                color: 'purple',
+                fillOpacity: 0.6,
+                weight: 1
+            }).bindTooltip('Bot ' + visit.botid + ' visited ' + visit.osmid + ' at ' + visit.at).addTo(historyLayer);
+        }
+    });
+}
+
+function stopPlaying() {
+    clearInterval(replayTimer);
+    replayTimer = null;
+    document.getElementById('history-play').textContent = 'Play';
+}
+
+function startReplay() {
+    var choice = document.getElementById('history-window').value.split(',');
+    var from = new Date(Date.now() - parseInt(choice[0], 10) * 3600 * 1000).toISOString().replace(/\.\d+Z$/, 'Z');
+
+    api('GET', '/api/v1/history?from=' + from + '&step=' + choice[1]).then(function(data) {
+        replay = data;
+        replaying = true;
+        stopPlaying();
+        mymap.removeLayer(botsLayer);
+        mymap.removeLayer(candidatesLayer);
+        mymap.removeLayer(manageLayer);
+        historyLayer.addTo(mymap);
+
+        document.getElementById('history-slider').max = replay.times.length - 1;
+        document.getElementById('history-controls').hidden = false;
+        showFrame(0);
+    }).catch(function(err) {
+        document.getElementById('history-time').textContent = err.message;
+    });
+}
+
+if (document.getElementById('history')) {
+    document.getElementById('history-load').addEventListener('click', startReplay);
+
+    document.getElementById('history-slider').addEventListener('input', function(e) {
+        stopPlaying();
+        showFrame(parseInt(e.target.value, 10));
+    });
+
+    document.getElementById('history-play').addEventListener('click', function() {
+        if (replayTimer) {
+            stopPlaying();
+            return;
+        }
+        var frame = parseInt(document.getElementById('history-slider').value, 10);
+        if (frame >= replay.times.length - 1) {
+            frame = 0;
+        }
+        document.getElementById('history-play').textContent = 'Pause';
+        replayTimer = setInterval(function() {
+            showFrame(frame);
+            frame++;
+            if (frame >= replay.times.length) {
+                stopPlaying();
+            }
+        }, 200);
+    });
 
+    document.getElementById('history-live').addEventListener('click', function() {
+        stopPlaying();
+        replaying = false;
+        mymap.removeLayer(historyLayer);
+        botsLayer.addTo(mymap);
+        candidatesLayer.addTo(mymap);
+        manageLayer.addTo(mymap);
+        document.getElementById('history-controls').hidden = true;
+        loadMap(true);
+    });
 }
\ No newline at end of file